@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"errors"
 	"fmt"
 	"os"
 )
@@ -19,8 +20,10 @@ type ActivationCheck struct {
 	Protocol string `json:"protocol"`
 	Agent    string `json:"agent"`
 
-	handler ActivationHandler
-	config  map[string]string
+	handler  ActivationHandler
+	config   map[string]string
+	protocol *protocol
+	span     *Span
 
 	externalAgent
 }
@@ -41,25 +44,55 @@ func newActivation(h interface{}, config map[string]string) (*ActivationCheck, e
 
 // HandleRequest handles the activation check
 func (ac *ActivationCheck) HandleRequest() error {
-	err := ac.loadRequest(activationProtocol, ac)
+	if ac.protocol == nil {
+		ac.protocol = v1Protocol
+	}
+
+	span := ac.span.StartSpan("read_request")
+	err := ac.loadRequest(ac.protocol.activationRequest, ac.protocol.activationRequestSchema, ac)
+	span.SetError(err)
+	span.End()
 	if err != nil {
-		Errorf("loading request failed: %s", err)
-		os.Exit(1)
+		ac.exit("loading request failed: %s", err)
 	}
 
 	reply := &ActivationReply{}
 
+	span = ac.span.StartSpan("activation_handler")
 	reply.ShouldActivate, err = ac.handler(ac.Agent, ac.config)
+	span.SetError(err)
+	span.SetAttribute("choria.activate", reply.ShouldActivate)
+	span.End()
+	if err != nil {
+		ac.exit("activation handler failed: %s", err)
+	}
+
+	rep := ac.protocol.encodeActivationReply(reply)
+	err = ac.validateReply(ac.protocol.activationReplySchema, rep)
 	if err != nil {
-		Errorf("activation handler failed: %s", err)
-		os.Exit(1)
+		ac.exit("invalid activation reply: %s", err)
 	}
 
-	err = ac.publishReply(reply)
+	span = ac.span.StartSpan("publish_reply")
+	err = ac.publishReply(rep)
+	span.SetError(err)
+	span.End()
 	if err != nil {
-		Errorf("publishing activation reply failed: %s", err)
-		os.Exit(1)
+		ac.exit("publishing activation reply failed: %s", err)
 	}
 
+	ac.span.End()
+
 	return nil
 }
+
+// exit logs a failed activation and exits, the trace is written first as the process ends
+func (ac *ActivationCheck) exit(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+
+	ac.span.SetError(errors.New(msg))
+	ac.span.End()
+
+	Errorf("%s", msg)
+	os.Exit(1)
+}
@@ -8,15 +8,59 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/choria-io/go-external/schemas"
+	"github.com/choria-io/go-external/transport"
 )
 
 // Agent is a Choria External agent helper library that assist you with building
 // agents in Go that does not need to be compiled into the Choria binary
 type Agent struct {
-	Name       string
-	activation ActivationHandler
-	actions    map[string]ActionHandler
-	config     map[string]string
+	Name        string
+	activation  ActivationHandler
+	actions     map[string]*action
+	config      map[string]string
+	mu          sync.RWMutex
+	lockDir     string
+	jobsDir     string
+	worker      bool
+	transport   transport.Transport
+	validation  schemas.Mode
+	metricsPath string
+	tracePath   string
+
+	maxReplyBytes int
+	replyLimitSet bool
+	overflow      ReplyOverflow
+	spillDir      string
+	transferDirs  []string
+
+	// sensitive inputs and outputs per action loaded from the DDL
+	ddlSensitive map[string]*sensitivity
+
+	// when the configuration was parsed, recorded as a span in traces
+	configStarted time.Time
+	configParsed  time.Time
+
+	idempotencyDir       string
+	idempotencyRetention time.Duration
+}
+
+// ActionOption configures optional behavior of a registered action
+type ActionOption func(*action)
+
+type action struct {
+	name    string
+	handler ActionHandler
+	lock    *lockSettings
+
+	idempotent bool
+	job        bool
+	sensitive  *sensitivity
+
+	truncatable []string
 }
 
 // NewAgent creates a new agent
@@ -24,15 +68,41 @@ func NewAgent(name string) *Agent {
 	a := &Agent{
 		Name:    name,
 		config:  make(map[string]string),
-		actions: make(map[string]ActionHandler),
+		actions: make(map[string]*action),
+
+		ddlSensitive: make(map[string]*sensitivity),
 	}
 
+	a.configStarted = time.Now()
 	err := a.parseConfig()
+	a.configParsed = time.Now()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Could not parse configuration: %s", err)
 		os.Exit(1)
 	}
 
+	_, err = schemas.ParseMode(a.config["schema_validation"])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not parse configuration: %s", err)
+		os.Exit(1)
+	}
+
+	if a.config["ddl_file"] != "" {
+		err = a.LoadDDL(a.config["ddl_file"])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not load DDL: %s", err)
+			os.Exit(1)
+		}
+	}
+
+	if a.config["script_manifest"] != "" {
+		err = a.LoadScriptManifest(a.config["script_manifest"])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not load scripts: %s", err)
+			os.Exit(1)
+		}
+	}
+
 	return a
 }
 
@@ -56,27 +126,43 @@ func Facts() (json.RawMessage, error) {
 	return fj, nil
 }
 
+// SetTransport sets the transport used to read requests and write replies, by default the transport is
+// selected using the CHORIA_EXTERNAL_TRANSPORT environment variable
+func (a *Agent) SetTransport(t transport.Transport) {
+	a.transport = t
+}
+
+// Logger is the logger of the agent, messages include the agent name
+func (a *Agent) Logger() *Logger {
+	return defaultLogger.With("agent", a.Name)
+}
+
 // RegisterActivator registers a function used to check if the agent should be active,
 // with no activator set the agent will always activate
 func (a *Agent) RegisterActivator(handler ActivationHandler) {
 	a.activation = handler
 }
 
-// RegisterAction registers a new action
-func (a *Agent) RegisterAction(action string, handler ActionHandler) error {
-	_, ok := a.actions[action]
+// RegisterAction registers a new action, opts can be used to configure optional behaviors like locking
+func (a *Agent) RegisterAction(name string, handler ActionHandler, opts ...ActionOption) error {
+	_, ok := a.actions[name]
 	if ok {
-		return fmt.Errorf("duplicate action %s", action)
+		return fmt.Errorf("duplicate action %s", name)
+	}
+
+	act := &action{name: name, handler: handler, sensitive: newSensitivity()}
+	for _, opt := range opts {
+		opt(act)
 	}
 
-	a.actions[action] = handler
+	a.actions[name] = act
 
 	return nil
 }
 
 // MustRegisterAction registers an action and panics if any error occur
-func (a *Agent) MustRegisterAction(action string, handler ActionHandler) {
-	err := a.RegisterAction(action, handler)
+func (a *Agent) MustRegisterAction(name string, handler ActionHandler, opts ...ActionOption) {
+	err := a.RegisterAction(name, handler, opts...)
 	if err != nil {
 		panic(err)
 	}
@@ -84,14 +170,27 @@ func (a *Agent) MustRegisterAction(action string, handler ActionHandler) {
 
 // ProcessRequest processes an incoming request
 func (a *Agent) ProcessRequest() {
+	jobdir := os.Getenv("CHORIA_EXTERNAL_JOB")
+	if jobdir != "" {
+		a.processJob(jobdir)
+		return
+	}
+
+	socket := os.Getenv("CHORIA_EXTERNAL_WORKER")
+	if socket != "" {
+		a.processWorker(socket)
+		return
+	}
+
 	protocol := os.Getenv("CHORIA_EXTERNAL_PROTOCOL")
+	p, activation, found := protocolByName(protocol)
 
-	switch protocol {
-	case activationProtocol:
-		a.processActivation()
+	switch {
+	case found && activation:
+		a.processActivation(p)
 
-	case rpcRequestProtocol:
-		a.processRPC()
+	case found:
+		a.processRPC(p)
 
 	default:
 		fmt.Println("This binary is a Plugin for the Choria Orchestrator and should only be called from within Choria")
@@ -103,14 +202,58 @@ func (a *Agent) ProcessRequest() {
 }
 
 func (a *Agent) parseConfig() error {
-	configpath := os.Getenv("CHORIA_EXTERNAL_CONFIG")
+	config, err := parseConfigFile(os.Getenv("CHORIA_EXTERNAL_CONFIG"))
+	if err != nil {
+		return err
+	}
+
+	if config["log_level"] != "" {
+		level, err := ParseLevel(config["log_level"])
+		if err != nil {
+			return err
+		}
+
+		defaultLogger.SetLevel(level)
+	}
+
+	a.mu.Lock()
+	a.config = config
+	a.mu.Unlock()
+
+	return nil
+}
+
+// configItem is a single item from the plugin configuration, empty when not set
+func (a *Agent) configItem(item string) string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.config[item]
+}
+
+// currentConfig is a copy of the plugin configuration that handlers can safely hold on to
+func (a *Agent) currentConfig() map[string]string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	config := make(map[string]string, len(a.config))
+	for k, v := range a.config {
+		config[k] = v
+	}
+
+	return config
+}
+
+func parseConfigFile(configpath string) (map[string]string, error) {
+	config := make(map[string]string)
+
 	if configpath == "" || !fileExist(configpath) {
-		return nil
+		return config, nil
 	}
 
 	file, err := os.Open(configpath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer file.Close()
 
@@ -126,26 +269,27 @@ func (a *Agent) parseConfig() error {
 		}
 
 		matches := itemr.FindStringSubmatch(line)
-		a.config[matches[1]] = matches[2]
+		config[matches[1]] = matches[2]
 	}
 
 	if scanner.Err() != nil {
-		return scanner.Err()
+		return nil, scanner.Err()
 	}
 
-	return nil
+	return config, nil
 }
 
 func (a *Agent) defaultActivator(_ string, _ map[string]string) (bool, error) {
 	return true, nil
 }
 
-func (a *Agent) processRPC() {
-	rpch, err := newRPC(a.actions, a.config)
+func (a *Agent) processRPC(p *protocol) {
+	rpch, err := newRPC(a)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "could not create RPC handler: %s", err)
 		os.Exit(1)
 	}
+	rpch.protocol = p
 
 	err = rpch.handleRequest()
 	if err != nil {
@@ -154,16 +298,22 @@ func (a *Agent) processRPC() {
 	}
 }
 
-func (a *Agent) processActivation() {
+func (a *Agent) processActivation(p *protocol) {
 	if a.activation == nil {
 		a.activation = a.defaultActivator
 	}
 
-	activator, err := newActivation(a.activation, a.config)
+	activator, err := newActivation(a.activation, a.currentConfig())
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "could not create activation: %s", err)
 		os.Exit(1)
 	}
+	activator.transport = a.transport
+	activator.validation = a.schemaValidation()
+	activator.span = a.startTrace("activation "+a.Name, "", "", a.configStarted)
+	activator.span.SetAttribute("choria.agent", a.Name)
+	activator.span.record("config", a.configStarted, a.configParsed, nil)
+	activator.protocol = p
 
 	err = activator.HandleRequest()
 	if err != nil {
@@ -194,3 +194,72 @@ func TestProcessRequestRPC(t *testing.T) {
 		t.Errorf("reply failed, got '%s'", rmsg)
 	}
 }
+
+func processRPC(t *testing.T, agent *Agent, request string) *Reply {
+	t.Helper()
+
+	os.Setenv("CHORIA_EXTERNAL_REQUEST", request)
+	os.Setenv("CHORIA_EXTERNAL_REPLY", filepath.Join(tempDir(t), "reply.json"))
+	os.Setenv("CHORIA_EXTERNAL_PROTOCOL", "io.choria.mcorpc.external.v1.rpc_request")
+
+	err := ioutil.WriteFile(os.Getenv("CHORIA_EXTERNAL_REPLY"), []byte{}, 0600)
+	if err != nil {
+		t.Fatalf("could not create reply file: %s", err)
+	}
+
+	agent.ProcessRequest()
+
+	rj, err := ioutil.ReadFile(os.Getenv("CHORIA_EXTERNAL_REPLY"))
+	if err != nil {
+		t.Fatalf("reading reply failed: %s", err)
+	}
+
+	reply := &Reply{}
+	err = json.Unmarshal(rj, reply)
+	if err != nil {
+		t.Fatalf("parsing reply failed: %s", err)
+	}
+
+	return reply
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
+
+func requestFile(t *testing.T, action string, data interface{}) string {
+	t.Helper()
+
+	req := map[string]interface{}{
+		"$schema":   "https://choria.io/schemas/mcorpc/external/v1/rpc_request.json",
+		"protocol":  "io.choria.mcorpc.external.v1.rpc_request",
+		"agent":     "helloworld",
+		"action":    action,
+		"requestid": "ea0bd4ee3e9b4e8c9aa7c3c7c8e17e3d",
+		"senderid":  "dev1.devco.net",
+		"callerid":  "choria=rip.mcollective",
+		"ttl":       60,
+		"data":      data,
+	}
+
+	rj, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("could not encode request: %s", err)
+	}
+
+	path := filepath.Join(tempDir(t), "request.json")
+	err = ioutil.WriteFile(path, rj, 0600)
+	if err != nil {
+		t.Fatalf("could not write request: %s", err)
+	}
+
+	return path
+}
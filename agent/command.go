@@ -0,0 +1,266 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultMaxCommandOutput is the number of bytes of STDOUT and STDERR each captured by RunCommand by default
+const DefaultMaxCommandOutput = 1024 * 1024
+
+// commandKillGrace is how long a command has to exit after SIGTERM before it is killed
+var commandKillGrace = 2 * time.Second
+
+var (
+	validEnvName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	shellUnsafe  = regexp.MustCompile("[\x00-\x08\x0a-\x1f\x7f;&|$`<>(){}\\\\!*?~'\"\\[\\]]")
+)
+
+// Command is a command to run using RunCommand, no shell is involved in running it
+type Command struct {
+	// Path is the command to run, it is looked up in PATH when it has no path separators
+	Path string
+
+	// Args are the arguments passed to the command
+	Args []string
+
+	// Env are environment variables set for the command in addition to those of the agent
+	Env map[string]string
+
+	// Dir is the working directory of the command
+	Dir string
+
+	// Stdin is data sent to the command on its STDIN
+	Stdin io.Reader
+
+	// Timeout limits how long the command may run, the request deadline is always enforced
+	Timeout time.Duration
+
+	// MaxOutput is the maximum bytes captured from each of STDOUT and STDERR, defaults to DefaultMaxCommandOutput
+	MaxOutput int
+
+	// AllowUnsafe disables the check that rejects Args and Env values holding shell meta characters
+	AllowUnsafe bool
+}
+
+// CommandResult is the outcome of running a Command
+type CommandResult struct {
+	Command         string        `json:"command"`
+	ExitCode        int           `json:"exitcode"`
+	Stdout          string        `json:"stdout"`
+	Stderr          string        `json:"stderr"`
+	StdoutTruncated bool          `json:"stdout_truncated"`
+	StderrTruncated bool          `json:"stderr_truncated"`
+	TimedOut        bool          `json:"timed_out"`
+	Started         time.Time     `json:"started"`
+	Duration        time.Duration `json:"duration"`
+}
+
+// ValidateShellSafe checks that value holds no control or shell meta characters, use it to check request inputs
+// that will end up as command arguments or environment values
+func ValidateShellSafe(value string) error {
+	loc := shellUnsafe.FindStringIndex(value)
+	if loc != nil {
+		return fmt.Errorf("unsafe character %q at position %d", value[loc[0]:loc[1]], loc[0])
+	}
+
+	return nil
+}
+
+// Validate checks the command is runnable and that its arguments and environment are shell safe
+func (c *Command) Validate() error {
+	if c.Path == "" {
+		return fmt.Errorf("no command given")
+	}
+
+	for k, v := range c.Env {
+		if !validEnvName.MatchString(k) {
+			return fmt.Errorf("invalid environment variable name %q", k)
+		}
+
+		if c.AllowUnsafe {
+			continue
+		}
+
+		err := ValidateShellSafe(v)
+		if err != nil {
+			return fmt.Errorf("environment variable %s: %s", k, err)
+		}
+	}
+
+	if c.AllowUnsafe {
+		return nil
+	}
+
+	for i, arg := range c.Args {
+		err := ValidateShellSafe(arg)
+		if err != nil {
+			return fmt.Errorf("argument %d: %s", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// RunCommand runs cmd until it completes, ctx or the request Context is cancelled, its Timeout passes or the
+// request deadline passes. On timeout the entire process group of the command is terminated. An error is returned only
+// when the command could not be run, a command that ran and exited non zero reports that in ExitCode
+func (r *Request) RunCommand(ctx context.Context, cmd Command) (*CommandResult, error) {
+	err := cmd.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, r.Deadline())
+	defer cancel()
+
+	// the command is also stopped when the request is abandoned
+	abandoned := r.Context()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-abandoned.Done():
+			cancel()
+		case <-stop:
+		}
+	}()
+
+	if cmd.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, cmd.Timeout)
+		defer cancel()
+	}
+
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("cannot run %s: %s", cmd.Path, ctx.Err())
+	}
+
+	max := cmd.MaxOutput
+	if max <= 0 {
+		max = DefaultMaxCommandOutput
+	}
+
+	stdout := &cappedBuffer{max: max}
+	stderr := &cappedBuffer{max: max}
+
+	execmd := exec.Command(cmd.Path, cmd.Args...)
+	execmd.Dir = cmd.Dir
+	execmd.Stdin = cmd.Stdin
+	execmd.Stdout = stdout
+	execmd.Stderr = stderr
+	execmd.SysProcAttr = newProcessGroupAttr()
+	execmd.Env = os.Environ()
+	for k, v := range cmd.Env {
+		execmd.Env = append(execmd.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	result := &CommandResult{
+		Command: cmd.Path,
+		Started: time.Now(),
+	}
+
+	err = execmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("could not start %s: %s", cmd.Path, err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- execmd.Wait() }()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		result.TimedOut = true
+		terminateProcessGroup(execmd.Process.Pid)
+
+		select {
+		case err = <-done:
+		case <-time.After(commandKillGrace):
+			killProcessGroup(execmd.Process.Pid)
+			err = <-done
+		}
+	}
+
+	result.Duration = time.Since(result.Started)
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+	result.StdoutTruncated = stdout.truncated
+	result.StderrTruncated = stderr.truncated
+	result.ExitCode = execmd.ProcessState.ExitCode()
+
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return result, fmt.Errorf("%s failed: %s", cmd.Path, err)
+	}
+
+	return result, nil
+}
+
+// AbortIfCommandFailed sets the Aborted status code on the reply when running a command failed, timed out or
+// exited non zero, the message includes the final line of STDERR. Returns true when the command failed
+func (r *Reply) AbortIfCommandFailed(res *CommandResult, err error) bool {
+	switch {
+	case err != nil:
+		r.Abort("%s", err)
+
+	case res.TimedOut:
+		r.Abort("%s timed out after %s", res.Command, res.Duration.Round(time.Millisecond))
+
+	case res.ExitCode != 0:
+		msg := lastLine(res.Stderr, 256)
+		if msg == "" {
+			r.Abort("%s exited with code %d", res.Command, res.ExitCode)
+		} else {
+			r.Abort("%s exited with code %d: %s", res.Command, res.ExitCode, msg)
+		}
+
+	default:
+		return false
+	}
+
+	return true
+}
+
+// lastLine is the last non empty line of s limited to max characters
+func lastLine(s string, max int) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	line := strings.TrimSpace(lines[len(lines)-1])
+
+	if len(line) > max {
+		line = line[:max] + "..."
+	}
+
+	return line
+}
+
+// cappedBuffer keeps the first max bytes written to it and discards the rest
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	remaining := b.max - b.buf.Len()
+
+	if len(p) > remaining {
+		b.truncated = true
+		if remaining > 0 {
+			b.buf.Write(p[:remaining])
+		}
+
+		return len(p), nil
+	}
+
+	return b.buf.Write(p)
+}
+
+func (b *cappedBuffer) String() string {
+	return b.buf.String()
+}
@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func commandRequest() *Request {
+	return &Request{Agent: "helloworld", Action: "run", TTL: 60, Time: time.Now().Unix()}
+}
+
+func TestValidateShellSafe(t *testing.T) {
+	for _, v := range []string{"hello", "hello world", "/usr/bin/x", "key=value", "-v"} {
+		if err := ValidateShellSafe(v); err != nil {
+			t.Errorf("expected %q to be safe: %s", v, err)
+		}
+	}
+
+	for _, v := range []string{"a;b", "$(id)", "`id`", "a|b", "a\nb", "a > b", "*"} {
+		if err := ValidateShellSafe(v); err == nil {
+			t.Errorf("expected %q to be unsafe", v)
+		}
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	req := commandRequest()
+
+	res, err := req.RunCommand(context.Background(), Command{Path: "echo", Args: []string{"hello world"}, Env: map[string]string{"X": "y"}})
+	if err != nil {
+		t.Fatalf("command failed: %s", err)
+	}
+
+	if res.ExitCode != 0 || res.Stdout != "hello world\n" || res.TimedOut {
+		t.Fatalf("unexpected result: %#v", res)
+	}
+
+	reply := &Reply{}
+	if reply.AbortIfCommandFailed(res, err) {
+		t.Fatalf("successful command marked as failed")
+	}
+
+	_, err = req.RunCommand(context.Background(), Command{Path: "echo", Args: []string{"$(id)"}})
+	if err == nil || !strings.Contains(err.Error(), "argument 1") {
+		t.Fatalf("expected unsafe argument to be rejected, got %v", err)
+	}
+
+	_, err = req.RunCommand(context.Background(), Command{Path: "echo", Env: map[string]string{"A B": "x"}})
+	if err == nil {
+		t.Fatalf("expected invalid environment to be rejected")
+	}
+}
+
+func TestRunCommandFailure(t *testing.T) {
+	req := commandRequest()
+
+	res, err := req.RunCommand(context.Background(), Command{Path: "sh", Args: []string{"-c", "echo 1234567890; echo oops >&2; exit 3"}, MaxOutput: 5, AllowUnsafe: true})
+	if err != nil {
+		t.Fatalf("command failed to run: %s", err)
+	}
+
+	if res.ExitCode != 3 || res.Stdout != "12345" || !res.StdoutTruncated {
+		t.Fatalf("unexpected result: %#v", res)
+	}
+
+	reply := &Reply{}
+	if !reply.AbortIfCommandFailed(res, err) {
+		t.Fatalf("failed command not marked as failed")
+	}
+
+	if reply.StatusCode != Aborted || reply.StatusMessage != "sh exited with code 3: oops" {
+		t.Fatalf("unexpected reply: %#v", reply)
+	}
+
+	_, err = req.RunCommand(context.Background(), Command{Path: "/nonexisting"})
+	if err == nil {
+		t.Fatalf("expected missing command to fail")
+	}
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	req := commandRequest()
+	start := time.Now()
+
+	res, err := req.RunCommand(context.Background(), Command{Path: "sh", Args: []string{"-c", "sleep 10 & sleep 10"}, Timeout: 200 * time.Millisecond, AllowUnsafe: true})
+	if err != nil {
+		t.Fatalf("command failed to run: %s", err)
+	}
+
+	if !res.TimedOut || time.Since(start) > 5*time.Second {
+		t.Fatalf("command did not time out: %#v", res)
+	}
+
+	req.Time = time.Now().Add(-2 * time.Minute).Unix()
+	_, err = req.RunCommand(context.Background(), Command{Path: "echo"})
+	if err == nil {
+		t.Fatalf("expected expired request to not run commands")
+	}
+}
@@ -3,16 +3,30 @@ package agent
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
+
+	"github.com/choria-io/go-external/schemas"
+	"github.com/choria-io/go-external/transport"
 )
 
-type externalAgent struct{}
+type externalAgent struct {
+	transport  transport.Transport
+	validation schemas.Mode
+}
+
+// getTransport is the transport set on the agent, or the one selected by the environment
+func (e externalAgent) getTransport() (transport.Transport, error) {
+	if e.transport != nil {
+		return e.transport, nil
+	}
+
+	return transport.FromEnvironment()
+}
 
 func (e externalAgent) publishReply(rep interface{}) error {
-	repfile := os.Getenv("CHORIA_EXTERNAL_REPLY")
-	if !fileExist(repfile) {
-		return fmt.Errorf("request file '%s' from CHORIA_EXTERNAL_REPLY does not exist", repfile)
+	t, err := e.getTransport()
+	if err != nil {
+		return err
 	}
 
 	j, err := json.Marshal(rep)
@@ -20,35 +34,33 @@ func (e externalAgent) publishReply(rep interface{}) error {
 		return fmt.Errorf("could not JSON encode reply data: %s", err)
 	}
 
-	f, err := os.Create(repfile)
-	if err != nil {
-		return fmt.Errorf("could not open reply file %s: %s", repfile, err)
-	}
-	defer f.Close()
+	return t.WriteReply(j)
+}
 
-	_, err = fmt.Fprint(f, string(j))
+func (e externalAgent) readRequest() ([]byte, error) {
+	t, err := e.getTransport()
 	if err != nil {
-		return fmt.Errorf("failed writing to reply file %s: %s", repfile, err)
+		return nil, err
 	}
 
-	return nil
+	return t.ReadRequest()
 }
 
-func (e externalAgent) loadRequest(protocol string, req interface{}) error {
+func (e externalAgent) loadRequest(protocol string, schema string, req interface{}) error {
 	reqproto := os.Getenv("CHORIA_EXTERNAL_PROTOCOL")
-	reqfile := os.Getenv("CHORIA_EXTERNAL_REQUEST")
 
-	if os.Getenv("CHORIA_EXTERNAL_PROTOCOL") != protocol {
+	if reqproto != protocol {
 		return fmt.Errorf("unexpected protocol '%s'", reqproto)
 	}
 
-	if !fileExist(reqfile) {
-		return fmt.Errorf("request file '%s' from CHORIA_EXTERNAL_REQUEST does not exist", reqfile)
+	reqj, err := e.readRequest()
+	if err != nil {
+		return fmt.Errorf("could not load request: %s", err)
 	}
 
-	reqj, err := ioutil.ReadFile(reqfile)
+	err = e.validateDocument(schema, reqj)
 	if err != nil {
-		return fmt.Errorf("could not load request: %s", err)
+		return fmt.Errorf("invalid request: %s", err)
 	}
 
 	err = json.Unmarshal(reqj, req)
@@ -0,0 +1,520 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/choria-io/go-external/internal/flock"
+)
+
+const (
+	// DefaultFileChunkSize is the number of bytes file_read_chunk reads when no length is requested
+	DefaultFileChunkSize = 256 * 1024
+
+	// MaxFileChunkSize is the most bytes file_read_chunk reads in one request
+	MaxFileChunkSize = 4 * 1024 * 1024
+
+	// partialSuffix names the file uploads are written to until they are committed
+	partialSuffix = ".choria-partial"
+
+	// DefaultFileTransferRetention is how long unfinished uploads are kept when file_transfer_retention is not configured
+	DefaultFileTransferRetention = 24 * time.Hour
+
+	// replyOverhead is reserved for everything but the chunk data when fitting chunks into the reply size limit
+	replyOverhead = 1024
+)
+
+type fileStatRequest struct {
+	Path     string `json:"path"`
+	Checksum bool   `json:"checksum"`
+}
+
+type fileStatReply struct {
+	Path        string `json:"path"`
+	Exists      bool   `json:"exists"`
+	Type        string `json:"type,omitempty"`
+	Size        int64  `json:"size"`
+	Mode        string `json:"mode,omitempty"`
+	ModTime     int64  `json:"mtime,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	PartialSize int64  `json:"partial_size"`
+}
+
+type fileReadRequest struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+	Length int    `json:"length"`
+}
+
+type fileReadReply struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+	Length int    `json:"length"`
+	Size   int64  `json:"size"`
+	EOF    bool   `json:"eof"`
+	Data   string `json:"data"`
+	SHA256 string `json:"sha256"`
+}
+
+type fileWriteRequest struct {
+	Path        string `json:"path"`
+	Offset      int64  `json:"offset"`
+	Data        string `json:"data"`
+	ChunkSHA256 string `json:"chunk_sha256"`
+	Commit      bool   `json:"commit"`
+	SHA256      string `json:"sha256"`
+	Mode        string `json:"mode"`
+}
+
+type fileWriteReply struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Committed bool   `json:"committed"`
+	SHA256    string `json:"sha256,omitempty"`
+}
+
+// RegisterFileTransferActions registers the file_stat, file_read_chunk and file_write_chunk actions used to copy
+// files to and from the node in chunks, only files in the directories set using SetFileTransferDirectories or the
+// file_transfer_directories configuration can be accessed
+func (a *Agent) RegisterFileTransferActions(opts ...ActionOption) error {
+	for name, handler := range map[string]ActionHandler{
+		"file_stat":        a.fileStatAction,
+		"file_read_chunk":  a.fileReadChunkAction,
+		"file_write_chunk": a.fileWriteChunkAction,
+	} {
+		err := a.RegisterAction(name, handler, opts...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MustRegisterFileTransferActions registers the file transfer actions and panics if any error occur
+func (a *Agent) MustRegisterFileTransferActions(opts ...ActionOption) {
+	err := a.RegisterFileTransferActions(opts...)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// SetFileTransferDirectories sets the directories the file transfer actions can access, overrides the
+// comma separated file_transfer_directories configuration
+func (a *Agent) SetFileTransferDirectories(dirs ...string) {
+	a.transferDirs = dirs
+}
+
+func (a *Agent) fileTransferDirectories() []string {
+	if len(a.transferDirs) > 0 {
+		return a.transferDirs
+	}
+
+	var dirs []string
+	for _, d := range strings.Split(a.configItem("file_transfer_directories"), ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			dirs = append(dirs, d)
+		}
+	}
+
+	return dirs
+}
+
+// transferPath validates that path is within an allowed directory and returns it with symlinks in its
+// directory resolved, the file itself need not exist
+func (a *Agent) transferPath(path string) (string, error) {
+	if path == "" || !filepath.IsAbs(path) {
+		return "", fmt.Errorf("path %q is not absolute", path)
+	}
+
+	path = filepath.Clean(path)
+	if strings.Contains(filepath.Base(path), partialSuffix) {
+		return "", fmt.Errorf("%s is not an allowed file", path)
+	}
+
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return "", fmt.Errorf("%s is not an allowed file", path)
+	}
+
+	resolved := filepath.Join(dir, filepath.Base(path))
+	if target, err := filepath.EvalSymlinks(resolved); err == nil {
+		resolved = target
+	}
+
+	for _, allowed := range a.fileTransferDirectories() {
+		root, err := filepath.EvalSymlinks(allowed)
+		if err != nil {
+			continue
+		}
+
+		rel, err := filepath.Rel(root, resolved)
+		if err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+
+	return "", fmt.Errorf("%s is not an allowed file", path)
+}
+
+func (a *Agent) fileTransferRetention() time.Duration {
+	retention, err := time.ParseDuration(a.configItem("file_transfer_retention"))
+	if err != nil || retention <= 0 {
+		return DefaultFileTransferRetention
+	}
+
+	return retention
+}
+
+func partialPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+partialSuffix)
+}
+
+// lockPartial locks an upload in progress. Finished uploads remove their lock file while holding the lock, so the
+// lock is only valid when the locked file is still the one at the path, otherwise it is retried with the new file
+func lockPartial(partial string) (*flock.Lock, error) {
+	path := partial + ".lock"
+
+	for i := 0; i < 10; i++ {
+		lock, err := flock.TryLock(path)
+		if err != nil {
+			return nil, err
+		}
+
+		held, err := lock.File().Stat()
+		if err != nil {
+			lock.Unlock()
+			return nil, err
+		}
+
+		current, err := os.Stat(path)
+		if err == nil && os.SameFile(held, current) {
+			return lock, nil
+		}
+
+		lock.Unlock()
+	}
+
+	return nil, flock.ErrLocked
+}
+
+// removePartial removes an upload and its lock file, the lock has to be held
+func removePartial(partial string) {
+	os.Remove(partial)
+	os.Remove(partial + ".lock")
+}
+
+// expirePartials removes uploads in dir that were not written to for longer than the retention period
+func (a *Agent) expirePartials(dir string) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	retention := a.fileTransferRetention()
+
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".lock")
+		if !entry.Mode().IsRegular() || !strings.HasPrefix(name, ".") || !strings.HasSuffix(name, partialSuffix) || time.Since(entry.ModTime()) < retention {
+			continue
+		}
+
+		partial := filepath.Join(dir, name)
+
+		lock, err := lockPartial(partial)
+		if err != nil {
+			continue
+		}
+
+		// the upload could have been resumed before it was locked
+		stat, err := os.Stat(partial)
+		if err != nil || time.Since(stat.ModTime()) >= retention {
+			removePartial(partial)
+		}
+
+		lock.Unlock()
+	}
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (a *Agent) fileStatAction(req *Request, rep *Reply, _ map[string]string) {
+	input := &fileStatRequest{}
+	if !req.ParseRequestData(input, rep) {
+		return
+	}
+
+	path, err := a.transferPath(input.Path)
+	if err != nil {
+		rep.InvalidData("%s", err)
+		return
+	}
+
+	result := &fileStatReply{Path: path}
+	rep.Data = result
+
+	if stat, err := os.Stat(partialPath(path)); err == nil {
+		result.PartialSize = stat.Size()
+	}
+
+	stat, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if rep.AbortIfErr(err, "could not stat %s: %s", path, err) {
+		return
+	}
+
+	result.Exists = true
+	result.Size = stat.Size()
+	result.Mode = fmt.Sprintf("%04o", stat.Mode().Perm())
+	result.ModTime = stat.ModTime().Unix()
+
+	switch {
+	case stat.IsDir():
+		result.Type = "directory"
+	case stat.Mode().IsRegular():
+		result.Type = "file"
+	default:
+		result.Type = "other"
+	}
+
+	if input.Checksum && result.Type == "file" {
+		result.SHA256, err = fileChecksum(path)
+		rep.AbortIfErr(err, "could not checksum %s: %s", path, err)
+	}
+}
+
+// maxChunkSize is the largest chunk that fits in the reply size limit once base64 encoded
+func (a *Agent) maxChunkSize() int {
+	max := MaxFileChunkSize
+	if limit := a.maxReplySize(); limit > 0 {
+		fit := (limit - replyOverhead) / 4 * 3
+		if fit < max {
+			max = fit
+		}
+	}
+
+	return max
+}
+
+func (a *Agent) fileReadChunkAction(req *Request, rep *Reply, _ map[string]string) {
+	input := &fileReadRequest{}
+	if !req.ParseRequestData(input, rep) {
+		return
+	}
+
+	path, err := a.transferPath(input.Path)
+	if err != nil {
+		rep.InvalidData("%s", err)
+		return
+	}
+
+	if input.Offset < 0 || input.Length < 0 {
+		rep.InvalidData("offset and length cannot be negative")
+		return
+	}
+
+	length := input.Length
+	if length == 0 {
+		length = DefaultFileChunkSize
+	}
+
+	if max := a.maxChunkSize(); length > max {
+		length = max
+	}
+
+	if length <= 0 {
+		rep.Abort("the maximum reply size is too small for file chunks")
+		return
+	}
+
+	f, err := os.Open(path)
+	if rep.AbortIfErr(err, "could not open %s: %s", path, err) {
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if rep.AbortIfErr(err, "could not stat %s: %s", path, err) {
+		return
+	}
+
+	if !stat.Mode().IsRegular() {
+		rep.InvalidData("%s is not a regular file", path)
+		return
+	}
+
+	if input.Offset > stat.Size() {
+		rep.InvalidData("offset %d is beyond the end of %s (%d bytes)", input.Offset, path, stat.Size())
+		return
+	}
+
+	buf := make([]byte, length)
+	n, err := f.ReadAt(buf, input.Offset)
+	if err != nil && err != io.EOF {
+		rep.Abort("could not read %s: %s", path, err)
+		return
+	}
+
+	sum := sha256.Sum256(buf[:n])
+
+	rep.Data = &fileReadReply{
+		Path:   path,
+		Offset: input.Offset,
+		Length: n,
+		Size:   stat.Size(),
+		EOF:    input.Offset+int64(n) >= stat.Size(),
+		Data:   base64.StdEncoding.EncodeToString(buf[:n]),
+		SHA256: hex.EncodeToString(sum[:]),
+	}
+}
+
+func (a *Agent) fileWriteChunkAction(req *Request, rep *Reply, _ map[string]string) {
+	input := &fileWriteRequest{}
+	if !req.ParseRequestData(input, rep) {
+		return
+	}
+
+	path, err := a.transferPath(input.Path)
+	if err != nil {
+		rep.InvalidData("%s", err)
+		return
+	}
+
+	data, err := base64.StdEncoding.DecodeString(input.Data)
+	if err != nil {
+		rep.InvalidData("invalid chunk data: %s", err)
+		return
+	}
+
+	if input.ChunkSHA256 != "" {
+		sum := sha256.Sum256(data)
+		if !strings.EqualFold(hex.EncodeToString(sum[:]), input.ChunkSHA256) {
+			rep.InvalidData("chunk checksum mismatch")
+			return
+		}
+	}
+
+	mode := os.FileMode(0644)
+	if input.Mode != "" {
+		m, err := strconv.ParseUint(input.Mode, 8, 32)
+		if err != nil || m > 0777 {
+			rep.InvalidData("invalid mode %q", input.Mode)
+			return
+		}
+		mode = os.FileMode(m)
+	}
+
+	if input.Commit && input.SHA256 == "" {
+		rep.StatusCode = MissingData
+		rep.StatusMessage = fmt.Sprintf("sha256 is required to commit %s", path)
+		return
+	}
+
+	partial := partialPath(path)
+
+	if input.Offset == 0 {
+		a.expirePartials(filepath.Dir(path))
+	}
+
+	lock, err := lockPartial(partial)
+	if err == flock.ErrLocked {
+		rep.Abort("another transfer to %s is in progress", path)
+		return
+	}
+	if rep.AbortIfErr(err, "could not lock %s: %s", path, err) {
+		return
+	}
+	defer lock.Unlock()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	if input.Offset == 0 {
+		flags |= os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(partial, flags, 0600)
+	if rep.AbortIfErr(err, "could not open %s: %s", partial, err) {
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if rep.AbortIfErr(err, "could not stat %s: %s", partial, err) {
+		return
+	}
+
+	// chunks must be written in order, the current size tells the client where to resume
+	if input.Offset != stat.Size() {
+		rep.InvalidData("offset %d does not match the %d bytes received so far for %s", input.Offset, stat.Size(), path)
+		rep.Data = &fileWriteReply{Path: path, Size: stat.Size()}
+		return
+	}
+
+	_, err = f.WriteAt(data, input.Offset)
+	if rep.AbortIfErr(err, "could not write %s: %s", partial, err) {
+		return
+	}
+
+	result := &fileWriteReply{Path: path, Size: input.Offset + int64(len(data))}
+	rep.Data = result
+
+	if !input.Commit {
+		return
+	}
+
+	err = f.Sync()
+	if rep.AbortIfErr(err, "could not write %s: %s", partial, err) {
+		return
+	}
+
+	sum, err := fileChecksum(partial)
+	if rep.AbortIfErr(err, "could not checksum %s: %s", partial, err) {
+		return
+	}
+
+	if !strings.EqualFold(sum, input.SHA256) {
+		removePartial(partial)
+		rep.Abort("checksum mismatch for %s, expected %s got %s, the transfer has to be restarted", path, input.SHA256, sum)
+		result.Size = 0
+		return
+	}
+
+	err = f.Chmod(mode)
+	if rep.AbortIfErr(err, "could not set mode of %s: %s", partial, err) {
+		return
+	}
+
+	err = os.Rename(partial, path)
+	if rep.AbortIfErr(err, "could not commit %s: %s", path, err) {
+		return
+	}
+
+	removePartial(partial)
+
+	result.Committed = true
+	result.SHA256 = sum
+}
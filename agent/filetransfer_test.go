@@ -0,0 +1,306 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/choria-io/go-external/internal/flock"
+)
+
+func transferAgent(t *testing.T) (*Agent, string) {
+	t.Helper()
+
+	dir := tempDir(t)
+	a := NewAgent("helloworld")
+	a.MustRegisterFileTransferActions()
+	a.SetFileTransferDirectories(dir)
+
+	return a, dir
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestFileTransferPaths(t *testing.T) {
+	defer cleanEnv()
+
+	a, dir := transferAgent(t)
+
+	for _, path := range []string{"", "relative/file", "/etc/passwd", filepath.Join(dir, "..", "escape"), dir, filepath.Join(dir, ".file"+partialSuffix)} {
+		reply := processRPC(t, a, requestFile(t, "file_stat", map[string]string{"path": path}))
+		if reply.StatusCode != InvalidData {
+			t.Fatalf("access to %q was allowed: %#v", path, reply)
+		}
+	}
+
+	err := os.Symlink("/etc", filepath.Join(dir, "etc"))
+	if err != nil {
+		t.Fatalf("could not create symlink: %s", err)
+	}
+
+	reply := processRPC(t, a, requestFile(t, "file_stat", map[string]string{"path": filepath.Join(dir, "etc", "passwd")}))
+	if reply.StatusCode != InvalidData {
+		t.Fatalf("access through a symlink was allowed: %#v", reply)
+	}
+}
+
+func TestFileTransferRead(t *testing.T) {
+	defer cleanEnv()
+
+	a, dir := transferAgent(t)
+	content := []byte(strings.Repeat("0123456789", 100))
+	path := filepath.Join(dir, "file.txt")
+
+	err := ioutil.WriteFile(path, content, 0640)
+	if err != nil {
+		t.Fatalf("could not write file: %s", err)
+	}
+
+	reply := processRPC(t, a, requestFile(t, "file_stat", map[string]interface{}{"path": path, "checksum": true}))
+	stat := reply.Data.(map[string]interface{})
+	if reply.StatusCode != OK || stat["exists"] != true || stat["type"] != "file" || stat["size"] != float64(1000) || stat["mode"] != "0640" || stat["sha256"] != checksum(content) {
+		t.Fatalf("unexpected stat reply: %#v", reply)
+	}
+
+	var received []byte
+	offset := 0
+	for {
+		reply = processRPC(t, a, requestFile(t, "file_read_chunk", map[string]interface{}{"path": path, "offset": offset, "length": 300}))
+		if reply.StatusCode != OK {
+			t.Fatalf("read failed: %#v", reply)
+		}
+
+		chunk := reply.Data.(map[string]interface{})
+		data, err := base64.StdEncoding.DecodeString(chunk["data"].(string))
+		if err != nil {
+			t.Fatalf("invalid chunk data: %s", err)
+		}
+
+		if chunk["sha256"] != checksum(data) {
+			t.Fatalf("chunk checksum mismatch")
+		}
+
+		received = append(received, data...)
+		offset += len(data)
+
+		if chunk["eof"] == true {
+			break
+		}
+
+		if len(data) != 300 {
+			t.Fatalf("expected 300 byte chunk got %d", len(data))
+		}
+	}
+
+	if string(received) != string(content) {
+		t.Fatalf("received content does not match")
+	}
+
+	reply = processRPC(t, a, requestFile(t, "file_read_chunk", map[string]interface{}{"path": path, "offset": 2000}))
+	if reply.StatusCode != InvalidData {
+		t.Fatalf("read beyond the end was allowed: %#v", reply)
+	}
+}
+
+func TestFileTransferReadReplyLimit(t *testing.T) {
+	defer cleanEnv()
+
+	a, dir := transferAgent(t)
+	a.SetReplyLimit(4096, OverflowAbort)
+	path := filepath.Join(dir, "file.bin")
+
+	err := ioutil.WriteFile(path, make([]byte, 100000), 0644)
+	if err != nil {
+		t.Fatalf("could not write file: %s", err)
+	}
+
+	reply := processRPC(t, a, requestFile(t, "file_read_chunk", map[string]interface{}{"path": path}))
+	if reply.StatusCode != OK {
+		t.Fatalf("read failed: %#v", reply)
+	}
+
+	chunk := reply.Data.(map[string]interface{})
+	if chunk["length"] != float64(a.maxChunkSize()) || chunk["eof"] != false {
+		t.Fatalf("chunk was not limited to fit the reply: %#v", chunk["length"])
+	}
+
+	if size := replySize(t); size > 4096 {
+		t.Fatalf("reply of %d bytes exceeds the limit", size)
+	}
+}
+
+func TestFileTransferWrite(t *testing.T) {
+	defer cleanEnv()
+
+	a, dir := transferAgent(t)
+	content := []byte(strings.Repeat("abcdefghij", 50))
+	path := filepath.Join(dir, "upload.txt")
+
+	write := func(offset int, data []byte, extra map[string]interface{}) *Reply {
+		req := map[string]interface{}{
+			"path":         path,
+			"offset":       offset,
+			"data":         base64.StdEncoding.EncodeToString(data),
+			"chunk_sha256": checksum(data),
+		}
+		for k, v := range extra {
+			req[k] = v
+		}
+
+		return processRPC(t, a, requestFile(t, "file_write_chunk", req))
+	}
+
+	reply := write(0, content[:200], nil)
+	if reply.StatusCode != OK || reply.Data.(map[string]interface{})["size"] != float64(200) {
+		t.Fatalf("first chunk failed: %#v", reply)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("file exists before commit")
+	}
+
+	// a client that lost track resumes from the size reported by file_stat or the offset error
+	reply = write(300, content[300:], nil)
+	if reply.StatusCode != InvalidData || reply.Data.(map[string]interface{})["size"] != float64(200) {
+		t.Fatalf("out of order chunk was accepted: %#v", reply)
+	}
+
+	reply = processRPC(t, a, requestFile(t, "file_stat", map[string]interface{}{"path": path}))
+	if reply.Data.(map[string]interface{})["partial_size"] != float64(200) || reply.Data.(map[string]interface{})["exists"] != false {
+		t.Fatalf("unexpected stat reply: %#v", reply)
+	}
+
+	reply = processRPC(t, a, requestFile(t, "file_write_chunk", map[string]interface{}{"path": path, "offset": 200, "data": base64.StdEncoding.EncodeToString(content[200:]), "chunk_sha256": checksum(content[:10])}))
+	if reply.StatusCode != InvalidData {
+		t.Fatalf("corrupt chunk was accepted: %#v", reply)
+	}
+
+	reply = write(200, content[200:], map[string]interface{}{"commit": true})
+	if reply.StatusCode != MissingData {
+		t.Fatalf("commit without checksum was accepted: %#v", reply)
+	}
+
+	reply = write(200, content[200:], map[string]interface{}{"commit": true, "sha256": checksum(content), "mode": "0600"})
+	if reply.StatusCode != OK || reply.Data.(map[string]interface{})["committed"] != true {
+		t.Fatalf("commit failed: %#v", reply)
+	}
+
+	written, err := ioutil.ReadFile(path)
+	if err != nil || string(written) != string(content) {
+		t.Fatalf("written content does not match: %s", err)
+	}
+
+	stat, _ := os.Stat(path)
+	if stat.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected mode %o", stat.Mode().Perm())
+	}
+
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("partial files were left behind: %d entries", len(entries))
+	}
+
+	reply = write(0, content, map[string]interface{}{"commit": true, "sha256": checksum(content[:10])})
+	if reply.StatusCode != Aborted || !strings.Contains(reply.StatusMessage, "checksum mismatch") {
+		t.Fatalf("commit with wrong checksum was accepted: %#v", reply)
+	}
+
+	if _, err := os.Stat(partialPath(path)); !os.IsNotExist(err) {
+		t.Fatalf("partial file was not removed after checksum mismatch")
+	}
+
+	if _, err := os.Stat(partialPath(path) + ".lock"); !os.IsNotExist(err) {
+		t.Fatalf("lock file was not removed after checksum mismatch")
+	}
+}
+
+func TestFileTransferPartialLock(t *testing.T) {
+	partial := partialPath(filepath.Join(tempDir(t), "upload.txt"))
+
+	lock, err := lockPartial(partial)
+	if err != nil {
+		t.Fatalf("could not lock: %s", err)
+	}
+	defer lock.Unlock()
+
+	_, err = lockPartial(partial)
+	if err != flock.ErrLocked {
+		t.Fatalf("expected the upload to be locked got %v", err)
+	}
+
+	// a finished upload removes the lock file while holding it, later uploads lock a new file
+	removePartial(partial)
+
+	second, err := lockPartial(partial)
+	if err != nil {
+		t.Fatalf("could not lock after the lock file was removed: %s", err)
+	}
+	defer second.Unlock()
+
+	_, err = lockPartial(partial)
+	if err != flock.ErrLocked {
+		t.Fatalf("expected the new lock to be held got %v", err)
+	}
+}
+
+func TestFileTransferExpirePartials(t *testing.T) {
+	defer cleanEnv()
+
+	a, dir := transferAgent(t)
+
+	stale := partialPath(filepath.Join(dir, "stale.txt"))
+	locked := partialPath(filepath.Join(dir, "locked.txt"))
+	old := time.Now().Add(-48 * time.Hour)
+
+	for _, f := range []string{stale, stale + ".lock", locked, locked + ".lock"} {
+		err := ioutil.WriteFile(f, []byte("partial"), 0600)
+		if err != nil {
+			t.Fatalf("could not write %s: %s", f, err)
+		}
+	}
+	os.Chtimes(stale, old, old)
+	os.Chtimes(stale+".lock", old, old)
+
+	// a stale upload that is still locked is kept
+	lock, err := lockPartial(locked)
+	if err != nil {
+		t.Fatalf("could not lock: %s", err)
+	}
+	os.Chtimes(locked, old, old)
+
+	data := []byte("hello")
+	reply := processRPC(t, a, requestFile(t, "file_write_chunk", map[string]interface{}{"path": filepath.Join(dir, "new.txt"), "offset": 0, "data": base64.StdEncoding.EncodeToString(data)}))
+	if reply.StatusCode != OK {
+		t.Fatalf("write failed: %#v", reply)
+	}
+
+	for _, f := range []string{stale, stale + ".lock"} {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Fatalf("stale upload %s was not removed", f)
+		}
+	}
+
+	if _, err := os.Stat(locked); err != nil {
+		t.Fatalf("locked upload was removed: %s", err)
+	}
+
+	lock.Unlock()
+
+	reply = processRPC(t, a, requestFile(t, "file_write_chunk", map[string]interface{}{"path": filepath.Join(dir, "new.txt"), "offset": 0, "data": base64.StdEncoding.EncodeToString(data)}))
+	if reply.StatusCode != OK {
+		t.Fatalf("write failed: %#v", reply)
+	}
+
+	if _, err := os.Stat(locked); !os.IsNotExist(err) {
+		t.Fatalf("stale upload was not removed once unlocked")
+	}
+}
@@ -0,0 +1,251 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/choria-io/go-external/internal/flock"
+)
+
+// DefaultIdempotencyRetention is how long completed requests are remembered when idempotency_retention is not configured
+const DefaultIdempotencyRetention = 24 * time.Hour
+
+var validRequestID = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// completedRequest is the record kept on disk for every completed idempotent request
+type completedRequest struct {
+	RequestID string    `json:"requestid"`
+	Agent     string    `json:"agent"`
+	Action    string    `json:"action"`
+	Completed time.Time `json:"completed"`
+	Reply     *Reply    `json:"reply"`
+}
+
+// WithIdempotency records the reply of every completed request of an action and, when a request with the
+// same RequestID is received again, returns the recorded reply instead of invoking the action again
+func WithIdempotency() ActionOption {
+	return func(a *action) {
+		a.idempotent = true
+	}
+}
+
+// SetIdempotencyStore sets the directory where completed requests are recorded and how long they are kept,
+// overrides the idempotency_directory and idempotency_retention configuration
+func (a *Agent) SetIdempotencyStore(dir string, retention time.Duration) {
+	a.idempotencyDir = dir
+	a.idempotencyRetention = retention
+}
+
+func (a *Agent) idempotencyDirectory() string {
+	if a.idempotencyDir != "" {
+		return a.idempotencyDir
+	}
+
+	if a.configItem("idempotency_directory") != "" {
+		return a.configItem("idempotency_directory")
+	}
+
+	return filepath.Join(privateTempDir("requests"), a.Name)
+}
+
+func (a *Agent) idempotencyRetentionPeriod() time.Duration {
+	if a.idempotencyRetention > 0 {
+		return a.idempotencyRetention
+	}
+
+	retention, err := time.ParseDuration(a.configItem("idempotency_retention"))
+	if err != nil || retention <= 0 {
+		return DefaultIdempotencyRetention
+	}
+
+	return retention
+}
+
+// idempotent returns the recorded reply for a previously completed request or calls run, its reply is only
+// recorded when run reports that the action completed so transient failures are retried
+func (a *Agent) idempotent(act *action, req *Request, run func() (*Reply, bool)) *Reply {
+	if !act.idempotent {
+		reply, _ := run()
+		return reply
+	}
+
+	if !validRequestID.MatchString(req.RequestID) {
+		return abortReply("cannot process %s#%s idempotently: invalid request id %q", a.Name, act.name, req.RequestID)
+	}
+
+	// records hold the replies including sensitive outputs
+	dir := a.idempotencyDirectory()
+	err := ensurePrivateDirectory(dir)
+	if err != nil {
+		return abortReply("cannot process %s#%s idempotently: %s", a.Name, act.name, err)
+	}
+
+	record := filepath.Join(dir, req.RequestID+".json")
+
+	// concurrent deliveries of the same request wait for the first to complete
+	ctx, cancel := context.WithTimeout(req.Context(), req.ttlDuration())
+	defer cancel()
+
+	lock, err := lockRequest(ctx, dir, req.RequestID)
+	if err != nil {
+		return abortReply("could not lock request %s: %s", req.RequestID, err)
+	}
+	defer lock.Unlock()
+
+	previous, err := a.loadCompletedRequest(record)
+	switch {
+	case err == nil:
+		req.Logger().Info("Returning recorded reply for previously completed request")
+		return previous.Reply
+
+	case !os.IsNotExist(err):
+		return abortReply("could not read the record of request %s: %s", req.RequestID, err)
+	}
+
+	reply, completed := run()
+	if !completed {
+		return reply
+	}
+
+	// the reply is recorded as it will be published so replays are identical to it
+	a.protectReply(req, reply)
+
+	err = writeFileAtomic(record, completedRequest{
+		RequestID: req.RequestID,
+		Agent:     a.Name,
+		Action:    act.name,
+		Completed: time.Now().UTC(),
+		Reply:     reply,
+	})
+	if err != nil {
+		req.Logger().Error("Could not record completed request", "error", err)
+	}
+
+	a.expireCompletedRequests(dir)
+
+	return reply
+}
+
+// lockRequest locks a request while holding the directory lock so expireCompletedRequests cannot remove the
+// lock file between it being opened and locked
+func lockRequest(ctx context.Context, dir string, id string) (*flock.Lock, error) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		dirLock, err := flock.WaitLock(ctx, filepath.Join(dir, ".lock"), 10*time.Millisecond)
+		if err != nil {
+			return nil, err
+		}
+
+		lock, err := flock.TryLock(filepath.Join(dir, id+".lock"))
+		dirLock.Unlock()
+		if err != flock.ErrLocked {
+			return lock, err
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, flock.ErrLocked
+		}
+	}
+}
+
+func (a *Agent) loadCompletedRequest(path string) (*completedRequest, error) {
+	rj, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &completedRequest{}
+	err = json.Unmarshal(rj, record)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Since(record.Completed) > a.idempotencyRetentionPeriod() {
+		return nil, os.ErrNotExist
+	}
+
+	return record, nil
+}
+
+// expireCompletedRequests removes records and lock files older than the retention period, lock files are only
+// removed while holding the directory lock used by lockRequest
+func (a *Agent) expireCompletedRequests(dir string) {
+	dirLock, err := flock.TryLock(filepath.Join(dir, ".lock"))
+	if err != nil {
+		return
+	}
+	defer dirLock.Unlock()
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	retention := a.idempotencyRetentionPeriod()
+
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == ".lock" || time.Since(entry.ModTime()) < retention {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+
+		switch {
+		case strings.HasSuffix(entry.Name(), ".json"):
+			os.Remove(path)
+
+		case strings.HasSuffix(entry.Name(), ".lock"):
+			// only remove lock files nobody holds
+			lock, err := flock.TryLock(path)
+			if err != nil {
+				continue
+			}
+			os.Remove(path)
+			lock.Unlock()
+		}
+	}
+}
+
+// writeFileAtomic writes data as JSON to a temporary file and renames it into place, the file is only
+// readable by the current user as it may hold secrets
+func writeFileAtomic(path string, data interface{}) error {
+	j, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("could not JSON encode %s: %s", path, err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	tf, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+
+	_, err = tf.Write(j)
+	if err != nil {
+		tf.Close()
+		return err
+	}
+
+	err = tf.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tf.Name(), path)
+}
@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/choria-io/go-external/internal/flock"
+)
+
+func TestIdempotentAction(t *testing.T) {
+	defer cleanEnv()
+
+	dir := tempDir(t)
+	count := 0
+
+	a := NewAgent("helloworld")
+	a.SetIdempotencyStore(dir, time.Hour)
+	a.MustRegisterAction("ping", func(req *Request, rep *Reply, config map[string]string) {
+		count++
+		rep.Data = map[string]int{"count": count}
+	}, WithIdempotency())
+
+	for i := 0; i < 2; i++ {
+		reply := processRPC(t, a, "testdata/pingrequest.json")
+		if reply.StatusCode != OK {
+			t.Fatalf("request failed: %s", reply.StatusMessage)
+		}
+
+		if reply.Data.(map[string]interface{})["count"].(float64) != 1 {
+			t.Fatalf("expected the recorded reply, got %v", reply.Data)
+		}
+	}
+
+	if count != 1 {
+		t.Fatalf("expected the action to run once, ran %d times", count)
+	}
+
+	if !fileExist(filepath.Join(dir, "034c527089f746248822ada8a145f499.json")) {
+		t.Fatalf("request was not recorded")
+	}
+
+	a.SetIdempotencyStore(dir, time.Nanosecond)
+	processRPC(t, a, "testdata/pingrequest.json")
+	if count != 2 {
+		t.Fatalf("expected expired record to be ignored, ran %d times", count)
+	}
+}
+
+func TestIdempotentActionFailures(t *testing.T) {
+	defer cleanEnv()
+
+	count := 0
+
+	a := NewAgent("helloworld")
+	a.SetIdempotencyStore(tempDir(t), time.Hour)
+	a.SetLockDirectory(tempDir(t))
+	a.MustRegisterAction("ping", func(req *Request, rep *Reply, config map[string]string) {
+		count++
+		if count == 1 {
+			panic("transient failure")
+		}
+
+		rep.Data = map[string]int{"count": count}
+	}, WithIdempotency(), WithLock(ActionLock, 0))
+
+	// neither a panic nor failing to obtain the action lock records the request
+	reply := processRPC(t, a, "testdata/pingrequest.json")
+	if reply.StatusCode != UnknownError {
+		t.Fatalf("expected the action to panic, got %d: %s", reply.StatusCode, reply.StatusMessage)
+	}
+
+	lock, err := flock.TryLock(a.lockPath(a.actions["ping"]))
+	if err != nil {
+		t.Fatalf("could not lock: %s", err)
+	}
+
+	reply = processRPC(t, a, "testdata/pingrequest.json")
+	lock.Unlock()
+	if reply.StatusCode != Aborted || count != 1 {
+		t.Fatalf("expected the locked action to be aborted, got %d after %d runs", reply.StatusCode, count)
+	}
+
+	reply = processRPC(t, a, "testdata/pingrequest.json")
+	if reply.StatusCode != OK || count != 2 {
+		t.Fatalf("expected the retry to run the action, got %d after %d runs", reply.StatusCode, count)
+	}
+
+	processRPC(t, a, "testdata/pingrequest.json")
+	if count != 2 {
+		t.Fatalf("expected the completed request to be recorded, ran %d times", count)
+	}
+}
+
+func TestExpireCompletedRequests(t *testing.T) {
+	dir := tempDir(t)
+
+	a := NewAgent("helloworld")
+	a.SetIdempotencyStore(dir, time.Hour)
+
+	old := filepath.Join(dir, "old.json")
+	recent := filepath.Join(dir, "recent.json")
+
+	for _, f := range []string{old, recent} {
+		err := ioutil.WriteFile(f, []byte("{}"), 0600)
+		if err != nil {
+			t.Fatalf("could not write %s: %s", f, err)
+		}
+	}
+
+	held, err := flock.TryLock(filepath.Join(dir, "held.lock"))
+	if err != nil {
+		t.Fatalf("could not lock: %s", err)
+	}
+	defer held.Unlock()
+
+	unused := filepath.Join(dir, "unused.lock")
+	ioutil.WriteFile(unused, nil, 0600)
+
+	past := time.Now().Add(-2 * time.Hour)
+	for _, f := range []string{old, unused, filepath.Join(dir, "held.lock")} {
+		os.Chtimes(f, past, past)
+	}
+
+	// expiry is skipped while a request is opening its lock
+	dirLock, err := flock.TryLock(filepath.Join(dir, ".lock"))
+	if err != nil {
+		t.Fatalf("could not lock: %s", err)
+	}
+
+	a.expireCompletedRequests(dir)
+	if !fileExist(old) {
+		t.Fatalf("records were expired while the directory was locked")
+	}
+	dirLock.Unlock()
+
+	a.expireCompletedRequests(dir)
+
+	if fileExist(old) || fileExist(unused) {
+		t.Fatalf("expired record was not removed")
+	}
+
+	if !fileExist(filepath.Join(dir, "held.lock")) {
+		t.Fatalf("held lock file was removed")
+	}
+
+	if !fileExist(recent) {
+		t.Fatalf("recent record was removed")
+	}
+}
@@ -0,0 +1,576 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/choria-io/go-external/internal/flock"
+)
+
+// JobState is the state of a background job
+type JobState string
+
+const (
+	// JobPending is the state of a job that has been created but did not start yet
+	JobPending = JobState("pending")
+
+	// JobRunning is the state of a job that is busy running its action
+	JobRunning = JobState("running")
+
+	// JobCompleted is the state of a job whose action completed and recorded a reply
+	JobCompleted = JobState("completed")
+
+	// JobFailed is the state of a job whose process exited without recording a reply
+	JobFailed = JobState("failed")
+
+	// JobCancelled is the state of a job that was cancelled using job_cancel
+	JobCancelled = JobState("cancelled")
+
+	// DefaultJobsRetention is how long finished jobs are kept when jobs_retention is not configured
+	DefaultJobsRetention = 7 * 24 * time.Hour
+
+	// DefaultJobsTimeout is how long a job may run when jobs_timeout is not configured
+	DefaultJobsTimeout = 24 * time.Hour
+
+	jobLockTimeout = 10 * time.Second
+)
+
+// Job is the state of a background job as recorded in the jobs spool
+type Job struct {
+	ID        string    `json:"jobid"`
+	Agent     string    `json:"agent"`
+	Action    string    `json:"action"`
+	RequestID string    `json:"requestid"`
+	CallerID  string    `json:"callerid"`
+	PID       int       `json:"pid"`
+	State     JobState  `json:"state"`
+	Created   time.Time `json:"created"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	ExitCode  int       `json:"exitcode"`
+	Error     string    `json:"error,omitempty"`
+	Reply     *Reply    `json:"reply,omitempty"`
+}
+
+type jobRequest struct {
+	JobID string `json:"jobid"`
+}
+
+// spooledRequest is the request of a job as stored in its spool, with the metadata that is not part of the request JSON
+type spooledRequest struct {
+	Request           *Request           `json:"request"`
+	Protocol          string             `json:"protocol,omitempty"`
+	FactsPath         string             `json:"facts,omitempty"`
+	Federation        *Federation        `json:"federation,omitempty"`
+	CallerCertificate *CallerCertificate `json:"caller_certificate,omitempty"`
+}
+
+// RegisterJobAction registers an action that runs handler in a detached background process, the action
+// replies immediately with the job ID in the jobid field of its reply data.  Registering a job action also
+// registers the job_status, job_output, job_list and job_cancel actions used to manage jobs
+func (a *Agent) RegisterJobAction(name string, handler ActionHandler, opts ...ActionOption) error {
+	err := a.RegisterAction(name, handler, append(opts, func(act *action) { act.job = true })...)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := a.actions["job_status"]; ok {
+		return nil
+	}
+
+	a.MustRegisterAction("job_status", a.jobStatusAction)
+	a.MustRegisterAction("job_output", a.jobOutputAction)
+	a.MustRegisterAction("job_list", a.jobListAction)
+	a.MustRegisterAction("job_cancel", a.jobCancelAction)
+
+	return nil
+}
+
+// MustRegisterJobAction registers a job action and panics if any error occur
+func (a *Agent) MustRegisterJobAction(name string, handler ActionHandler, opts ...ActionOption) {
+	err := a.RegisterJobAction(name, handler, opts...)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// SetJobsDirectory sets the directory where jobs are spooled, overrides the jobs_directory configuration
+func (a *Agent) SetJobsDirectory(dir string) {
+	a.jobsDir = dir
+}
+
+func (a *Agent) jobsDirectory() string {
+	if a.jobsDir != "" {
+		return a.jobsDir
+	}
+
+	if a.configItem("jobs_directory") != "" {
+		return a.configItem("jobs_directory")
+	}
+
+	return filepath.Join(privateTempDir("jobs"), a.Name)
+}
+
+func (a *Agent) jobsRetention() time.Duration {
+	retention, err := time.ParseDuration(a.configItem("jobs_retention"))
+	if err != nil || retention <= 0 {
+		return DefaultJobsRetention
+	}
+
+	return retention
+}
+
+func (a *Agent) jobsTimeout() time.Duration {
+	timeout, err := time.ParseDuration(a.configItem("jobs_timeout"))
+	if err != nil || timeout <= 0 {
+		return DefaultJobsTimeout
+	}
+
+	return timeout
+}
+
+func (a *Agent) jobDirectory(id string) (string, error) {
+	if !validRequestID.MatchString(id) {
+		return "", fmt.Errorf("invalid job id %q", id)
+	}
+
+	return filepath.Join(a.jobsDirectory(), id), nil
+}
+
+// startJob spools the request and starts a detached copy of the agent to run it
+func (a *Agent) startJob(act *action, req *Request) *Reply {
+	a.expireJobs()
+
+	id, err := newJobID()
+	if err != nil {
+		return abortReply("could not create job id: %s", err)
+	}
+
+	// the spooled request is what the job runs so other users may not be able to modify it
+	err = ensurePrivateDirectory(a.jobsDirectory())
+	if err != nil {
+		return abortReply("could not create job spool: %s", err)
+	}
+
+	dir, _ := a.jobDirectory(id)
+	err = os.Mkdir(dir, 0700)
+	if err != nil {
+		return abortReply("could not create job spool %s: %s", dir, err)
+	}
+
+	err = writeFileAtomic(filepath.Join(dir, "request.json"), spooledRequest{
+		Request:           req,
+		Protocol:          req.protocol.rpcRequest,
+		FactsPath:         req.factsPath,
+		Federation:        req.Federation,
+		CallerCertificate: req.CallerCertificate,
+	})
+	if err != nil {
+		return abortReply("could not spool job request: %s", err)
+	}
+
+	job := &Job{
+		ID:        id,
+		Agent:     a.Name,
+		Action:    act.name,
+		RequestID: req.RequestID,
+		CallerID:  req.CallerID,
+		State:     JobPending,
+		Created:   time.Now().UTC(),
+	}
+
+	err = writeFileAtomic(filepath.Join(dir, "state.json"), job)
+	if err != nil {
+		return abortReply("could not spool job state: %s", err)
+	}
+
+	err = a.spawnJob(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return abortReply("could not start job: %s", err)
+	}
+
+	return &Reply{Data: map[string]string{"jobid": id}}
+}
+
+func (a *Agent) spawnJob(dir string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	stdout, err := os.OpenFile(filepath.Join(dir, "stdout"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer stdout.Close()
+
+	stderr, err := os.OpenFile(filepath.Join(dir, "stderr"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer stderr.Close()
+
+	cmd := exec.Command(self)
+	cmd.Env = append(os.Environ(), "CHORIA_EXTERNAL_JOB="+dir)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.SysProcAttr = newProcessGroupAttr()
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	// reap the job when it exits so a long running worker does not collect zombies
+	go cmd.Wait()
+
+	return nil
+}
+
+// processJob runs a spooled job, this is the entry point of the detached process started by startJob
+func (a *Agent) processJob(dir string) {
+	err := checkPrivateDirectory(filepath.Dir(dir))
+	if err != nil {
+		Errorf("not running job from %s: %s", dir, err)
+		os.Exit(1)
+	}
+
+	job, claimed, err := a.claimJob(dir)
+	if err != nil {
+		Errorf("could not start job from %s: %s", dir, err)
+		os.Exit(1)
+	}
+
+	if !claimed {
+		return
+	}
+
+	rj, err := ioutil.ReadFile(filepath.Join(dir, "request.json"))
+	if err != nil {
+		a.finishJob(dir, job, JobFailed, 1, nil, fmt.Errorf("could not read job request: %s", err))
+		os.Exit(1)
+	}
+
+	spooled := &spooledRequest{}
+	err = json.Unmarshal(rj, spooled)
+	if err == nil && spooled.Request == nil {
+		err = fmt.Errorf("no request found")
+	}
+	if err != nil {
+		a.finishJob(dir, job, JobFailed, 1, nil, fmt.Errorf("could not parse job request: %s", err))
+		os.Exit(1)
+	}
+
+	req := spooled.Request
+	req.Federation = spooled.Federation
+	req.CallerCertificate = spooled.CallerCertificate
+	req.factsPath = spooled.FactsPath
+	req.protocol = v1Protocol
+	if p, activation, found := protocolByName(spooled.Protocol); found && !activation {
+		req.protocol = p
+	}
+
+	// the job outlives the request so the request TTL does not limit it
+	req.deadline = job.Started.Add(a.jobsTimeout())
+
+	act, ok := a.actions[job.Action]
+	if !ok {
+		a.finishJob(dir, job, JobFailed, 1, nil, fmt.Errorf("unknown action %s", job.Action))
+		os.Exit(1)
+	}
+
+	rpch, err := newRPC(a)
+	if err != nil {
+		a.finishJob(dir, job, JobFailed, 1, nil, err)
+		os.Exit(1)
+	}
+
+	release := a.protectRequest(req)
+	defer release()
+
+	root := a.startTrace(fmt.Sprintf("job %s#%s", req.Agent, req.Action), req.RequestID, "", time.Now())
+	setRequestAttributes(root, req)
+	root.SetAttribute("choria.jobid", job.ID)
+	req.span = root
+
+	reply, _ := rpch.invoke(act, req)
+	a.protectReply(req, reply)
+	root.SetAttribute("choria.statuscode", int(reply.StatusCode))
+	root.End()
+
+	a.finishJob(dir, job, JobCompleted, 0, reply, nil)
+}
+
+// claimJob marks a pending job as running by this process, false is returned when it was cancelled before it started
+func (a *Agent) claimJob(dir string) (*Job, bool, error) {
+	lock, err := lockJob(dir)
+	if err != nil {
+		return nil, false, err
+	}
+	defer lock.Unlock()
+
+	job, err := a.loadJob(dir)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if job.State != JobPending {
+		return job, false, nil
+	}
+
+	job.PID = os.Getpid()
+	job.State = JobRunning
+	job.Started = time.Now().UTC()
+
+	err = writeFileAtomic(filepath.Join(dir, "state.json"), job)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not record job state: %s", err)
+	}
+
+	return job, true, nil
+}
+
+func (a *Agent) finishJob(dir string, job *Job, state JobState, code int, reply *Reply, jerr error) {
+	lock, err := lockJob(dir)
+	if err != nil {
+		Errorf("could not record job state: %s", err)
+		return
+	}
+	defer lock.Unlock()
+
+	// a cancelled job keeps its state even if the action managed to complete
+	current, err := a.loadJob(dir)
+	if err == nil && current.State == JobCancelled {
+		state = JobCancelled
+	}
+
+	job.State = state
+	job.ExitCode = code
+	job.Finished = time.Now().UTC()
+	job.Reply = reply
+	if jerr != nil {
+		job.Error = secrets.redact(jerr.Error())
+		Errorf("job %s failed: %s", job.ID, jerr)
+	}
+
+	err = writeFileAtomic(filepath.Join(dir, "state.json"), job)
+	if err != nil {
+		Errorf("could not record job state: %s", err)
+	}
+}
+
+// lockJob locks the state of a job, every state change is made while holding it
+func lockJob(dir string) (*flock.Lock, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), jobLockTimeout)
+	defer cancel()
+
+	return flock.WaitLock(ctx, filepath.Join(dir, "state.lock"), 10*time.Millisecond)
+}
+
+// loadJob reads the state of a job, jobs whose process died without recording a result are reported as failed
+func (a *Agent) loadJob(dir string) (*Job, error) {
+	sj, err := ioutil.ReadFile(filepath.Join(dir, "state.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	job := &Job{}
+	err = json.Unmarshal(sj, job)
+	if err != nil {
+		return nil, err
+	}
+
+	if job.State == JobRunning && !processAlive(job.PID) {
+		job.State = JobFailed
+		job.ExitCode = -1
+		job.Error = "job process exited without recording a result"
+	}
+
+	return job, nil
+}
+
+func (a *Agent) jobFromRequest(req *Request, rep *Reply) (string, *Job, bool) {
+	input := &jobRequest{}
+	if !req.ParseRequestData(input, rep) {
+		return "", nil, false
+	}
+
+	dir, err := a.jobDirectory(input.JobID)
+	if err != nil {
+		rep.InvalidData("%s", err)
+		return "", nil, false
+	}
+
+	job, err := a.loadJob(dir)
+	if os.IsNotExist(err) {
+		rep.InvalidData("unknown job %s", input.JobID)
+		return "", nil, false
+	}
+	if rep.AbortIfErr(err, "could not load job %s: %s", input.JobID, err) {
+		return "", nil, false
+	}
+
+	return dir, job, true
+}
+
+func (a *Agent) jobStatusAction(req *Request, rep *Reply, _ map[string]string) {
+	_, job, ok := a.jobFromRequest(req, rep)
+	if !ok {
+		return
+	}
+
+	rep.Data = job
+}
+
+func (a *Agent) jobOutputAction(req *Request, rep *Reply, _ map[string]string) {
+	dir, job, ok := a.jobFromRequest(req, rep)
+	if !ok {
+		return
+	}
+
+	stdout, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	if rep.AbortIfErr(err, "could not read output of job %s: %s", job.ID, err) {
+		return
+	}
+
+	stderr, err := ioutil.ReadFile(filepath.Join(dir, "stderr"))
+	if rep.AbortIfErr(err, "could not read output of job %s: %s", job.ID, err) {
+		return
+	}
+
+	rep.Data = map[string]interface{}{
+		"jobid":  job.ID,
+		"state":  job.State,
+		"stdout": string(stdout),
+		"stderr": string(stderr),
+	}
+}
+
+func (a *Agent) jobListAction(_ *Request, rep *Reply, _ map[string]string) {
+	a.expireJobs()
+
+	jobs, err := a.listJobs()
+	if rep.AbortIfErr(err, "could not list jobs: %s", err) {
+		return
+	}
+
+	for _, job := range jobs {
+		job.Reply = nil
+	}
+
+	rep.Data = map[string]interface{}{"jobs": jobs}
+}
+
+func (a *Agent) jobCancelAction(req *Request, rep *Reply, _ map[string]string) {
+	dir, job, ok := a.jobFromRequest(req, rep)
+	if !ok {
+		return
+	}
+
+	lock, err := lockJob(dir)
+	if rep.AbortIfErr(err, "could not lock job %s: %s", job.ID, err) {
+		return
+	}
+	defer lock.Unlock()
+
+	// the state is loaded again as it could have changed before the lock was obtained
+	id := job.ID
+	job, err = a.loadJob(dir)
+	if rep.AbortIfErr(err, "could not load job %s: %s", id, err) {
+		return
+	}
+
+	if job.State != JobRunning && job.State != JobPending {
+		rep.Abort("job %s is %s and cannot be cancelled", job.ID, job.State)
+		return
+	}
+
+	if job.PID > 0 {
+		err := terminateProcessGroup(job.PID)
+		if rep.AbortIfErr(err, "could not cancel job %s: %s", job.ID, err) {
+			return
+		}
+	}
+
+	job.State = JobCancelled
+	job.Finished = time.Now().UTC()
+	err = writeFileAtomic(filepath.Join(dir, "state.json"), job)
+	if rep.AbortIfErr(err, "could not record job state: %s", err) {
+		return
+	}
+
+	rep.Data = job
+}
+
+func (a *Agent) listJobs() ([]*Job, error) {
+	entries, err := ioutil.ReadDir(a.jobsDirectory())
+	if os.IsNotExist(err) {
+		return []*Job{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []*Job{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		job, err := a.loadJob(filepath.Join(a.jobsDirectory(), entry.Name()))
+		if err != nil {
+			continue
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created.Before(jobs[j].Created) })
+
+	return jobs, nil
+}
+
+// expireJobs removes the spool of finished jobs older than the retention period
+func (a *Agent) expireJobs() {
+	jobs, err := a.listJobs()
+	if err != nil {
+		return
+	}
+
+	retention := a.jobsRetention()
+
+	for _, job := range jobs {
+		if job.State == JobRunning {
+			continue
+		}
+
+		finished := job.Finished
+		if finished.IsZero() {
+			finished = job.Created
+		}
+
+		if time.Since(finished) > retention {
+			os.RemoveAll(filepath.Join(a.jobsDirectory(), job.ID))
+		}
+	}
+}
+
+func newJobID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,300 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain turns the test binary into a job runner when it is started as a detached job
+func TestMain(m *testing.M) {
+	if os.Getenv("CHORIA_EXTERNAL_JOB") != "" {
+		a := NewAgent("helloworld")
+		a.MustRegisterJobAction("ping", func(req *Request, rep *Reply, config map[string]string) {
+			Infof("job output")
+
+			if os.Getenv("JOB_TEST_SLEEP") != "" {
+				time.Sleep(10 * time.Second)
+			}
+
+			rep.Data = map[string]string{"message": "pong"}
+		})
+		a.MustRegisterJobAction("command", func(req *Request, rep *Reply, config map[string]string) {
+			res, err := req.RunCommand(context.Background(), Command{Path: "echo", Args: []string{"ran"}})
+			if rep.AbortIfCommandFailed(res, err) {
+				return
+			}
+
+			rep.Data = map[string]string{"output": res.Stdout}
+		})
+		a.MustRegisterJobAction("facts", func(req *Request, rep *Reply, config map[string]string) {
+			facts, err := req.Facts()
+			if rep.AbortIfErr(err, "could not read facts: %s", err) {
+				return
+			}
+
+			rep.Data = map[string]interface{}{"facts": facts, "protocol": req.ProtocolVersion()}
+		})
+
+		a.ProcessRequest()
+		os.Exit(0)
+	}
+
+	if os.Getenv("CHORIA_EXTERNAL_WORKER") != "" {
+		a := NewAgent("helloworld")
+		a.MustRegisterAction("ping", workerPingAction)
+		a.ProcessRequest()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+func waitForJob(t *testing.T, a *Agent, jobid string, state JobState) map[string]interface{} {
+	t.Helper()
+
+	timeout := time.After(10 * time.Second)
+
+	for {
+		reply := processRPC(t, a, requestFile(t, "job_status", map[string]string{"jobid": jobid}))
+		if reply.StatusCode != OK {
+			t.Fatalf("job_status failed: %s", reply.StatusMessage)
+		}
+
+		status := reply.Data.(map[string]interface{})
+		if status["state"] == string(state) {
+			return status
+		}
+
+		select {
+		case <-timeout:
+			t.Fatalf("job did not reach state %s, last status: %v", state, status)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func newJobAgent(t *testing.T) *Agent {
+	t.Helper()
+
+	a := NewAgent("helloworld")
+	a.SetJobsDirectory(tempDir(t))
+	a.MustRegisterJobAction("ping", func(req *Request, rep *Reply, config map[string]string) {
+		t.Fatalf("job action should not run in the test process")
+	})
+	a.MustRegisterJobAction("command", func(req *Request, rep *Reply, config map[string]string) {
+		t.Fatalf("job action should not run in the test process")
+	})
+	a.MustRegisterJobAction("facts", func(req *Request, rep *Reply, config map[string]string) {
+		t.Fatalf("job action should not run in the test process")
+	})
+
+	return a
+}
+
+func TestJobs(t *testing.T) {
+	defer cleanEnv()
+
+	a := newJobAgent(t)
+
+	reply := processRPC(t, a, "testdata/pingrequest.json")
+	if reply.StatusCode != OK {
+		t.Fatalf("starting job failed: %s", reply.StatusMessage)
+	}
+
+	jobid := reply.Data.(map[string]interface{})["jobid"].(string)
+	status := waitForJob(t, a, jobid, JobCompleted)
+
+	if status["action"] != "ping" || status["requestid"] != "034c527089f746248822ada8a145f499" {
+		t.Fatalf("incorrect job status: %v", status)
+	}
+
+	jobreply := status["reply"].(map[string]interface{})
+	if jobreply["data"].(map[string]interface{})["message"] != "pong" {
+		t.Fatalf("incorrect job reply: %v", jobreply)
+	}
+
+	reply = processRPC(t, a, requestFile(t, "job_output", map[string]string{"jobid": jobid}))
+	if reply.Data.(map[string]interface{})["stdout"] != "level=info msg=\"job output\"\n" {
+		t.Fatalf("incorrect job output: %v", reply.Data)
+	}
+
+	reply = processRPC(t, a, requestFile(t, "job_list", map[string]string{"jobid": ""}))
+	jobs := reply.Data.(map[string]interface{})["jobs"].([]interface{})
+	if len(jobs) != 1 || jobs[0].(map[string]interface{})["jobid"] != jobid {
+		t.Fatalf("incorrect job list: %v", reply.Data)
+	}
+
+	reply = processRPC(t, a, requestFile(t, "job_status", map[string]string{"jobid": "../../etc"}))
+	if reply.StatusCode != InvalidData {
+		t.Fatalf("expected invalid job id to fail, got %d", reply.StatusCode)
+	}
+}
+
+func TestJobCancel(t *testing.T) {
+	defer cleanEnv()
+	defer os.Unsetenv("JOB_TEST_SLEEP")
+
+	os.Setenv("JOB_TEST_SLEEP", "1")
+	a := newJobAgent(t)
+
+	reply := processRPC(t, a, "testdata/pingrequest.json")
+	jobid := reply.Data.(map[string]interface{})["jobid"].(string)
+	waitForJob(t, a, jobid, JobRunning)
+
+	reply = processRPC(t, a, requestFile(t, "job_cancel", map[string]string{"jobid": jobid}))
+	if reply.StatusCode != OK {
+		t.Fatalf("cancel failed: %s", reply.StatusMessage)
+	}
+
+	waitForJob(t, a, jobid, JobCancelled)
+
+	reply = processRPC(t, a, requestFile(t, "job_cancel", map[string]string{"jobid": jobid}))
+	if reply.StatusCode != Aborted {
+		t.Fatalf("expected cancelling a cancelled job to fail")
+	}
+}
+
+func TestJobCancelledBeforeStart(t *testing.T) {
+	defer cleanEnv()
+
+	a := newJobAgent(t)
+	id := "6d1b3e1a4f6c4c2e9d8b7a6f5e4d3c2b"
+	dir, _ := a.jobDirectory(id)
+
+	err := writeFileAtomic(filepath.Join(dir, "request.json"), spooledRequest{Request: &Request{Agent: "helloworld", Action: "ping"}})
+	if err != nil {
+		t.Fatalf("could not spool request: %s", err)
+	}
+
+	err = writeFileAtomic(filepath.Join(dir, "state.json"), &Job{ID: id, Agent: "helloworld", Action: "ping", State: JobPending, Created: time.Now().UTC()})
+	if err != nil {
+		t.Fatalf("could not spool state: %s", err)
+	}
+
+	reply := processRPC(t, a, requestFile(t, "job_cancel", map[string]string{"jobid": id}))
+	if reply.StatusCode != OK {
+		t.Fatalf("cancel failed: %s", reply.StatusMessage)
+	}
+
+	// the job action fails the test if it runs
+	a.processJob(dir)
+
+	job, err := a.loadJob(dir)
+	if err != nil {
+		t.Fatalf("could not load job: %s", err)
+	}
+
+	if job.State != JobCancelled || !job.Started.IsZero() {
+		t.Fatalf("cancelled job was started: %#v", job)
+	}
+}
+
+func TestJobSharedSpool(t *testing.T) {
+	defer cleanEnv()
+
+	shared := filepath.Join(tempDir(t), "shared")
+	os.Mkdir(shared, 0700)
+	os.Chmod(shared, 0777)
+
+	a := newJobAgent(t)
+	a.SetJobsDirectory(filepath.Join(shared, "jobs"))
+
+	reply := processRPC(t, a, "testdata/pingrequest.json")
+	if reply.StatusCode != Aborted || !strings.Contains(reply.StatusMessage, "modified by other users") {
+		t.Fatalf("job was spooled in a shared directory: %s", reply.StatusMessage)
+	}
+}
+
+func TestJobOutlivesRequest(t *testing.T) {
+	defer cleanEnv()
+
+	a := newJobAgent(t)
+
+	// the request expired long ago, the job still runs commands
+	path := requestFile(t, "command", map[string]string{})
+	req := map[string]interface{}{}
+	rj, _ := ioutil.ReadFile(path)
+	json.Unmarshal(rj, &req)
+	req["msgtime"] = time.Now().Add(-time.Hour).Unix()
+	rj, _ = json.Marshal(req)
+	ioutil.WriteFile(path, rj, 0600)
+
+	reply := processRPC(t, a, path)
+	if reply.StatusCode != OK {
+		t.Fatalf("starting job failed: %s", reply.StatusMessage)
+	}
+
+	status := waitForJob(t, a, reply.Data.(map[string]interface{})["jobid"].(string), JobCompleted)
+	jobreply := status["reply"].(map[string]interface{})
+	if jobreply["statuscode"].(float64) != float64(OK) || jobreply["data"].(map[string]interface{})["output"] != "ran\n" {
+		t.Fatalf("command did not run in the job: %v", jobreply)
+	}
+}
+
+func TestJobRequestMetadata(t *testing.T) {
+	defer cleanEnv()
+
+	a := newJobAgent(t)
+
+	rj, err := ioutil.ReadFile("testdata/pingrequest_v2.json")
+	if err != nil {
+		t.Fatalf("could not read request: %s", err)
+	}
+
+	req := map[string]interface{}{}
+	json.Unmarshal(rj, &req)
+	req["action"] = "facts"
+	rj, _ = json.Marshal(req)
+
+	path := filepath.Join(tempDir(t), "request.json")
+	ioutil.WriteFile(path, rj, 0600)
+
+	facts, _ := filepath.Abs("testdata/facts.json")
+	os.Setenv("CHORIA_EXTERNAL_FACTS", facts)
+
+	reply := processWithProtocol(t, a, "io.choria.mcorpc.external.v2.rpc_request", path)
+	if reply["statuscode"].(float64) != float64(OK) {
+		t.Fatalf("starting job failed: %v", reply)
+	}
+
+	status := waitForJob(t, a, reply["data"].(map[string]interface{})["jobid"].(string), JobCompleted)
+	data, ok := status["reply"].(map[string]interface{})["data"].(map[string]interface{})
+	if !ok || data["protocol"] != float64(2) || data["facts"].(map[string]interface{})["ginkgo"] != true {
+		t.Fatalf("job did not receive the request metadata: %v", status["reply"])
+	}
+}
+
+func TestProcessAliveZombie(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("process state is not available on this platform")
+	}
+
+	cmd := exec.Command("true")
+	err := cmd.Start()
+	if err != nil {
+		t.Fatalf("could not start process: %s", err)
+	}
+
+	// the process exits but is not reaped until Wait is called
+	timeout := time.After(10 * time.Second)
+	for processAlive(cmd.Process.Pid) {
+		select {
+		case <-timeout:
+			t.Fatalf("exited process was reported alive")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	cmd.Wait()
+
+	if processAlive(cmd.Process.Pid) || !processAlive(os.Getpid()) {
+		t.Fatalf("unexpected process state")
+	}
+}
@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/choria-io/go-external/internal/flock"
+)
+
+// LockScope determines which other invocations an action lock excludes
+type LockScope int
+
+const (
+	// AgentLock prevents an action from running while any other agent scoped locked action of the same agent is running
+	AgentLock = LockScope(iota)
+
+	// ActionLock prevents an action from running concurrently with another invocation of the same action
+	ActionLock
+)
+
+type lockSettings struct {
+	scope LockScope
+	wait  time.Duration
+}
+
+// lockHolder is written into the lock file by the process holding the lock
+type lockHolder struct {
+	RequestID string    `json:"requestid"`
+	Action    string    `json:"action"`
+	PID       int       `json:"pid"`
+	Time      time.Time `json:"time"`
+}
+
+// WithLock prevents concurrent execution of an action across processes using a lock file, when wait is
+// 0 the request fails immediately when the lock is held else it waits up to wait for the lock to be released
+func WithLock(scope LockScope, wait time.Duration) ActionOption {
+	return func(a *action) {
+		a.lock = &lockSettings{scope: scope, wait: wait}
+	}
+}
+
+// SetLockDirectory sets the directory where action lock files are kept, overrides the lock_directory configuration
+func (a *Agent) SetLockDirectory(dir string) {
+	a.lockDir = dir
+}
+
+func (a *Agent) lockDirectory() string {
+	if a.lockDir != "" {
+		return a.lockDir
+	}
+
+	if a.configItem("lock_directory") != "" {
+		return a.configItem("lock_directory")
+	}
+
+	return filepath.Join(os.TempDir(), "choria-external-locks")
+}
+
+func (a *Agent) lockPath(act *action) string {
+	name := a.Name
+	if act.lock.scope == ActionLock {
+		name = fmt.Sprintf("%s_%s", a.Name, act.name)
+	}
+
+	return filepath.Join(a.lockDirectory(), name+".lock")
+}
+
+// obtainLock acquires the lock configured for act and returns a function that releases it
+func (a *Agent) obtainLock(act *action, req *Request) (func(), error) {
+	if act.lock == nil {
+		return func() {}, nil
+	}
+
+	path := a.lockPath(act)
+
+	var lock *flock.Lock
+	var err error
+
+	if act.lock.wait > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), act.lock.wait)
+		defer cancel()
+		lock, err = flock.WaitLock(ctx, path, 100*time.Millisecond)
+	} else {
+		lock, err = flock.TryLock(path)
+	}
+
+	if err == flock.ErrLocked {
+		return nil, fmt.Errorf("could not obtain lock for %s#%s: %s", a.Name, act.name, describeLockHolder(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not obtain lock for %s#%s: %s", a.Name, act.name, err)
+	}
+
+	previous, err := readLockHolder(lock.File())
+	if err == nil && previous.PID != os.Getpid() && !processAlive(previous.PID) {
+		req.Logger().Warn("Recovered stale lock", "lock", path, "previous_requestid", previous.RequestID, "previous_pid", previous.PID)
+	}
+
+	err = writeLockHolder(lock.File(), lockHolder{
+		RequestID: req.RequestID,
+		Action:    act.name,
+		PID:       os.Getpid(),
+		Time:      time.Now().UTC(),
+	})
+	if err != nil {
+		lock.Unlock()
+		return nil, fmt.Errorf("could not record lock holder in %s: %s", path, err)
+	}
+
+	return func() {
+		lock.File().Truncate(0)
+		lock.Unlock()
+	}, nil
+}
+
+func describeLockHolder(path string) string {
+	hj, err := ioutil.ReadFile(path)
+	if err != nil || len(hj) == 0 {
+		return "held by an unknown request"
+	}
+
+	holder := lockHolder{}
+	err = json.Unmarshal(hj, &holder)
+	if err != nil {
+		return "held by an unknown request"
+	}
+
+	msg := fmt.Sprintf("held by request %s (action %s, pid %d) since %s", holder.RequestID, holder.Action, holder.PID, holder.Time.Format(time.RFC3339))
+	if !processAlive(holder.PID) {
+		msg = "stale lock " + msg
+	}
+
+	return msg
+}
+
+func readLockHolder(f *os.File) (*lockHolder, error) {
+	_, err := f.Seek(0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	hj, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hj) == 0 {
+		return nil, fmt.Errorf("lock file is empty")
+	}
+
+	holder := &lockHolder{}
+	err = json.Unmarshal(hj, holder)
+	if err != nil {
+		return nil, err
+	}
+
+	return holder, nil
+}
+
+func writeLockHolder(f *os.File, holder lockHolder) error {
+	hj, err := json.Marshal(holder)
+	if err != nil {
+		return err
+	}
+
+	err = f.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt(hj, 0)
+
+	return err
+}
@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/choria-io/go-external/internal/flock"
+)
+
+func TestActionLock(t *testing.T) {
+	defer cleanEnv()
+
+	ran := false
+	a := NewAgent("helloworld")
+	a.SetLockDirectory(tempDir(t))
+	a.MustRegisterAction("ping", func(req *Request, rep *Reply, config map[string]string) {
+		ran = true
+	}, WithLock(ActionLock, 0))
+
+	reply := processRPC(t, a, "testdata/pingrequest.json")
+	if reply.StatusCode != OK || !ran {
+		t.Fatalf("expected unlocked action to run, got %d: %s", reply.StatusCode, reply.StatusMessage)
+	}
+
+	lock, err := flock.TryLock(a.lockPath(a.actions["ping"]))
+	if err != nil {
+		t.Fatalf("could not lock: %s", err)
+	}
+	defer lock.Unlock()
+
+	err = writeLockHolder(lock.File(), lockHolder{RequestID: "other", Action: "ping", PID: os.Getpid(), Time: time.Now()})
+	if err != nil {
+		t.Fatalf("could not write holder: %s", err)
+	}
+
+	ran = false
+	reply = processRPC(t, a, "testdata/pingrequest.json")
+	if reply.StatusCode != Aborted || ran {
+		t.Fatalf("expected locked action to be aborted, got %d", reply.StatusCode)
+	}
+
+	if !strings.Contains(reply.StatusMessage, "held by request other") {
+		t.Fatalf("expected the holder in the message, got %q", reply.StatusMessage)
+	}
+}
+
+func TestActionLockWait(t *testing.T) {
+	defer cleanEnv()
+
+	a := NewAgent("helloworld")
+	a.SetLockDirectory(tempDir(t))
+	a.MustRegisterAction("ping", func(req *Request, rep *Reply, config map[string]string) {}, WithLock(AgentLock, time.Second))
+
+	lock, err := flock.TryLock(a.lockPath(a.actions["ping"]))
+	if err != nil {
+		t.Fatalf("could not lock: %s", err)
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		lock.Unlock()
+	}()
+
+	reply := processRPC(t, a, "testdata/pingrequest.json")
+	if reply.StatusCode != OK {
+		t.Fatalf("expected action to run once the lock was released, got %d: %s", reply.StatusCode, reply.StatusMessage)
+	}
+}
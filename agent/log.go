@@ -0,0 +1,210 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is the severity of a log message
+type Level int32
+
+const (
+	// DebugLevel messages are only logged when the log_level configuration is debug
+	DebugLevel = Level(iota)
+
+	// InfoLevel is the default level
+	InfoLevel
+
+	// WarnLevel messages indicate problems that did not prevent the request from being handled
+	WarnLevel
+
+	// ErrorLevel messages indicate failures
+	ErrorLevel
+)
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+}
+
+// ParseLevel parses a level name like debug or error, an empty string is InfoLevel
+func ParseLevel(level string) (Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return DebugLevel, nil
+	case "", "info":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	default:
+		return InfoLevel, fmt.Errorf("invalid log level %q", level)
+	}
+}
+
+// Logger writes leveled messages in logfmt format, debug and info messages are written to STDOUT and
+// warnings and errors to STDERR so the Choria Server logs them at a matching level. Sensitive values of
+// the requests being handled are masked in all messages
+type Logger struct {
+	level  *int32
+	fields []interface{}
+	stdout io.Writer
+	stderr io.Writer
+}
+
+var defaultLogger = NewLogger(stdWriter{}, stdWriter{stderr: true})
+
+// stdWriter writes to the current os.Stdout or os.Stderr
+type stdWriter struct {
+	stderr bool
+}
+
+func (w stdWriter) Write(p []byte) (int, error) {
+	if w.stderr {
+		return os.Stderr.Write(p)
+	}
+
+	return os.Stdout.Write(p)
+}
+
+// NewLogger creates a logger at InfoLevel writing debug and info messages to stdout and others to stderr
+func NewLogger(stdout io.Writer, stderr io.Writer) *Logger {
+	level := int32(InfoLevel)
+
+	return &Logger{level: &level, stdout: stdout, stderr: stderr}
+}
+
+// Log returns the logger used by Infof and Errorf and by the agent itself, its level is set using the
+// log_level configuration
+func Log() *Logger {
+	return defaultLogger
+}
+
+// SetLevel sets the minimum level of messages to log, it applies to all loggers derived from this one
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(l.level, int32(level))
+}
+
+// Level is the minimum level of messages to log
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(l.level))
+}
+
+// With creates a logger that adds the key value pairs kv to every message
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+
+	return &Logger{level: l.level, fields: fields, stdout: l.stdout, stderr: l.stderr}
+}
+
+// Debug logs msg and the key value pairs kv at DebugLevel
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(DebugLevel, msg, kv)
+}
+
+// Info logs msg and the key value pairs kv at InfoLevel
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(InfoLevel, msg, kv)
+}
+
+// Warn logs msg and the key value pairs kv at WarnLevel
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(WarnLevel, msg, kv)
+}
+
+// Error logs msg and the key value pairs kv at ErrorLevel
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(ErrorLevel, msg, kv)
+}
+
+// Debugf logs a formatted message at DebugLevel
+func (l *Logger) Debugf(format string, a ...interface{}) {
+	l.log(DebugLevel, fmt.Sprintf(format, a...), nil)
+}
+
+// Infof logs a formatted message at InfoLevel
+func (l *Logger) Infof(format string, a ...interface{}) {
+	l.log(InfoLevel, fmt.Sprintf(format, a...), nil)
+}
+
+// Warnf logs a formatted message at WarnLevel
+func (l *Logger) Warnf(format string, a ...interface{}) {
+	l.log(WarnLevel, fmt.Sprintf(format, a...), nil)
+}
+
+// Errorf logs a formatted message at ErrorLevel
+func (l *Logger) Errorf(format string, a ...interface{}) {
+	l.log(ErrorLevel, fmt.Sprintf(format, a...), nil)
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if level < l.Level() {
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("level=" + level.String())
+	// secrets are masked before quoting as escaping would change how they appear in the line
+	buf.WriteString(" msg=" + logfmtValue(secrets.redact(msg)))
+
+	writeFields(buf, l.fields)
+	writeFields(buf, kv)
+	buf.WriteByte('\n')
+
+	out := l.stdout
+	if level >= WarnLevel {
+		out = l.stderr
+	}
+
+	// a single write keeps lines from concurrent requests in a worker intact
+	out.Write(buf.Bytes())
+}
+
+func writeFields(buf *bytes.Buffer, kv []interface{}) {
+	for i := 0; i < len(kv); i += 2 {
+		key := fmt.Sprintf("%v", kv[i])
+
+		var value interface{} = "(MISSING)"
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+
+		buf.WriteString(" " + logfmtKey(key) + "=" + logfmtValue(secrets.redact(fmt.Sprintf("%v", value))))
+	}
+}
+
+func logfmtKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' {
+			return '_'
+		}
+
+		return r
+	}, key)
+}
+
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\\\t\r\n") {
+		return strconv.Quote(value)
+	}
+
+	return value
+}
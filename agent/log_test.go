@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+
+	log := NewLogger(stdout, stderr).With("agent", "helloworld")
+	log.Debug("hidden")
+	log.Info("handling request", "requestid", "123", "count", 2)
+	log.Warnf("disk %d%% full", 90)
+	log.Error("failed", "error", fmt.Errorf(`could not "open" file`), "odd")
+
+	expected := "level=info msg=\"handling request\" agent=helloworld requestid=123 count=2\n"
+	if stdout.String() != expected {
+		t.Fatalf("unexpected stdout: %q", stdout.String())
+	}
+
+	expected = "level=warn msg=\"disk 90% full\" agent=helloworld\n" +
+		"level=error msg=failed agent=helloworld error=\"could not \\\"open\\\" file\" odd=(MISSING)\n"
+	if stderr.String() != expected {
+		t.Fatalf("unexpected stderr: %q", stderr.String())
+	}
+
+	stdout.Reset()
+	log.SetLevel(DebugLevel)
+	log.Debug("shown", "empty", "")
+	if stdout.String() != "level=debug msg=shown agent=helloworld empty=\"\"\n" {
+		t.Fatalf("unexpected stdout: %q", stdout.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for in, expected := range map[string]Level{"": InfoLevel, "debug": DebugLevel, "INFO": InfoLevel, "warn": WarnLevel, "error": ErrorLevel} {
+		level, err := ParseLevel(in)
+		if err != nil || level != expected {
+			t.Fatalf("expected %s for %q got %s: %v", expected, in, level, err)
+		}
+	}
+
+	_, err := ParseLevel("trace")
+	if err == nil {
+		t.Fatalf("expected invalid level to fail")
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	defer cleanEnv()
+
+	stdout := &bytes.Buffer{}
+	original := defaultLogger
+	defaultLogger = NewLogger(stdout, ioutil.Discard)
+	defer func() { defaultLogger = original }()
+
+	config := filepath.Join(tempDir(t), "plugin.conf")
+	err := ioutil.WriteFile(config, []byte("log_level = debug\n"), 0600)
+	if err != nil {
+		t.Fatalf("could not write config: %s", err)
+	}
+	os.Setenv("CHORIA_EXTERNAL_CONFIG", config)
+
+	a := NewAgent("helloworld")
+	a.MustRegisterAction("ping", func(req *Request, rep *Reply, config map[string]string) {
+		req.Logger().Debug("pinged", "msg_size", 5)
+		Infof("legacy %s", "message")
+	})
+
+	processRPC(t, a, requestFile(t, "ping", map[string]string{}))
+
+	for _, expected := range []string{
+		"level=debug msg=\"Handling request\" requestid=ea0bd4ee3e9b4e8c9aa7c3c7c8e17e3d agent=helloworld action=ping data={}\n",
+		"level=debug msg=pinged requestid=ea0bd4ee3e9b4e8c9aa7c3c7c8e17e3d agent=helloworld action=ping msg_size=5\n",
+		"level=info msg=\"legacy message\"\n",
+	} {
+		if !strings.Contains(stdout.String(), expected) {
+			t.Fatalf("expected %q in log output: %q", expected, stdout.String())
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package agent
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/choria-io/go-external/internal/metrics"
+)
+
+// durationBuckets are the upper bounds in seconds of the request duration histogram buckets
+var durationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+// SetMetricsFile enables metrics that are merged into a node-exporter textfile collector file, same
+// as the metrics_file configuration, the file name should end in .prom
+func (a *Agent) SetMetricsFile(path string) {
+	a.metricsPath = path
+}
+
+func (a *Agent) metricsFile() string {
+	if a.metricsPath != "" {
+		return a.metricsPath
+	}
+
+	return a.configItem("metrics_file")
+}
+
+// recordMetrics writes the metrics set by record when metrics are enabled, failures are logged
+func (a *Agent) recordMetrics(record func(s *metrics.Set)) {
+	path := a.metricsFile()
+	if path == "" {
+		return
+	}
+
+	set := metrics.NewSet()
+	record(set)
+
+	err := set.Write(path, metrics.DefaultLockTimeout)
+	if err != nil {
+		Errorf("Could not write metrics: %s", err)
+	}
+}
+
+func (a *Agent) recordRequest(action string, reply *Reply, duration time.Duration) {
+	a.recordMetrics(func(s *metrics.Set) {
+		labels := metrics.Labels{"agent": a.Name, "action": action}
+
+		s.Counter("choria_external_agent_requests_total", "Requests handled by the agent", metrics.Labels{"agent": a.Name, "action": action, "statuscode": strconv.Itoa(int(reply.StatusCode))}, 1)
+		s.Observe("choria_external_agent_request_duration_seconds", "Time taken to handle requests", durationBuckets, labels, duration.Seconds())
+	})
+}
+
+func (a *Agent) recordPanic(action string) {
+	a.recordMetrics(func(s *metrics.Set) {
+		s.Counter("choria_external_agent_panics_total", "Actions that panicked", metrics.Labels{"agent": a.Name, "action": action}, 1)
+	})
+}
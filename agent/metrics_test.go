@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	defer cleanEnv()
+
+	path := filepath.Join(tempDir(t), "helloworld.prom")
+
+	a := NewAgent("helloworld")
+	a.SetMetricsFile(path)
+	a.MustRegisterAction("ping", func(req *Request, rep *Reply, config map[string]string) {})
+	a.MustRegisterAction("crash", func(req *Request, rep *Reply, config map[string]string) {
+		panic("boom")
+	})
+
+	processRPC(t, a, requestFile(t, "ping", map[string]string{}))
+	processRPC(t, a, requestFile(t, "ping", map[string]string{}))
+	processRPC(t, a, requestFile(t, "missing", map[string]string{}))
+
+	reply := processRPC(t, a, requestFile(t, "crash", map[string]string{}))
+	if reply.StatusCode != UnknownError || reply.StatusMessage != "action panicked: boom" {
+		t.Fatalf("unexpected reply from panicking action: %#v", reply)
+	}
+
+	tf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read metrics: %s", err)
+	}
+
+	for _, expected := range []string{
+		`choria_external_agent_requests_total{action="ping",agent="helloworld",statuscode="0"} 2`,
+		`choria_external_agent_requests_total{action="unknown",agent="helloworld",statuscode="1"} 1`,
+		`choria_external_agent_requests_total{action="crash",agent="helloworld",statuscode="5"} 1`,
+		`choria_external_agent_panics_total{action="crash",agent="helloworld"} 1`,
+		`choria_external_agent_request_duration_seconds_count{action="ping",agent="helloworld"} 2`,
+		`# TYPE choria_external_agent_request_duration_seconds histogram`,
+	} {
+		if !strings.Contains(string(tf), expected+"\n") {
+			t.Fatalf("metrics did not include %s:\n%s", expected, tf)
+		}
+	}
+}
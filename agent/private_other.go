@@ -0,0 +1,28 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// checkPrivateDirectory only ensures dir is a directory as ownership cannot be determined on this platform
+func checkPrivateDirectory(dir string) error {
+	stat, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+
+	if !stat.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	return nil
+}
+
+func listenPrivateUnix(socket string) (net.Listener, error) {
+	return net.Listen("unix", socket)
+}
@@ -0,0 +1,61 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// checkPrivateDirectory ensures only the current user can access dir and that no other user can replace it, every
+// parent has to be owned by the user or root and not be writable by others unless it is sticky like /tmp
+func checkPrivateDirectory(dir string) error {
+	path, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	uid := uint32(os.Geteuid())
+
+	for current := path; ; current = filepath.Dir(current) {
+		stat, err := os.Lstat(current)
+		if err != nil {
+			return err
+		}
+
+		sys, ok := stat.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("could not determine the owner of %s", current)
+		}
+
+		if current == path {
+			if !stat.IsDir() || sys.Uid != uid || stat.Mode().Perm()&0077 != 0 {
+				return fmt.Errorf("%s is not a directory private to uid %d", dir, uid)
+			}
+		} else if sys.Uid != uid && sys.Uid != 0 || stat.Mode().Perm()&0022 != 0 && stat.Mode()&os.ModeSticky == 0 {
+			return fmt.Errorf("%s is in %s that can be modified by other users", dir, current)
+		}
+
+		if current == filepath.Dir(current) {
+			return nil
+		}
+	}
+}
+
+// listenPrivateUnix listens on a Unix socket that is created accessible only to the current user
+func listenPrivateUnix(socket string) (net.Listener, error) {
+	// the umask is process wide, this is only used by the worker before it handles any requests
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+
+	return net.Listen("unix", socket)
+}
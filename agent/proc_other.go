@@ -0,0 +1,33 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package agent
+
+import (
+	"os"
+	"syscall"
+)
+
+// processAlive cannot determine liveness on this platform and assumes the process exists
+func processAlive(pid int) bool {
+	return pid > 0
+}
+
+func newProcessGroupAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+// terminateProcessGroup kills only pid as process groups are not supported on this platform
+func terminateProcessGroup(pid int) error {
+	return killProcessGroup(pid)
+}
+
+// killProcessGroup kills only pid as process groups are not supported on this platform
+func killProcessGroup(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+
+	return p.Kill()
+}
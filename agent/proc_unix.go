@@ -0,0 +1,56 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strconv"
+	"syscall"
+)
+
+// processAlive determines if pid is running, zombies that exited but were not yet reaped are not alive
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	err := syscall.Kill(pid, 0)
+	if err != nil && err != syscall.EPERM {
+		return false
+	}
+
+	return !processZombie(pid)
+}
+
+// processZombie checks the process state in /proc, false when it is not available on this platform
+func processZombie(pid int) bool {
+	stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+
+	// the state follows the command name which is in parenthesis and may itself contain spaces or parenthesis
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 || i+2 >= len(stat) {
+		return false
+	}
+
+	return stat[i+2] == 'Z' || stat[i+2] == 'X'
+}
+
+// newProcessGroupAttr starts a process as the leader of a new session so it and its children can be signaled together
+func newProcessGroupAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// terminateProcessGroup sends SIGTERM to every process in the group led by pid
+func terminateProcessGroup(pid int) error {
+	return syscall.Kill(-pid, syscall.SIGTERM)
+}
+
+// killProcessGroup sends SIGKILL to every process in the group led by pid
+func killProcessGroup(pid int) error {
+	return syscall.Kill(-pid, syscall.SIGKILL)
+}
@@ -0,0 +1,210 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// protocol is a version of the external agent protocol, every version has its own request and reply
+// formats that are translated to and from the normalized Request and Reply seen by handlers
+type protocol struct {
+	version           int
+	activationRequest string
+	activationReply   string
+	rpcRequest        string
+	rpcReply          string
+
+	// schemas of the documents in this version, see the schemas package
+	activationRequestSchema string
+	activationReplySchema   string
+	rpcRequestSchema        string
+	rpcReplySchema          string
+
+	// decodeRequest parses a RPC request into a normalized Request
+	decodeRequest func(data []byte) (*Request, error)
+
+	// encodeReply creates the document to publish for a reply to req, req is nil when the request could not be parsed
+	encodeReply func(req *Request, rep *Reply) interface{}
+
+	// encodeActivationReply creates the document to publish for an activation reply
+	encodeActivationReply func(rep *ActivationReply) interface{}
+}
+
+var protocols = []*protocol{v1Protocol, v2Protocol}
+
+// protocolByName finds the protocol a request protocol name belongs to, activation is true for activation requests
+func protocolByName(name string) (p *protocol, activation bool, found bool) {
+	for _, p := range protocols {
+		switch name {
+		case p.activationRequest:
+			return p, true, true
+		case p.rpcRequest:
+			return p, false, true
+		}
+	}
+
+	return nil, false, false
+}
+
+var v1Protocol = &protocol{
+	version:           1,
+	activationRequest: activationProtocol,
+	activationReply:   activationReplyProtocol,
+	rpcRequest:        rpcRequestProtocol,
+	rpcReply:          rpcReplyProtocol,
+
+	activationRequestSchema: "https://choria.io/schemas/mcorpc/external/v1/activation_request.json",
+	activationReplySchema:   "https://choria.io/schemas/mcorpc/external/v1/activation_reply.json",
+	rpcRequestSchema:        "https://choria.io/schemas/mcorpc/external/v1/rpc_request.json",
+	rpcReplySchema:          "https://choria.io/schemas/mcorpc/external/v1/rpc_reply.json",
+
+	decodeRequest: func(data []byte) (*Request, error) {
+		req := &Request{}
+		err := json.Unmarshal(data, req)
+		if err != nil {
+			return nil, err
+		}
+
+		if req.Protocol != rpcRequestProtocol {
+			return nil, fmt.Errorf("unexpected protocol '%s'", req.Protocol)
+		}
+
+		return req, nil
+	},
+
+	encodeReply: func(_ *Request, rep *Reply) interface{} {
+		return rep
+	},
+
+	encodeActivationReply: func(rep *ActivationReply) interface{} {
+		return rep
+	},
+}
+
+const (
+	activationProtocolV2      = "io.choria.mcorpc.external.v2.activation_request"
+	activationReplyProtocolV2 = "io.choria.mcorpc.external.v2.activation_reply"
+	rpcRequestProtocolV2      = "io.choria.mcorpc.external.v2.rpc_request"
+	rpcReplyProtocolV2        = "io.choria.mcorpc.external.v2.rpc_reply"
+
+	activationRequestSchemaV2 = "https://choria.io/schemas/mcorpc/external/v2/activation_request.json"
+	activationReplySchemaV2   = "https://choria.io/schemas/mcorpc/external/v2/activation_reply.json"
+	rpcRequestSchemaV2        = "https://choria.io/schemas/mcorpc/external/v2/rpc_request.json"
+	rpcReplySchemaV2          = "https://choria.io/schemas/mcorpc/external/v2/rpc_reply.json"
+)
+
+// Federation describes how a request reached the node when it passed through a Choria Federation
+type Federation struct {
+	RequestID string   `json:"req"`
+	ReplyTo   string   `json:"reply_to"`
+	SeenBy    []string `json:"seen_by"`
+}
+
+// CallerCertificate describes the certificate the caller signed the request with
+type CallerCertificate struct {
+	Subject     string `json:"subject"`
+	Issuer      string `json:"issuer"`
+	Fingerprint string `json:"fingerprint"`
+	PEM         string `json:"pem"`
+}
+
+// v2Request is the version 2 RPC request, it adds federation and caller certificate metadata to version 1
+type v2Request struct {
+	Schema     string          `json:"$schema"`
+	Protocol   string          `json:"protocol"`
+	Agent      string          `json:"agent"`
+	Action     string          `json:"action"`
+	RequestID  string          `json:"requestid"`
+	SenderID   string          `json:"senderid"`
+	CallerID   string          `json:"callerid"`
+	Collective string          `json:"collective"`
+	TTL        int             `json:"ttl"`
+	Time       int64           `json:"msgtime"`
+	Data       json.RawMessage `json:"data"`
+	Metadata   struct {
+		Federation        *Federation        `json:"federation"`
+		CallerCertificate *CallerCertificate `json:"caller_certificate"`
+	} `json:"metadata"`
+}
+
+// v2Reply is the version 2 RPC reply, unlike version 1 it identifies itself and the request it answers
+type v2Reply struct {
+	Schema        string      `json:"$schema"`
+	Protocol      string      `json:"protocol"`
+	RequestID     string      `json:"requestid"`
+	StatusCode    StatusCode  `json:"statuscode"`
+	StatusMessage string      `json:"statusmsg"`
+	Data          interface{} `json:"data"`
+}
+
+// v2ActivationReply is the version 2 activation reply
+type v2ActivationReply struct {
+	Schema         string `json:"$schema"`
+	Protocol       string `json:"protocol"`
+	ShouldActivate bool   `json:"activate"`
+}
+
+var v2Protocol = &protocol{
+	version:           2,
+	activationRequest: activationProtocolV2,
+	activationReply:   activationReplyProtocolV2,
+	rpcRequest:        rpcRequestProtocolV2,
+	rpcReply:          rpcReplyProtocolV2,
+
+	activationRequestSchema: activationRequestSchemaV2,
+	activationReplySchema:   activationReplySchemaV2,
+	rpcRequestSchema:        rpcRequestSchemaV2,
+	rpcReplySchema:          rpcReplySchemaV2,
+
+	decodeRequest: func(data []byte) (*Request, error) {
+		v2 := &v2Request{}
+		err := json.Unmarshal(data, v2)
+		if err != nil {
+			return nil, err
+		}
+
+		if v2.Protocol != rpcRequestProtocolV2 {
+			return nil, fmt.Errorf("unexpected protocol '%s'", v2.Protocol)
+		}
+
+		return &Request{
+			Schema:            v2.Schema,
+			Protocol:          v2.Protocol,
+			Agent:             v2.Agent,
+			Action:            v2.Action,
+			RequestID:         v2.RequestID,
+			SenderID:          v2.SenderID,
+			CallerID:          v2.CallerID,
+			Collective:        v2.Collective,
+			TTL:               v2.TTL,
+			Time:              v2.Time,
+			Data:              v2.Data,
+			Federation:        v2.Metadata.Federation,
+			CallerCertificate: v2.Metadata.CallerCertificate,
+		}, nil
+	},
+
+	encodeReply: func(req *Request, rep *Reply) interface{} {
+		reply := &v2Reply{
+			Schema:        rpcReplySchemaV2,
+			Protocol:      rpcReplyProtocolV2,
+			StatusCode:    rep.StatusCode,
+			StatusMessage: rep.StatusMessage,
+			Data:          rep.Data,
+		}
+
+		if req != nil {
+			reply.RequestID = req.RequestID
+		}
+
+		return reply
+	},
+
+	encodeActivationReply: func(rep *ActivationReply) interface{} {
+		return &v2ActivationReply{
+			Schema:         activationReplySchemaV2,
+			Protocol:       activationReplyProtocolV2,
+			ShouldActivate: rep.ShouldActivate,
+		}
+	},
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func processWithProtocol(t *testing.T, agent *Agent, protocol string, request string) map[string]interface{} {
+	t.Helper()
+
+	os.Setenv("CHORIA_EXTERNAL_REQUEST", request)
+	os.Setenv("CHORIA_EXTERNAL_REPLY", filepath.Join(tempDir(t), "reply.json"))
+	os.Setenv("CHORIA_EXTERNAL_PROTOCOL", protocol)
+
+	err := ioutil.WriteFile(os.Getenv("CHORIA_EXTERNAL_REPLY"), []byte{}, 0600)
+	if err != nil {
+		t.Fatalf("could not create reply file: %s", err)
+	}
+
+	agent.ProcessRequest()
+
+	rj, err := ioutil.ReadFile(os.Getenv("CHORIA_EXTERNAL_REPLY"))
+	if err != nil {
+		t.Fatalf("reading reply failed: %s", err)
+	}
+
+	reply := map[string]interface{}{}
+	err = json.Unmarshal(rj, &reply)
+	if err != nil {
+		t.Fatalf("parsing reply failed: %s", err)
+	}
+
+	return reply
+}
+
+func TestProtocolV2RPC(t *testing.T) {
+	defer cleanEnv()
+
+	var seen *Request
+	a := NewAgent("helloworld")
+	a.MustRegisterAction("ping", func(req *Request, rep *Reply, config map[string]string) {
+		seen = req
+		rep.Data = map[string]string{"message": "pong"}
+	})
+
+	reply := processWithProtocol(t, a, "io.choria.mcorpc.external.v2.rpc_request", "testdata/pingrequest_v2.json")
+
+	if seen == nil {
+		t.Fatalf("action was not called")
+	}
+
+	if seen.ProtocolVersion() != 2 || seen.Federation == nil || seen.Federation.SeenBy[0] != "fed1.devco.net" {
+		t.Fatalf("federation metadata was not normalized: %#v", seen.Federation)
+	}
+
+	if seen.CallerCertificate == nil || seen.CallerCertificate.Subject != "CN=rip.mcollective" {
+		t.Fatalf("certificate metadata was not normalized: %#v", seen.CallerCertificate)
+	}
+
+	if reply["protocol"] != "io.choria.mcorpc.external.v2.rpc_reply" || reply["requestid"] != "034c527089f746248822ada8a145f499" {
+		t.Fatalf("reply was not in version 2 format: %v", reply)
+	}
+
+	if reply["data"].(map[string]interface{})["message"] != "pong" {
+		t.Fatalf("unexpected reply data: %v", reply)
+	}
+
+	reply = processWithProtocol(t, a, "io.choria.mcorpc.external.v1.rpc_request", "testdata/pingrequest.json")
+	if _, ok := reply["protocol"]; ok {
+		t.Fatalf("version 1 reply should not have a protocol: %v", reply)
+	}
+
+	if seen.ProtocolVersion() != 1 || seen.Federation != nil {
+		t.Fatalf("unexpected version 1 request: %#v", seen)
+	}
+
+	reply = processWithProtocol(t, a, "io.choria.mcorpc.external.v2.rpc_request", "testdata/pingrequest.json")
+	if reply["statuscode"].(float64) != float64(Aborted) {
+		t.Fatalf("expected version 1 request with version 2 protocol to fail: %v", reply)
+	}
+}
+
+func TestProtocolV2Activation(t *testing.T) {
+	defer cleanEnv()
+
+	a := NewAgent("testing")
+	reply := processWithProtocol(t, a, "io.choria.mcorpc.external.v2.activation_request", "testdata/activationrequest_v2.json")
+
+	if reply["protocol"] != "io.choria.mcorpc.external.v2.activation_reply" || reply["activate"] != true {
+		t.Fatalf("unexpected activation reply: %v", reply)
+	}
+}
+
+func TestProtocolV1Decode(t *testing.T) {
+	rj := []byte(`{
+		"protocol": "io.choria.mcorpc.external.v1.rpc_request",
+		"agent": "helloworld",
+		"action": "ping",
+		"federation": {"req": "forged", "seen_by": ["fed1.devco.net"]},
+		"caller_certificate": {"subject": "forged"}
+	}`)
+
+	req, err := v1Protocol.decodeRequest(rj)
+	if err != nil {
+		t.Fatalf("decode failed: %s", err)
+	}
+
+	if req.Federation != nil || req.CallerCertificate != nil {
+		t.Fatalf("version 2 metadata was set from a version 1 request: %#v %#v", req.Federation, req.CallerCertificate)
+	}
+
+	_, err = v1Protocol.decodeRequest([]byte(`{"protocol": "io.choria.mcorpc.external.v2.rpc_request", "agent": "helloworld", "action": "ping"}`))
+	if err == nil {
+		t.Fatalf("request with the wrong protocol was accepted")
+	}
+}
@@ -0,0 +1,439 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// RedactedValue replaces sensitive values in logs, error messages and dumps
+	RedactedValue = "[REDACTED]"
+
+	// minRedactLength is the shortest secret masked wherever it appears within text, shorter values are only
+	// masked where they appear as whole words as masking them everywhere would make logs unreadable
+	minRedactLength = 4
+)
+
+// sensitivity lists the inputs and outputs of an action that hold secrets
+type sensitivity struct {
+	inputs  map[string]bool
+	outputs map[string]bool
+}
+
+func newSensitivity() *sensitivity {
+	return &sensitivity{inputs: make(map[string]bool), outputs: make(map[string]bool)}
+}
+
+func (s *sensitivity) merge(other *sensitivity) {
+	if other == nil {
+		return
+	}
+
+	for k := range other.inputs {
+		s.inputs[k] = true
+	}
+
+	for k := range other.outputs {
+		s.outputs[k] = true
+	}
+}
+
+// secretStore holds the sensitive values of requests being handled in this process
+type secretStore struct {
+	values map[string]int
+	mu     sync.RWMutex
+}
+
+var secrets = &secretStore{values: make(map[string]int)}
+
+// add registers values to be masked until the returned function is called
+func (s *secretStore) add(values ...string) func() {
+	var added []string
+
+	s.mu.Lock()
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+
+		s.values[v]++
+		added = append(added, v)
+	}
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		for _, v := range added {
+			s.values[v]--
+			if s.values[v] <= 0 {
+				delete(s.values, v)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// redact masks all registered values found in text
+func (s *secretStore) redact(text string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.values) == 0 {
+		return text
+	}
+
+	// longest first so a secret containing another is masked completely
+	values := make([]string, 0, len(s.values))
+	for v := range s.values {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+
+	for _, v := range values {
+		if len(v) < minRedactLength {
+			text = redactWord(text, v)
+		} else {
+			text = strings.ReplaceAll(text, v, RedactedValue)
+		}
+	}
+
+	return text
+}
+
+// redactWord masks v where it is not surrounded by letters or digits
+func redactWord(text string, v string) string {
+	var b strings.Builder
+
+	for {
+		i := strings.Index(text, v)
+		if i < 0 {
+			b.WriteString(text)
+			return b.String()
+		}
+
+		end := i + len(v)
+		before, _ := utf8.DecodeLastRuneInString(text[:i])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+
+		b.WriteString(text[:i])
+		if isWordRune(before) || isWordRune(after) {
+			b.WriteString(v)
+		} else {
+			b.WriteString(RedactedValue)
+		}
+
+		text = text[end:]
+	}
+}
+
+func isWordRune(r rune) bool {
+	return r != utf8.RuneError && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// Redact masks the sensitive values of requests being handled by this process in text, use this when
+// writing output without the logger
+func Redact(text string) string {
+	return secrets.redact(text)
+}
+
+// WithSensitiveInputs marks inputs of the action that hold secrets
+func WithSensitiveInputs(names ...string) ActionOption {
+	return func(a *action) {
+		for _, n := range names {
+			a.sensitive.inputs[n] = true
+		}
+	}
+}
+
+// WithSensitiveOutputs marks outputs of the action that hold secrets
+func WithSensitiveOutputs(names ...string) ActionOption {
+	return func(a *action) {
+		for _, n := range names {
+			a.sensitive.outputs[n] = true
+		}
+	}
+}
+
+// WithSensitiveTypes marks the inputs and outputs of the action that hold secrets using the fields of the
+// input and output structs tagged sensitive:"true", either can be nil
+func WithSensitiveTypes(input interface{}, output interface{}) ActionOption {
+	return func(a *action) {
+		for _, n := range sensitiveFields(input) {
+			a.sensitive.inputs[n] = true
+		}
+
+		for _, n := range sensitiveFields(output) {
+			a.sensitive.outputs[n] = true
+		}
+	}
+}
+
+// sensitiveFields are the JSON names of the struct fields tagged sensitive:"true"
+func sensitiveFields(v interface{}) []string {
+	if v == nil {
+		return nil
+	}
+
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Tag.Get("sensitive") != "true" {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// ddl is the part of a JSON DDL file that describes sensitive inputs and outputs
+type ddl struct {
+	Actions []struct {
+		Action string `json:"action"`
+		Input  map[string]struct {
+			Sensitive bool `json:"sensitive"`
+		} `json:"input"`
+		Output map[string]struct {
+			Sensitive bool `json:"sensitive"`
+		} `json:"output"`
+	} `json:"actions"`
+}
+
+// LoadDDL reads the JSON DDL of the agent and marks inputs and outputs that have "sensitive": true in
+// their definition as holding secrets, same as the ddl_file configuration
+func (a *Agent) LoadDDL(path string) error {
+	dj, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read DDL: %s", err)
+	}
+
+	d := &ddl{}
+	err = json.Unmarshal(dj, d)
+	if err != nil {
+		return fmt.Errorf("could not parse DDL %s: %s", path, err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, act := range d.Actions {
+		s, ok := a.ddlSensitive[act.Action]
+		if !ok {
+			s = newSensitivity()
+			a.ddlSensitive[act.Action] = s
+		}
+
+		for name, input := range act.Input {
+			if input.Sensitive {
+				s.inputs[name] = true
+			}
+		}
+
+		for name, output := range act.Output {
+			if output.Sensitive {
+				s.outputs[name] = true
+			}
+		}
+	}
+
+	return nil
+}
+
+// sensitivity combines the sensitive fields from the DDL and action options
+func (a *Agent) sensitivity(act *action) *sensitivity {
+	s := newSensitivity()
+	s.merge(act.sensitive)
+
+	a.mu.RLock()
+	s.merge(a.ddlSensitive[act.name])
+	a.mu.RUnlock()
+
+	return s
+}
+
+// protectRequest registers the sensitive inputs of the request to be masked until the returned function is called
+func (a *Agent) protectRequest(request *Request) func() {
+	act, ok := a.actions[request.Action]
+	if !ok {
+		return func() {}
+	}
+
+	request.sensitive = a.sensitivity(act)
+	release := secrets.add(sensitiveValues(request.Data, request.sensitive.inputs)...)
+
+	return func() {
+		request.mu.Lock()
+		extra := request.releases
+		request.releases = nil
+		request.mu.Unlock()
+
+		for _, r := range extra {
+			r()
+		}
+
+		release()
+	}
+}
+
+// protectReply registers the sensitive outputs of the reply and masks secrets in its status message
+func (a *Agent) protectReply(request *Request, reply *Reply) {
+	if request.sensitive != nil && len(request.sensitive.outputs) > 0 {
+		rj, err := json.Marshal(reply.Data)
+		if err == nil {
+			request.Redact(sensitiveValues(rj, request.sensitive.outputs)...)
+		}
+	}
+
+	reply.StatusMessage = secrets.redact(reply.StatusMessage)
+}
+
+// Redact registers additional secrets that should be masked in all output while the request is being handled
+func (r *Request) Redact(values ...string) {
+	release := secrets.add(values...)
+
+	r.mu.Lock()
+	r.releases = append(r.releases, release)
+	r.mu.Unlock()
+}
+
+// RedactedData is the request data with sensitive inputs masked, suitable for logging
+func (r *Request) RedactedData() json.RawMessage {
+	var inputs map[string]bool
+	if r.sensitive != nil {
+		inputs = r.sensitive.inputs
+	}
+
+	return redactData(r.Data, inputs)
+}
+
+// redactData masks the values of the sensitive top level fields of a JSON object and secrets found in any
+// other string, secrets are masked before encoding as escaping would change how they appear in the JSON
+func redactData(data []byte, fields map[string]bool) json.RawMessage {
+	var value interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	err := dec.Decode(&value)
+	if err != nil {
+		return json.RawMessage(secrets.redact(string(data)))
+	}
+
+	if obj, ok := value.(map[string]interface{}); ok {
+		for k := range obj {
+			if fields[k] {
+				obj[k] = RedactedValue
+			}
+		}
+	}
+
+	rj, err := json.Marshal(redactValue(value))
+	if err != nil {
+		return json.RawMessage(`{}`)
+	}
+
+	return json.RawMessage(rj)
+}
+
+// redactValue masks secrets in the strings, numbers and keys of decoded JSON
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return secrets.redact(v)
+
+	case json.Number:
+		if r := secrets.redact(v.String()); r != v.String() {
+			return r
+		}
+
+		return v
+
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+
+		return v
+
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			redacted[secrets.redact(k)] = redactValue(item)
+		}
+
+		return redacted
+
+	default:
+		return v
+	}
+}
+
+// sensitiveValues extracts the values of the sensitive top level fields of a JSON object, strings are returned
+// as is and other values as JSON
+func sensitiveValues(data []byte, fields map[string]bool) []string {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	obj := map[string]json.RawMessage{}
+	err := json.Unmarshal(data, &obj)
+	if err != nil {
+		return nil
+	}
+
+	var values []string
+	for k, v := range obj {
+		if !fields[k] {
+			continue
+		}
+
+		var s string
+		if json.Unmarshal(v, &s) == nil {
+			values = append(values, s)
+		} else {
+			values = append(values, string(v))
+		}
+	}
+
+	return values
+}
+
+// debugReply logs the reply with sensitive outputs masked when debug logging is enabled
+func (a *Agent) debugReply(request *Request, reply *Reply) {
+	if defaultLogger.Level() > DebugLevel {
+		return
+	}
+
+	var outputs map[string]bool
+	if request.sensitive != nil {
+		outputs = request.sensitive.outputs
+	}
+
+	data, err := json.Marshal(reply.Data)
+	if err != nil {
+		data = []byte(`null`)
+	}
+
+	request.Logger().Debug("Publishing reply", "statuscode", int(reply.StatusCode), "statusmsg", reply.StatusMessage, "data", string(redactData(data, outputs)))
+}
@@ -0,0 +1,460 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "s3cr3t-hunter2"
+
+// captureOutput runs f with STDOUT and STDERR redirected and returns everything written to them
+func captureOutput(t *testing.T, f func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("could not create pipe: %s", err)
+	}
+
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = w, w
+
+	output := make(chan string)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		output <- string(b)
+	}()
+
+	defer func() {
+		os.Stdout, os.Stderr = stdout, stderr
+	}()
+
+	f()
+	w.Close()
+
+	return <-output
+}
+
+func leakyHandler(req *Request, rep *Reply, config map[string]string) {
+	input := struct {
+		Password string `json:"password"`
+	}{}
+
+	if !req.ParseRequestData(&input, rep) {
+		return
+	}
+
+	Infof("connecting with %s", input.Password)
+	Debugf("debugging %s", input.Password)
+	Warnf("retrying with %s", input.Password)
+	Errorf("failed with %s", input.Password)
+	req.Logger().Info("login", "password", input.Password)
+	fmt.Println(Redact("printed " + input.Password))
+
+	span := req.StartSpan("login")
+	span.SetAttribute("password", input.Password)
+	span.SetError(fmt.Errorf("denied for %s", input.Password))
+	span.End()
+
+	res, err := req.RunCommand(context.Background(), Command{
+		Path:        "/bin/sh",
+		Args:        []string{"-c", `echo "bad password $PASSWORD" >&2; exit 2`},
+		Env:         map[string]string{"PASSWORD": input.Password},
+		AllowUnsafe: true,
+	})
+	rep.AbortIfCommandFailed(res, err)
+}
+
+func TestRedactOutput(t *testing.T) {
+	defer cleanEnv()
+
+	defaultLogger.SetLevel(DebugLevel)
+	defer defaultLogger.SetLevel(InfoLevel)
+
+	tracePath := filepath.Join(tempDir(t), "trace.json")
+
+	a := NewAgent("helloworld")
+	a.SetTraceFile(tracePath)
+	a.MustRegisterAction("login", leakyHandler, WithSensitiveInputs("password"))
+	a.MustRegisterAction("crash", func(req *Request, rep *Reply, config map[string]string) {
+		panic("crashed with " + testSecret)
+	}, WithSensitiveInputs("password"))
+
+	var replies []*Reply
+	output := captureOutput(t, func() {
+		replies = append(replies, processRPC(t, a, requestFile(t, "login", map[string]string{"password": testSecret})))
+		replies = append(replies, processRPC(t, a, requestFile(t, "crash", map[string]string{"password": testSecret})))
+	})
+
+	if strings.Contains(output, testSecret) {
+		t.Fatalf("secret leaked to output:\n%s", output)
+	}
+
+	for _, expected := range []string{"connecting with [REDACTED]", "debugging [REDACTED]", "password=[REDACTED]", "printed [REDACTED]", `data="{\"password\":\"[REDACTED]\"}"`, "Action panicked"} {
+		if !strings.Contains(output, expected) {
+			t.Fatalf("expected %q in output:\n%s", expected, output)
+		}
+	}
+
+	if replies[0].StatusCode != Aborted || replies[0].StatusMessage != "/bin/sh exited with code 2: bad password [REDACTED]" {
+		t.Fatalf("unexpected reply: %#v", replies[0])
+	}
+
+	if replies[1].StatusCode != UnknownError || strings.Contains(replies[1].StatusMessage, testSecret) {
+		t.Fatalf("unexpected reply: %#v", replies[1])
+	}
+
+	trace, err := ioutil.ReadFile(tracePath)
+	if err != nil {
+		t.Fatalf("could not read trace: %s", err)
+	}
+
+	if strings.Contains(string(trace), testSecret) || !strings.Contains(string(trace), "denied for [REDACTED]") {
+		t.Fatalf("secret leaked to trace:\n%s", trace)
+	}
+
+	// secrets are only masked while their request is being handled
+	if Redact(testSecret) != testSecret {
+		t.Fatalf("secret was not released after the request")
+	}
+}
+
+func TestRedactEscapedSecrets(t *testing.T) {
+	defer cleanEnv()
+
+	defaultLogger.SetLevel(DebugLevel)
+	defer defaultLogger.SetLevel(InfoLevel)
+
+	a := NewAgent("helloworld")
+	a.MustRegisterAction("login", func(req *Request, rep *Reply, config map[string]string) {
+		input := struct {
+			Password string `json:"password"`
+		}{}
+
+		if !req.ParseRequestData(&input, rep) {
+			return
+		}
+
+		Infof("connecting with %s", input.Password)
+		req.Logger().Info("login", "password", input.Password)
+		req.Logger().Info("echo", "data", string(req.RedactedData()))
+		rep.Data = map[string]string{"echo": "using " + input.Password}
+	}, WithSensitiveInputs("password"))
+
+	for _, secret := range []string{`pa"ss"word`, `back\slash\pass`, "line1\nline2", "tab\tbed\x01pass"} {
+		var reply *Reply
+		output := captureOutput(t, func() {
+			reply = processRPC(t, a, requestFile(t, "login", map[string]string{"password": secret, "note": "about " + secret}))
+		})
+
+		if reply.StatusCode != OK {
+			t.Fatalf("%q: unexpected reply: %#v", secret, reply)
+		}
+
+		quoted := strconv.Quote(secret)
+		encoded, _ := json.Marshal(secret)
+		forms := []string{secret, quoted[1 : len(quoted)-1], string(encoded[1 : len(encoded)-1])}
+		twice := strconv.Quote(string(encoded))
+		forms = append(forms, twice[3:len(twice)-3])
+
+		for _, form := range forms {
+			if strings.Contains(output, form) {
+				t.Fatalf("%q: secret leaked as %q to output:\n%s", secret, form, output)
+			}
+		}
+
+		for _, expected := range []string{"connecting with [REDACTED]", `password=[REDACTED]`, `about [REDACTED]`, `using [REDACTED]`} {
+			if !strings.Contains(output, expected) {
+				t.Fatalf("%q: expected %q in output:\n%s", secret, expected, output)
+			}
+		}
+	}
+}
+
+func TestRedactOutputs(t *testing.T) {
+	defer cleanEnv()
+
+	defaultLogger.SetLevel(DebugLevel)
+	defer defaultLogger.SetLevel(InfoLevel)
+
+	type output struct {
+		Token string `json:"token" sensitive:"true"`
+		User  string `json:"user"`
+	}
+
+	a := NewAgent("helloworld")
+	a.MustRegisterAction("token", func(req *Request, rep *Reply, config map[string]string) {
+		rep.Data = output{Token: testSecret, User: "rip"}
+	}, WithSensitiveTypes(nil, output{}))
+
+	var reply *Reply
+	out := captureOutput(t, func() {
+		reply = processRPC(t, a, requestFile(t, "token", map[string]string{}))
+	})
+
+	if strings.Contains(out, testSecret) || !strings.Contains(out, `{\"token\":\"[REDACTED]\",\"user\":\"rip\"}`) {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	// the caller receives the real value
+	if reply.Data.(map[string]interface{})["token"] != testSecret {
+		t.Fatalf("sensitive output was removed from the reply: %#v", reply.Data)
+	}
+}
+
+func TestLoadDDL(t *testing.T) {
+	defer cleanEnv()
+
+	ddl := map[string]interface{}{
+		"actions": []interface{}{
+			map[string]interface{}{
+				"action": "login",
+				"input": map[string]interface{}{
+					"user":     map[string]interface{}{"type": "string"},
+					"password": map[string]interface{}{"type": "string", "sensitive": true},
+				},
+				"output": map[string]interface{}{
+					"token": map[string]interface{}{"type": "string", "sensitive": true},
+				},
+			},
+		},
+	}
+
+	dj, err := json.Marshal(ddl)
+	if err != nil {
+		t.Fatalf("could not encode DDL: %s", err)
+	}
+
+	dir := tempDir(t)
+	err = ioutil.WriteFile(filepath.Join(dir, "helloworld.json"), dj, 0600)
+	if err != nil {
+		t.Fatalf("could not write DDL: %s", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "plugin.conf"), []byte("ddl_file = "+filepath.Join(dir, "helloworld.json")+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("could not write config: %s", err)
+	}
+	os.Setenv("CHORIA_EXTERNAL_CONFIG", filepath.Join(dir, "plugin.conf"))
+
+	a := NewAgent("helloworld")
+	a.MustRegisterAction("login", func(req *Request, rep *Reply, config map[string]string) {
+		rep.Data = map[string]string{"data": string(req.RedactedData())}
+	})
+
+	s := a.sensitivity(a.actions["login"])
+	if !s.inputs["password"] || s.inputs["user"] || !s.outputs["token"] {
+		t.Fatalf("unexpected sensitivity: %#v", s)
+	}
+
+	reply := processRPC(t, a, requestFile(t, "login", map[string]string{"user": "rip", "password": testSecret}))
+	if reply.Data.(map[string]interface{})["data"] != `{"password":"[REDACTED]","user":"rip"}` {
+		t.Fatalf("unexpected redacted data: %#v", reply.Data)
+	}
+}
+
+func TestSecretStore(t *testing.T) {
+	store := &secretStore{values: make(map[string]int)}
+
+	release := store.add("secret", "secret-longer", "abc")
+	if store.redact("secret-longer and secret and abc") != "[REDACTED] and [REDACTED] and [REDACTED]" {
+		t.Fatalf("unexpected redaction: %s", store.redact("secret-longer and secret and abc"))
+	}
+
+	// short values are only masked as whole words
+	if store.redact("pin=abc abcd xabc abc.") != "pin=[REDACTED] abcd xabc [REDACTED]." {
+		t.Fatalf("unexpected redaction: %s", store.redact("pin=abc abcd xabc abc."))
+	}
+
+	second := store.add("secret")
+	release()
+	if store.redact("secret") != "[REDACTED]" {
+		t.Fatalf("secret registered twice was released early")
+	}
+
+	second()
+	if store.redact("secret") != "secret" {
+		t.Fatalf("secret was not released")
+	}
+}
+
+func TestRedactWorker(t *testing.T) {
+	a := NewAgent("helloworld")
+	a.MustRegisterAction("login", leakyHandler, WithSensitiveInputs("password"))
+
+	rj, err := ioutil.ReadFile(requestFile(t, "login", map[string]string{"password": testSecret}))
+	if err != nil {
+		t.Fatalf("could not read request: %s", err)
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	reply := &workerReply{}
+	output := captureOutput(t, func() {
+		go a.handleWorkerConnection(server)
+
+		err = json.NewEncoder(client).Encode(workerRequest{Protocol: v1Protocol.rpcRequest, Request: rj})
+		if err == nil {
+			err = json.NewDecoder(client).Decode(reply)
+		}
+	})
+	if err != nil {
+		t.Fatalf("worker request failed: %s", err)
+	}
+
+	if strings.Contains(output, testSecret) || !strings.Contains(output, "connecting with [REDACTED]") {
+		t.Fatalf("secret leaked to output:\n%s", output)
+	}
+
+	if reply.Reply == nil || reply.Reply.StatusMessage != "/bin/sh exited with code 2: bad password [REDACTED]" {
+		t.Fatalf("unexpected reply: %#v", reply.Reply)
+	}
+}
+
+func TestRedactJob(t *testing.T) {
+	a := NewAgent("helloworld")
+	a.SetJobsDirectory(tempDir(t))
+	a.MustRegisterJobAction("login", leakyHandler, WithSensitiveInputs("password"))
+
+	id := "9f8e7d6c5b4a49382716a5b4c3d2e1f0"
+	dir, _ := a.jobDirectory(id)
+
+	err := writeFileAtomic(filepath.Join(dir, "request.json"), spooledRequest{Request: &Request{Agent: "helloworld", Action: "login", RequestID: id, Data: json.RawMessage(`{"password":"` + testSecret + `"}`)}})
+	if err != nil {
+		t.Fatalf("could not spool request: %s", err)
+	}
+
+	err = writeFileAtomic(filepath.Join(dir, "state.json"), &Job{ID: id, Agent: "helloworld", Action: "login", State: JobPending})
+	if err != nil {
+		t.Fatalf("could not spool state: %s", err)
+	}
+
+	output := captureOutput(t, func() { a.processJob(dir) })
+	if strings.Contains(output, testSecret) {
+		t.Fatalf("secret leaked to output:\n%s", output)
+	}
+
+	state, err := ioutil.ReadFile(filepath.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatalf("could not read state: %s", err)
+	}
+
+	if strings.Contains(string(state), testSecret) || !strings.Contains(string(state), "bad password [REDACTED]") {
+		t.Fatalf("secret leaked to job state:\n%s", state)
+	}
+
+	// the job needs its request so it is kept only readable by the agent user
+	for _, f := range []string{"request.json", "state.json"} {
+		assertPrivateFile(t, filepath.Join(dir, f))
+	}
+}
+
+func TestRedactIdempotencyRecord(t *testing.T) {
+	defer cleanEnv()
+
+	dir := tempDir(t)
+
+	a := NewAgent("helloworld")
+	a.SetIdempotencyStore(dir, time.Hour)
+	a.MustRegisterAction("ping", func(req *Request, rep *Reply, config map[string]string) {
+		req.Redact(testSecret)
+		rep.Abort("denied for %s", testSecret)
+	}, WithIdempotency())
+
+	processRPC(t, a, "testdata/pingrequest.json")
+
+	record := filepath.Join(dir, "034c527089f746248822ada8a145f499.json")
+	rj, err := ioutil.ReadFile(record)
+	if err != nil {
+		t.Fatalf("request was not recorded: %s", err)
+	}
+
+	if strings.Contains(string(rj), testSecret) || !strings.Contains(string(rj), "denied for [REDACTED]") {
+		t.Fatalf("secret leaked to the record:\n%s", rj)
+	}
+
+	assertPrivateFile(t, record)
+}
+
+func TestRedactIdempotencyReplay(t *testing.T) {
+	defer cleanEnv()
+
+	dir := tempDir(t)
+
+	a := NewAgent("helloworld")
+	a.SetIdempotencyStore(dir, time.Hour)
+	a.MustRegisterAction("ping", func(req *Request, rep *Reply, config map[string]string) {
+		rep.Data = map[string]string{"token": testSecret}
+		rep.StatusMessage = "issued " + testSecret
+	}, WithIdempotency(), WithSensitiveOutputs("token"))
+
+	first := processRPC(t, a, "testdata/pingrequest.json")
+	replay := processRPC(t, a, "testdata/pingrequest.json")
+
+	if first.StatusMessage != "issued [REDACTED]" {
+		t.Fatalf("unexpected reply: %#v", first)
+	}
+
+	if !reflect.DeepEqual(first, replay) {
+		t.Fatalf("replayed reply differs from the original:\n%#v\n%#v", first, replay)
+	}
+
+	record, err := a.loadCompletedRequest(filepath.Join(dir, "034c527089f746248822ada8a145f499.json"))
+	if err != nil {
+		t.Fatalf("could not load record: %s", err)
+	}
+
+	if record.Reply.StatusMessage != first.StatusMessage {
+		t.Fatalf("recorded reply differs from the published reply: %q", record.Reply.StatusMessage)
+	}
+}
+
+func TestRedactSpilledReply(t *testing.T) {
+	defer cleanEnv()
+
+	dir := filepath.Join(tempDir(t), "spill")
+
+	a := NewAgent("helloworld")
+	a.SetReplyLimit(250, OverflowSpill)
+	a.SetReplySpillDirectory(dir)
+	a.MustRegisterAction("ping", func(req *Request, rep *Reply, config map[string]string) {
+		rep.Data = map[string]string{"token": testSecret, "padding": strings.Repeat("x", 400)}
+	}, WithSensitiveOutputs("token"))
+
+	reply := processRPC(t, a, "testdata/pingrequest.json")
+	if reply.StatusCode != OK {
+		t.Fatalf("request failed: %s", reply.StatusMessage)
+	}
+
+	// spilled replies hold sensitive outputs for the caller so only the agent user can read them
+	assertPrivateFile(t, reply.Data.(map[string]interface{})["reply_file"].(string))
+
+	stat, err := os.Stat(dir)
+	if err != nil || stat.Mode().Perm() != 0700 {
+		t.Fatalf("spill directory is not private: %v", err)
+	}
+}
+
+func assertPrivateFile(t *testing.T, path string) {
+	t.Helper()
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat failed: %s", err)
+	}
+
+	if stat.Mode().Perm() != 0600 {
+		t.Fatalf("%s has mode %v", path, stat.Mode().Perm())
+	}
+}
@@ -58,3 +58,11 @@ func (r *Reply) AbortIfErr(err error, format string, a ...interface{}) bool {
 
 	return true
 }
+
+func abortReply(format string, a ...interface{}) *Reply {
+	return &Reply{
+		StatusCode:    Aborted,
+		StatusMessage: fmt.Sprintf(format, a...),
+		Data:          make(map[string]interface{}),
+	}
+}
@@ -0,0 +1,291 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ReplyOverflow is what happens to replies larger than the maximum reply size
+type ReplyOverflow string
+
+const (
+	// OverflowTruncate shortens the outputs marked using WithTruncatableOutputs, replies that cannot be
+	// truncated enough are aborted
+	OverflowTruncate = ReplyOverflow("truncate")
+
+	// OverflowAbort replaces the reply with an Aborted reply explaining the overflow
+	OverflowAbort = ReplyOverflow("abort")
+
+	// OverflowSpill writes the reply data to a local file and replies with its path
+	OverflowSpill = ReplyOverflow("spill")
+
+	// DefaultReplySpillRetention is how long spilled replies are kept when reply_spill_retention is not configured
+	DefaultReplySpillRetention = 24 * time.Hour
+)
+
+// WithTruncatableOutputs marks outputs of the action that can be shortened when the reply is too large,
+// the largest are truncated first and a marker noting the amount removed is added
+func WithTruncatableOutputs(names ...string) ActionOption {
+	return func(a *action) {
+		a.truncatable = append(a.truncatable, names...)
+	}
+}
+
+// SetReplyLimit sets the maximum size in bytes of the encoded JSON reply and what to do with replies that
+// exceed it, same as the max_reply_size and reply_overflow configuration, a size of 0 disables the limit
+func (a *Agent) SetReplyLimit(size int, overflow ReplyOverflow) {
+	a.maxReplyBytes = size
+	a.replyLimitSet = true
+	a.overflow = overflow
+}
+
+// SetReplySpillDirectory sets where replies are written by OverflowSpill, same as the reply_spill_directory configuration
+func (a *Agent) SetReplySpillDirectory(dir string) {
+	a.spillDir = dir
+}
+
+func (a *Agent) maxReplySize() int {
+	if a.replyLimitSet {
+		return a.maxReplyBytes
+	}
+
+	size, err := strconv.Atoi(a.configItem("max_reply_size"))
+	if err != nil || size < 0 {
+		return 0
+	}
+
+	return size
+}
+
+func (a *Agent) replyOverflow() ReplyOverflow {
+	if a.overflow != "" {
+		return a.overflow
+	}
+
+	switch overflow := ReplyOverflow(a.configItem("reply_overflow")); overflow {
+	case OverflowAbort, OverflowSpill:
+		return overflow
+	default:
+		return OverflowTruncate
+	}
+}
+
+func (a *Agent) replySpillDirectory() string {
+	if a.spillDir != "" {
+		return a.spillDir
+	}
+
+	if a.configItem("reply_spill_directory") != "" {
+		return a.configItem("reply_spill_directory")
+	}
+
+	return filepath.Join(privateTempDir("replies"), a.Name)
+}
+
+func (a *Agent) replySpillRetention() time.Duration {
+	retention, err := time.ParseDuration(a.configItem("reply_spill_retention"))
+	if err != nil || retention <= 0 {
+		return DefaultReplySpillRetention
+	}
+
+	return retention
+}
+
+// limitReply enforces the maximum reply size, encode produces the document that will be published for a reply
+func (a *Agent) limitReply(request *Request, reply *Reply, encode func(*Reply) interface{}) *Reply {
+	limit := a.maxReplySize()
+	if limit <= 0 {
+		return reply
+	}
+
+	size, err := encodedSize(encode(reply))
+	if err != nil || size <= limit {
+		return reply
+	}
+
+	var limited *Reply
+
+	switch a.replyOverflow() {
+	case OverflowTruncate:
+		var fields []string
+		if act, ok := a.actions[request.Action]; ok {
+			fields = act.truncatable
+		}
+
+		limited = truncateReply(reply, fields, limit, encode)
+
+	case OverflowSpill:
+		limited, err = a.spillReply(request, reply, size)
+		if err != nil {
+			request.Logger().Error("Could not spill reply", "error", err)
+			limited = nil
+		}
+	}
+
+	if limited != nil {
+		size, err := encodedSize(encode(limited))
+		if err == nil && size <= limit {
+			return limited
+		}
+	}
+
+	return abortReply("reply of %d bytes exceeds the maximum reply size of %d bytes", size, limit)
+}
+
+func encodedSize(rep interface{}) (int, error) {
+	j, err := json.Marshal(rep)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(j), nil
+}
+
+// truncateReply shortens the largest truncatable fields of the reply data until the reply fits, nil when it cannot fit
+func truncateReply(reply *Reply, fields []string, limit int, encode func(*Reply) interface{}) *Reply {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	dj, err := json.Marshal(reply.Data)
+	if err != nil {
+		return nil
+	}
+
+	data := map[string]json.RawMessage{}
+	err = json.Unmarshal(dj, &data)
+	if err != nil {
+		return nil
+	}
+
+	truncated := &Reply{StatusCode: reply.StatusCode, StatusMessage: reply.StatusMessage, Data: data}
+	exhausted := make(map[string]bool)
+
+	// fields are truncated from their original value so the marker reports everything removed
+	original := make(map[string]json.RawMessage)
+	kept := make(map[string]int)
+
+	for {
+		size, err := encodedSize(encode(truncated))
+		if err != nil {
+			return nil
+		}
+
+		if size <= limit {
+			return truncated
+		}
+
+		candidates := []string{}
+		for _, f := range fields {
+			if _, ok := data[f]; ok && !exhausted[f] {
+				candidates = append(candidates, f)
+			}
+		}
+
+		if len(candidates) == 0 {
+			return nil
+		}
+
+		sort.SliceStable(candidates, func(i, j int) bool { return len(data[candidates[i]]) > len(data[candidates[j]]) })
+
+		field := candidates[0]
+		if _, ok := original[field]; !ok {
+			original[field] = data[field]
+			kept[field] = -1
+		}
+
+		var complete bool
+		data[field], kept[field], complete = truncateValue(original[field], kept[field], size-limit)
+		if complete {
+			exhausted[field] = true
+		}
+	}
+}
+
+// truncateValue shortens a JSON value that had keep bytes of its string kept by at least over encoded bytes where
+// possible, keep is negative for values not yet truncated. Strings keep their start and get a marker noting how many
+// bytes of the original were removed while other values are replaced by a marker, complete is true when nothing
+// more can be removed
+func truncateValue(value json.RawMessage, keep int, over int) (result json.RawMessage, kept int, complete bool) {
+	var s string
+	if json.Unmarshal(value, &s) != nil {
+		marker, _ := json.Marshal(fmt.Sprintf("[truncated %d bytes]", len(value)))
+		return marker, 0, true
+	}
+
+	if keep < 0 || keep > len(s) {
+		keep = len(s)
+	}
+
+	// escaping makes the encoded string longer than the string, remove a proportional amount
+	keep -= (over+64)*len(s)/len(value) + 1
+	if keep < 0 {
+		keep = 0
+	}
+
+	for keep > 0 && !utf8.RuneStart(s[keep]) {
+		keep--
+	}
+
+	marker, _ := json.Marshal(fmt.Sprintf("%s... [truncated %d bytes]", s[:keep], len(s)-keep))
+
+	return marker, keep, keep == 0
+}
+
+// spillReply writes the reply data to a file and returns a reply pointing to it
+func (a *Agent) spillReply(request *Request, reply *Reply, size int) (*Reply, error) {
+	// spilled replies hold sensitive outputs
+	dir := a.replySpillDirectory()
+	err := ensurePrivateDirectory(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	a.expireSpilledReplies(dir)
+
+	id := request.RequestID
+	if !validRequestID.MatchString(id) {
+		jid, err := newJobID()
+		if err != nil {
+			return nil, err
+		}
+		id = jid
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.json", id, request.Action))
+	err = writeFileAtomic(path, reply.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reply{
+		StatusCode:    reply.StatusCode,
+		StatusMessage: reply.StatusMessage,
+		Data:          map[string]interface{}{"reply_file": path, "reply_size": size},
+	}, nil
+}
+
+func (a *Agent) expireSpilledReplies(dir string) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	retention := a.replySpillRetention()
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") || time.Since(entry.ModTime()) < retention {
+			continue
+		}
+
+		os.Remove(filepath.Join(dir, entry.Name()))
+	}
+}
@@ -0,0 +1,174 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func replySize(t *testing.T) int {
+	t.Helper()
+
+	stat, err := os.Stat(os.Getenv("CHORIA_EXTERNAL_REPLY"))
+	if err != nil {
+		t.Fatalf("could not stat reply: %s", err)
+	}
+
+	return int(stat.Size())
+}
+
+func largeReplyAgent(output string, opts ...ActionOption) *Agent {
+	a := NewAgent("helloworld")
+	a.MustRegisterAction("cat", func(req *Request, rep *Reply, config map[string]string) {
+		rep.Data = map[string]string{"output": output, "file": "/etc/motd"}
+	}, opts...)
+
+	return a
+}
+
+func TestReplyLimitTruncate(t *testing.T) {
+	defer cleanEnv()
+
+	for _, output := range []string{strings.Repeat("a", 10000), strings.Repeat("<é>", 5000)} {
+		a := largeReplyAgent(output, WithTruncatableOutputs("output"))
+		a.SetReplyLimit(2000, OverflowTruncate)
+
+		reply := processRPC(t, a, requestFile(t, "cat", map[string]string{}))
+		if reply.StatusCode != OK {
+			t.Fatalf("truncated reply failed: %#v", reply)
+		}
+
+		if size := replySize(t); size > 2000 || size < 1500 {
+			t.Fatalf("reply of %d bytes was not truncated to fit the limit", size)
+		}
+
+		data := reply.Data.(map[string]interface{})
+		if data["file"] != "/etc/motd" || !strings.HasPrefix(output, strings.Split(data["output"].(string), "...")[0]) {
+			t.Fatalf("unexpected reply data: %#v", data)
+		}
+
+		marker := truncationMarker.FindStringSubmatch(data["output"].(string))
+		if marker == nil {
+			t.Fatalf("no truncation marker in %q", data["output"])
+		}
+
+		// truncation takes several rounds, the marker counts what was removed from the original
+		removed, _ := strconv.Atoi(marker[2])
+		if len(marker[1])+removed != len(output) {
+			t.Fatalf("marker reports %d bytes removed, kept %d of %d bytes", removed, len(marker[1]), len(output))
+		}
+	}
+}
+
+var truncationMarker = regexp.MustCompile(`^(?s)(.*)\.\.\. \[truncated (\d+) bytes\]$`)
+
+func TestReplyLimitAbort(t *testing.T) {
+	defer cleanEnv()
+
+	// without truncatable outputs the truncate policy aborts
+	a := largeReplyAgent(strings.Repeat("a", 10000))
+	a.SetReplyLimit(2000, OverflowTruncate)
+
+	reply := processRPC(t, a, requestFile(t, "cat", map[string]string{}))
+	if reply.StatusCode != Aborted || !strings.HasPrefix(reply.StatusMessage, "reply of 10") || !strings.HasSuffix(reply.StatusMessage, "exceeds the maximum reply size of 2000 bytes") {
+		t.Fatalf("unexpected reply: %#v", reply)
+	}
+
+	a = largeReplyAgent(strings.Repeat("a", 10000), WithTruncatableOutputs("output"))
+	a.SetReplyLimit(2000, OverflowAbort)
+	reply = processRPC(t, a, requestFile(t, "cat", map[string]string{}))
+	if reply.StatusCode != Aborted {
+		t.Fatalf("unexpected reply: %#v", reply)
+	}
+
+	// small replies are untouched
+	a = largeReplyAgent("small")
+	a.SetReplyLimit(2000, OverflowAbort)
+	reply = processRPC(t, a, requestFile(t, "cat", map[string]string{}))
+	if reply.StatusCode != OK || reply.Data.(map[string]interface{})["output"] != "small" {
+		t.Fatalf("unexpected reply: %#v", reply)
+	}
+}
+
+func TestReplyLimitSpill(t *testing.T) {
+	defer cleanEnv()
+
+	dir := tempDir(t)
+	output := strings.Repeat("a", 10000)
+
+	config := filepath.Join(dir, "plugin.conf")
+	err := ioutil.WriteFile(config, []byte("max_reply_size = 2000\nreply_overflow = spill\nreply_spill_directory = "+dir+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("could not write config: %s", err)
+	}
+	os.Setenv("CHORIA_EXTERNAL_CONFIG", config)
+
+	a := largeReplyAgent(output)
+	reply := processRPC(t, a, requestFile(t, "cat", map[string]string{}))
+	if reply.StatusCode != OK {
+		t.Fatalf("spilled reply failed: %#v", reply)
+	}
+
+	data := reply.Data.(map[string]interface{})
+	if data["reply_file"] != filepath.Join(dir, "ea0bd4ee3e9b4e8c9aa7c3c7c8e17e3d-cat.json") || data["reply_size"].(float64) < 10000 {
+		t.Fatalf("unexpected spill reply: %#v", data)
+	}
+
+	sj, err := ioutil.ReadFile(data["reply_file"].(string))
+	if err != nil {
+		t.Fatalf("could not read spilled reply: %s", err)
+	}
+
+	spilled := map[string]string{}
+	err = json.Unmarshal(sj, &spilled)
+	if err != nil {
+		t.Fatalf("invalid spilled reply: %s", err)
+	}
+
+	if spilled["output"] != output {
+		t.Fatalf("spilled reply is incomplete")
+	}
+}
+
+func TestReplyLimitDisabled(t *testing.T) {
+	defer cleanEnv()
+
+	dir := tempDir(t)
+	config := filepath.Join(dir, "plugin.conf")
+	err := ioutil.WriteFile(config, []byte("max_reply_size = 2000\nreply_overflow = abort\n"), 0600)
+	if err != nil {
+		t.Fatalf("could not write config: %s", err)
+	}
+	os.Setenv("CHORIA_EXTERNAL_CONFIG", config)
+
+	metrics := filepath.Join(dir, "helloworld.prom")
+
+	a := largeReplyAgent(strings.Repeat("a", 10000))
+	a.SetMetricsFile(metrics)
+
+	// metrics record the status of the reply that was published
+	reply := processRPC(t, a, requestFile(t, "cat", map[string]string{}))
+	if reply.StatusCode != Aborted {
+		t.Fatalf("expected the configured limit to apply: %#v", reply.StatusMessage)
+	}
+
+	mf, err := ioutil.ReadFile(metrics)
+	if err != nil {
+		t.Fatalf("could not read metrics: %s", err)
+	}
+
+	if !strings.Contains(string(mf), `choria_external_agent_requests_total{action="cat",agent="helloworld",statuscode="1"} 1`) {
+		t.Fatalf("metrics did not record the aborted reply:\n%s", mf)
+	}
+
+	a.SetReplyLimit(0, OverflowAbort)
+	reply = processRPC(t, a, requestFile(t, "cat", map[string]string{}))
+	if reply.StatusCode != OK {
+		t.Fatalf("expected SetReplyLimit(0) to disable the configured limit: %s", reply.StatusMessage)
+	}
+}
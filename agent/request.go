@@ -1,7 +1,11 @@
 package agent
 
 import (
+	"context"
 	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"time"
 )
 
 // Request is the request being published to the shim runner
@@ -17,6 +21,21 @@ type Request struct {
 	TTL        int             `json:"ttl"`
 	Time       int64           `json:"msgtime"`
 	Data       json.RawMessage `json:"data"`
+
+	// Federation is set for requests that passed through a Choria Federation, only available in protocol version 2
+	Federation *Federation `json:"-"`
+
+	// CallerCertificate describes the certificate of the caller, only available in protocol version 2
+	CallerCertificate *CallerCertificate `json:"-"`
+
+	factsPath string
+	protocol  *protocol
+	deadline  time.Time
+	ctx       context.Context
+	span      *Span
+	sensitive *sensitivity
+	releases  []func()
+	mu        sync.Mutex
 }
 
 // ParseRequestData parses the RPC request JSON into target, sets reply to an appropriate failure code on error
@@ -29,3 +48,74 @@ func (r *Request) ParseRequestData(target interface{}, reply *Reply) bool {
 
 	return true
 }
+
+// ttlDuration is the validity period of the request, defaults to one minute when no TTL is set
+func (r *Request) ttlDuration() time.Duration {
+	if r.TTL <= 0 {
+		return time.Minute
+	}
+
+	return time.Duration(r.TTL) * time.Second
+}
+
+// Deadline is the time after which the request is no longer valid, based on the message time and TTL. Actions
+// running as background jobs have their own deadline set by jobs_timeout
+func (r *Request) Deadline() time.Time {
+	if !r.deadline.IsZero() {
+		return r.deadline
+	}
+
+	if r.Time <= 0 {
+		return time.Now().Add(r.ttlDuration())
+	}
+
+	return time.Unix(r.Time, 0).Add(r.ttlDuration())
+}
+
+// Context is cancelled when the request is abandoned, for example when a worker stops waiting for an action that
+// exceeded the request TTL. Long running actions should stop once it is done
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+
+	return r.ctx
+}
+
+// FactsPath returns the path to the node facts for this request, empty string when not provided
+func (r *Request) FactsPath() string {
+	return r.factsPath
+}
+
+// Facts returns the server facts provided with this request, empty JSON hash when not provided. Unlike the
+// package level Facts() this is safe to use in actions handled by a persistent worker
+func (r *Request) Facts() (json.RawMessage, error) {
+	span := r.StartSpan("facts")
+	defer span.End()
+
+	if r.factsPath == "" {
+		return []byte(`{}`), nil
+	}
+
+	fj, err := ioutil.ReadFile(r.factsPath)
+	if err != nil {
+		span.SetError(err)
+		return []byte(`{}`), err
+	}
+
+	return fj, nil
+}
+
+// Logger is a logger that includes the request id, agent and action in every message
+func (r *Request) Logger() *Logger {
+	return defaultLogger.With("requestid", r.RequestID, "agent", r.Agent, "action", r.Action)
+}
+
+// ProtocolVersion is the version of the external protocol the request was received in
+func (r *Request) ProtocolVersion() int {
+	if r.protocol == nil {
+		return v1Protocol.version
+	}
+
+	return r.protocol.version
+}
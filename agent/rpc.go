@@ -1,10 +1,12 @@
 package agent
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"time"
+
+	"github.com/choria-io/go-external/schemas"
 )
 
 const (
@@ -17,12 +19,22 @@ type ActionHandler func(req *Request, rep *Reply, config map[string]string)
 
 type rpc struct {
 	externalAgent
-	actions map[string]ActionHandler
-	config  map[string]string
+	agent     *Agent
+	actions   map[string]*action
+	config    map[string]string
+	factsPath string
+	protocol  *protocol
 }
 
-func newRPC(actions map[string]ActionHandler, config map[string]string) (*rpc, error) {
-	return &rpc{actions: actions, config: config}, nil
+func newRPC(agent *Agent) (*rpc, error) {
+	return &rpc{
+		externalAgent: externalAgent{transport: agent.transport, validation: agent.schemaValidation()},
+		agent:         agent,
+		actions:       agent.actions,
+		config:        agent.currentConfig(),
+		factsPath:     FactsPath(),
+		protocol:      v1Protocol,
+	}, nil
 }
 
 func (r *rpc) panicIfError(err error, format string, a ...interface{}) {
@@ -33,13 +45,7 @@ func (r *rpc) panicIfError(err error, format string, a ...interface{}) {
 }
 
 func (r *rpc) fail(format string, a ...interface{}) bool {
-	reply := &Reply{
-		StatusCode:    Aborted,
-		StatusMessage: fmt.Sprintf(format, a...),
-		Data:          make(map[string]interface{}),
-	}
-
-	err := r.publishReply(reply)
+	err := r.publishReply(r.protocol.encodeReply(nil, abortReply(format, a...)))
 	r.panicIfError(err, "could not write reply: %s", err)
 
 	return true
@@ -59,35 +65,170 @@ func (r *rpc) hasAction(action string) bool {
 }
 
 func (r *rpc) handleRequest() error {
-	request := &Request{}
-	reply := &Reply{}
+	readStart := time.Now()
+	jreq, err := r.readRequest()
+	if r.failIfError(err, "could not read request: %s", err) {
+		return nil
+	}
 
-	jreq, err := ioutil.ReadFile(os.Getenv("CHORIA_EXTERNAL_REQUEST"))
-	if r.failIfError(err, "could not read request from CHORIA_EXTERNAL_REQUEST file") {
+	validateStart := time.Now()
+	verr := r.validateDocument(r.protocol.rpcRequestSchema, jreq)
+	if r.failIfError(verr, "invalid request: %s", verr) {
 		return nil
 	}
 
-	if r.failIfError(json.Unmarshal(jreq, request), "could not parse request") {
+	decodeStart := time.Now()
+	request, err := r.protocol.decodeRequest(jreq)
+	if r.failIfError(err, "could not parse request") {
 		return nil
 	}
 
+	start := time.Now()
+
+	traceStart := readStart
+	if !r.agent.configStarted.IsZero() {
+		traceStart = r.agent.configStarted
+	}
+
+	root := r.agent.startTrace(fmt.Sprintf("%s#%s", request.Agent, request.Action), request.RequestID, "", traceStart)
+	root.record("config", r.agent.configStarted, r.agent.configParsed, nil)
+	root.record("read_request", readStart, validateStart, nil)
+	if r.validation != "" && r.validation != schemas.Off {
+		root.record("validate_request", validateStart, decodeStart, verr)
+	}
+	root.record("decode_request", decodeStart, start, nil)
+	setRequestAttributes(root, request)
+	request.span = root
+
+	release := r.agent.protectRequest(request)
+	defer release()
+
+	request.Logger().Debug("Handling request", "data", string(request.RedactedData()))
+
+	var reply *Reply
+	if r.agent.workerEnabled() {
+		span := root.StartSpan("worker")
+		reply = r.agent.dispatchToWorker(jreq, r.protocol, r.factsPath, span)
+		span.SetAttribute("choria.worker.handled", reply != nil)
+		span.End()
+	}
+
+	if reply == nil {
+		reply = r.processRequest(request)
+	}
+
+	r.agent.protectReply(request, reply)
+	r.agent.debugReply(request, reply)
+
+	reply = r.agent.limitReply(request, reply, func(rep *Reply) interface{} {
+		return r.protocol.encodeReply(request, rep)
+	})
+
+	action := "unknown"
+	if r.hasAction(request.Action) {
+		action = request.Action
+	}
+	r.agent.recordRequest(action, reply, time.Since(start))
+
+	span := root.StartSpan("validate_reply")
+	rep := r.protocol.encodeReply(request, reply)
+	err = r.validateReply(r.protocol.rpcReplySchema, rep)
+	if err != nil {
+		span.SetError(err)
+		rep = r.protocol.encodeReply(request, abortReply("invalid reply: %s", err))
+	}
+	span.End()
+
+	span = root.StartSpan("publish_reply")
+	err = r.publishReply(rep)
+	span.SetError(err)
+	span.End()
+
+	root.SetAttribute("choria.statuscode", int(reply.StatusCode))
+	root.End()
+
+	r.panicIfError(err, "request failed: %s", err)
+
+	return nil
+}
+
+// processRequest dispatches a decoded request to its action, any failure is reported in the reply
+func (r *rpc) processRequest(request *Request) *Reply {
 	if request.Action == "" {
-		if r.failIfError(fmt.Errorf("invalid action"), "request failed") {
-			return nil
-		}
+		return abortReply("request failed")
 	}
 
 	action, ok := r.actions[request.Action]
 	if action == nil || !ok {
-		if r.fail("unknown action %s", request.Action) {
-			return nil
+		return abortReply("unknown action %s", request.Action)
+	}
+
+	request.factsPath = r.factsPath
+	request.protocol = r.protocol
+
+	return r.agent.idempotent(action, request, func() (*Reply, bool) {
+		if action.job {
+			reply := r.agent.startJob(action, request)
+			return reply, reply.StatusCode == OK
 		}
+
+		return r.invoke(action, request)
+	})
+}
+
+// invoke runs the action handler while holding any locks the action requires, false is returned when the
+// handler did not run or did not return normally
+func (r *rpc) invoke(action *action, request *Request) (*Reply, bool) {
+	span := request.StartSpan("lock")
+	release, err := r.agent.obtainLock(action, request)
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		return abortReply("%s", err), false
 	}
+	defer release()
 
-	action(request, reply, r.config)
+	// spans started by the handler are children of the handler span
+	parent := request.span
+	span = parent.StartSpan("handler")
+	request.span = span
 
-	err = r.publishReply(reply)
-	r.panicIfError(err, "request failed: %s", err)
+	reply := &Reply{}
+	completed := false
+
+	func() {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+
+			request.Logger().Error("Action panicked", "panic", p)
+			r.agent.recordPanic(action.name)
+			reply = &Reply{StatusCode: UnknownError, StatusMessage: fmt.Sprintf("action panicked: %v", p)}
+		}()
+
+		action.handler(request, reply, r.config)
+		completed = true
+	}()
+
+	request.span = parent
+	span.SetAttribute("choria.statuscode", int(reply.StatusCode))
+	if reply.StatusCode != OK {
+		span.SetError(errors.New(reply.StatusMessage))
+	}
+	span.End()
 
-	return nil
+	return reply, completed
+}
+
+// setRequestAttributes describes the request on its root span
+func setRequestAttributes(span *Span, request *Request) {
+	span.SetAttribute("choria.agent", request.Agent)
+	span.SetAttribute("choria.action", request.Action)
+	span.SetAttribute("choria.requestid", request.RequestID)
+	span.SetAttribute("choria.callerid", request.CallerID)
+	span.SetAttribute("choria.senderid", request.SenderID)
+	span.SetAttribute("choria.collective", request.Collective)
+	span.SetAttribute("choria.protocol_version", request.ProtocolVersion())
 }
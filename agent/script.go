@@ -0,0 +1,254 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ScriptInputMode is how request inputs are passed to a script
+type ScriptInputMode string
+
+const (
+	// ScriptInputEnv passes every input as an environment variable named CHORIA_INPUT_<NAME>
+	ScriptInputEnv = ScriptInputMode("env")
+
+	// ScriptInputArgs passes every input as a --name=value argument, sorted by name
+	ScriptInputArgs = ScriptInputMode("args")
+
+	// ScriptInputJSON passes the request data as JSON on STDIN
+	ScriptInputJSON = ScriptInputMode("json")
+)
+
+var invalidEnvChars = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// Script maps an action to an executable
+type Script struct {
+	// Action is the name of the action the script implements
+	Action string `json:"action"`
+
+	// Command is the script to run, relative paths in a manifest are relative to the manifest
+	Command string `json:"command"`
+
+	// Args are arguments passed to the script before any input arguments
+	Args []string `json:"args"`
+
+	// Env are additional environment variables set for the script
+	Env map[string]string `json:"env"`
+
+	// Input is how request inputs are passed to the script, defaults to ScriptInputEnv
+	Input ScriptInputMode `json:"input"`
+
+	// OutputField is the reply data field that holds the output of scripts that do not produce JSON, defaults to output
+	OutputField string `json:"output_field"`
+
+	// ExitCodes maps script exit codes to reply status codes, by default 0 is OK and anything else Aborted
+	ExitCodes map[int]StatusCode `json:"exit_codes"`
+
+	// Timeout limits how long the script may run, the request deadline is always enforced
+	Timeout time.Duration `json:"-"`
+
+	// AllowUnsafe allows inputs holding shell meta characters to be passed to the script
+	AllowUnsafe bool `json:"allow_unsafe"`
+}
+
+// scriptManifest is the format of the file loaded using LoadScriptManifest
+type scriptManifest struct {
+	Scripts []struct {
+		Script
+		Timeout string `json:"timeout"`
+	} `json:"scripts"`
+}
+
+// RegisterScript registers an action implemented by an external script
+func (a *Agent) RegisterScript(script Script, opts ...ActionOption) error {
+	if script.Action == "" {
+		return fmt.Errorf("scripts require an action name")
+	}
+
+	if script.Command == "" {
+		return fmt.Errorf("script for action %s requires a command", script.Action)
+	}
+
+	switch script.Input {
+	case "":
+		script.Input = ScriptInputEnv
+	case ScriptInputEnv, ScriptInputArgs, ScriptInputJSON:
+	default:
+		return fmt.Errorf("script for action %s has invalid input mode %q", script.Action, script.Input)
+	}
+
+	if script.OutputField == "" {
+		script.OutputField = "output"
+	}
+
+	for exit, code := range script.ExitCodes {
+		if code > UnknownError {
+			return fmt.Errorf("script for action %s maps exit code %d to invalid status code %d", script.Action, exit, code)
+		}
+	}
+
+	return a.RegisterAction(script.Action, script.handle, opts...)
+}
+
+// MustRegisterScript registers a script action and panics if any error occur
+func (a *Agent) MustRegisterScript(script Script, opts ...ActionOption) {
+	err := a.RegisterScript(script, opts...)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// LoadScriptManifest registers all the scripts found in a JSON manifest file of the form
+// {"scripts": [{"action": "status", "command": "status.sh", "input": "env", "timeout": "10s"}]}
+func (a *Agent) LoadScriptManifest(path string) error {
+	mj, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read script manifest: %s", err)
+	}
+
+	manifest := &scriptManifest{}
+	err = json.Unmarshal(mj, manifest)
+	if err != nil {
+		return fmt.Errorf("could not parse script manifest %s: %s", path, err)
+	}
+
+	for _, s := range manifest.Scripts {
+		script := s.Script
+
+		if s.Timeout != "" {
+			script.Timeout, err = time.ParseDuration(s.Timeout)
+			if err != nil {
+				return fmt.Errorf("invalid timeout for script action %s: %s", script.Action, err)
+			}
+		}
+
+		if script.Command != "" && !filepath.IsAbs(script.Command) {
+			local := filepath.Join(filepath.Dir(path), script.Command)
+			if strings.ContainsRune(script.Command, filepath.Separator) || fileExist(local) {
+				script.Command = local
+			}
+		}
+
+		err = a.RegisterScript(script)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s Script) handle(req *Request, rep *Reply, _ map[string]string) {
+	cmd := Command{
+		Path:        s.Command,
+		Args:        append([]string{}, s.Args...),
+		Env:         map[string]string{},
+		Timeout:     s.Timeout,
+		AllowUnsafe: s.AllowUnsafe,
+	}
+
+	for k, v := range s.Env {
+		cmd.Env[k] = v
+	}
+
+	cmd.Env["CHORIA_REQUEST_ID"] = req.RequestID
+	cmd.Env["CHORIA_AGENT"] = req.Agent
+	cmd.Env["CHORIA_ACTION"] = req.Action
+	cmd.Env["CHORIA_CALLER_ID"] = req.CallerID
+
+	if s.Input == ScriptInputJSON {
+		cmd.Stdin = bytes.NewReader(req.Data)
+	} else {
+		inputs, err := scriptInputs(req.Data)
+		if err != nil {
+			rep.InvalidData("Could not parse request data for %s#%s: %s", req.Agent, req.Action, err)
+			return
+		}
+
+		names := make([]string, 0, len(inputs))
+		for name := range inputs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if s.Input == ScriptInputArgs {
+				cmd.Args = append(cmd.Args, fmt.Sprintf("--%s=%s", name, inputs[name]))
+			} else {
+				cmd.Env["CHORIA_INPUT_"+invalidEnvChars.ReplaceAllString(strings.ToUpper(name), "_")] = inputs[name]
+			}
+		}
+	}
+
+	res, err := req.RunCommand(context.Background(), cmd)
+	if err != nil {
+		rep.Abort("%s", err)
+		return
+	}
+
+	if res.TimedOut {
+		rep.AbortIfCommandFailed(res, nil)
+		return
+	}
+
+	// only JSON objects are used as reply data, other output including JSON scalars and lists is text
+	output := bytes.TrimSpace([]byte(res.Stdout))
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(output, &obj) == nil && obj != nil {
+		rep.Data = json.RawMessage(output)
+	} else {
+		rep.Data = map[string]string{s.OutputField: string(output)}
+	}
+
+	code, ok := s.ExitCodes[res.ExitCode]
+	if !ok {
+		if res.ExitCode == 0 {
+			return
+		}
+
+		code = Aborted
+	}
+
+	rep.StatusCode = code
+	if code != OK {
+		msg := lastLine(res.Stderr, 256)
+		if msg == "" {
+			msg = fmt.Sprintf("%s exited with code %d", s.Command, res.ExitCode)
+		}
+
+		rep.StatusMessage = msg
+	}
+}
+
+// scriptInputs turns request data into a map of strings, non string values are passed as JSON
+func scriptInputs(data json.RawMessage) (map[string]string, error) {
+	result := map[string]string{}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return result, nil
+	}
+
+	inputs := map[string]json.RawMessage{}
+	err := json.Unmarshal(data, &inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range inputs {
+		var s string
+		if json.Unmarshal(v, &s) == nil {
+			result[k] = s
+		} else {
+			result[k] = string(v)
+		}
+	}
+
+	return result, nil
+}
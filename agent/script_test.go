@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestScriptManifest(t *testing.T) {
+	defer cleanEnv()
+
+	a := NewAgent("helloworld")
+	err := a.LoadScriptManifest("testdata/scripts/manifest.json")
+	if err != nil {
+		t.Fatalf("loading manifest failed: %s", err)
+	}
+
+	if len(a.actions) != 3 {
+		t.Fatalf("expected 3 actions got %d", len(a.actions))
+	}
+
+	reply := processRPC(t, a, requestFile(t, "env_echo", map[string]string{"message": "hello world"}))
+	if reply.StatusCode != OK {
+		t.Fatalf("env_echo failed: %s", reply.StatusMessage)
+	}
+
+	data := reply.Data.(map[string]interface{})
+	if data["message"] != "hello world" || data["action"] != "env_echo" {
+		t.Fatalf("unexpected env_echo reply: %v", data)
+	}
+
+	reply = processRPC(t, a, requestFile(t, "args_echo", map[string]interface{}{"message": "hello", "count": 1}))
+	if reply.StatusCode != OK {
+		t.Fatalf("args_echo failed: %s", reply.StatusMessage)
+	}
+
+	if reply.Data.(map[string]interface{})["output"] != "--count=1 --message=hello" {
+		t.Fatalf("unexpected args_echo reply: %v", reply.Data)
+	}
+
+	reply = processRPC(t, a, requestFile(t, "json_echo", map[string]string{"message": "hello"}))
+	if reply.StatusCode != InvalidData || reply.StatusMessage != "invalid input" {
+		t.Fatalf("unexpected json_echo status %d: %s", reply.StatusCode, reply.StatusMessage)
+	}
+
+	if reply.Data.(map[string]interface{})["message"] != "hello" {
+		t.Fatalf("unexpected json_echo reply: %v", reply.Data)
+	}
+
+	reply = processRPC(t, a, requestFile(t, "env_echo", map[string]string{"message": "$(id)"}))
+	if reply.StatusCode != Aborted {
+		t.Fatalf("expected unsafe input to be rejected")
+	}
+}
+
+func TestScriptManifestFromConfig(t *testing.T) {
+	defer cleanEnv()
+
+	config := tempDir(t) + "/config"
+	err := ioutil.WriteFile(config, []byte("script_manifest = testdata/scripts/manifest.json\n"), 0600)
+	if err != nil {
+		t.Fatalf("could not write config: %s", err)
+	}
+	os.Setenv("CHORIA_EXTERNAL_CONFIG", config)
+
+	a := NewAgent("helloworld")
+	if _, ok := a.actions["env_echo"]; !ok {
+		t.Fatalf("script manifest was not loaded")
+	}
+
+	err = a.RegisterScript(Script{Action: "other", Command: "echo", Input: "bogus"})
+	if err == nil {
+		t.Fatalf("expected invalid input mode to fail")
+	}
+}
+
+func TestScriptOutput(t *testing.T) {
+	defer cleanEnv()
+
+	a := NewAgent("helloworld")
+	for action, output := range map[string]string{"number": "42", "bool": "true", "list": `["a"]`, "object": `{"answer": 42}`} {
+		a.MustRegisterScript(Script{Action: action, Command: "/bin/sh", Args: []string{"-c", "echo '" + output + "'"}, AllowUnsafe: true})
+	}
+
+	// JSON scalars and lists are not reply data
+	for action, output := range map[string]string{"number": "42", "bool": "true", "list": `["a"]`} {
+		reply := processRPC(t, a, requestFile(t, action, map[string]string{}))
+		data, ok := reply.Data.(map[string]interface{})
+		if reply.StatusCode != OK || !ok || data["output"] != output {
+			t.Fatalf("unexpected %s reply: %#v", action, reply)
+		}
+	}
+
+	reply := processRPC(t, a, requestFile(t, "object", map[string]string{}))
+	if reply.Data.(map[string]interface{})["answer"] != float64(42) {
+		t.Fatalf("unexpected object reply: %#v", reply.Data)
+	}
+}
+
+func TestScriptExitCodes(t *testing.T) {
+	a := NewAgent("helloworld")
+
+	for _, code := range []StatusCode{6, 255} {
+		err := a.RegisterScript(Script{Action: "status", Command: "status.sh", ExitCodes: map[int]StatusCode{1: code}})
+		if err == nil {
+			t.Fatalf("status code %d was accepted", code)
+		}
+	}
+
+	manifest := tempDir(t) + "/manifest.json"
+	err := ioutil.WriteFile(manifest, []byte(`{"scripts": [{"action": "status", "command": "status.sh", "exit_codes": {"1": 9}}]}`), 0600)
+	if err != nil {
+		t.Fatalf("could not write manifest: %s", err)
+	}
+
+	err = a.LoadScriptManifest(manifest)
+	if err == nil || err.Error() != "script for action status maps exit code 1 to invalid status code 9" {
+		t.Fatalf("expected the invalid status code to be rejected got %v", err)
+	}
+}
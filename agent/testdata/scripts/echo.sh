@@ -0,0 +1,16 @@
+#!/bin/sh
+
+case "$1" in
+  args)
+    shift
+    echo "$@"
+    ;;
+  json)
+    cat
+    echo "invalid input" >&2
+    exit 4
+    ;;
+  *)
+    echo "{\"message\": \"${CHORIA_INPUT_MESSAGE}\", \"action\": \"${CHORIA_ACTION}\"}"
+    ;;
+esac
@@ -0,0 +1,377 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/choria-io/go-external/internal/flock"
+)
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+
+	spanStatusOK    = 1
+	spanStatusError = 2
+
+	traceScope = "github.com/choria-io/go-external/agent"
+)
+
+var traceIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Span is a timed operation within a request, spans are nil when tracing is disabled and all methods are
+// safe to call on a nil span
+type Span struct {
+	trace      *trace
+	id         string
+	parentID   string
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	events     []spanEvent
+	err        error
+	mu         sync.Mutex
+}
+
+type spanEvent struct {
+	name       string
+	time       time.Time
+	attributes map[string]interface{}
+}
+
+// trace collects the spans of a request in one process and exports them when the root span ends
+type trace struct {
+	path     string
+	id       string
+	resource map[string]interface{}
+	spans    []*Span
+	mu       sync.Mutex
+}
+
+// SetTraceFile enables tracing of requests, spans are appended to path as OTLP JSON lines, same as the
+// trace_file configuration
+func (a *Agent) SetTraceFile(path string) {
+	a.tracePath = path
+}
+
+func (a *Agent) traceFile() string {
+	if a.tracePath != "" {
+		return a.tracePath
+	}
+
+	return a.configItem("trace_file")
+}
+
+// startTrace starts the root span of a request handled in this process, nil when tracing is disabled
+func (a *Agent) startTrace(name string, requestID string, parentID string, start time.Time) *Span {
+	path := a.traceFile()
+	if path == "" {
+		return nil
+	}
+
+	if start.IsZero() {
+		start = time.Now()
+	}
+
+	hostname, _ := os.Hostname()
+
+	t := &trace{
+		path:     path,
+		id:       traceID(requestID),
+		resource: map[string]interface{}{"service.name": a.Name, "host.name": hostname, "process.pid": os.Getpid()},
+	}
+
+	return t.newSpan(name, parentID, spanKindServer, start)
+}
+
+// traceID derives the trace id from the request id so spans from all nodes handling a request share a trace
+func traceID(requestID string) string {
+	if traceIDPattern.MatchString(requestID) {
+		return requestID
+	}
+
+	if requestID == "" {
+		return randomID(16)
+	}
+
+	sum := sha256.Sum256([]byte(requestID))
+
+	return hex.EncodeToString(sum[:16])
+}
+
+func randomID(size int) string {
+	b := make([]byte, size)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+func (t *trace) newSpan(name string, parentID string, kind int, start time.Time) *Span {
+	s := &Span{
+		trace:      t,
+		id:         randomID(8),
+		parentID:   parentID,
+		name:       name,
+		kind:       kind,
+		start:      start,
+		attributes: make(map[string]interface{}),
+	}
+
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+
+	return s
+}
+
+// spanID is the id of the span, empty for nil spans
+func (s *Span) spanID() string {
+	if s == nil {
+		return ""
+	}
+
+	return s.id
+}
+
+// StartSpan starts a span that is a child of the span
+func (s *Span) StartSpan(name string) *Span {
+	if s == nil {
+		return nil
+	}
+
+	return s.trace.newSpan(name, s.id, spanKindInternal, time.Now())
+}
+
+// record adds a completed child span for a phase that was timed before tracing started
+func (s *Span) record(name string, start time.Time, end time.Time, err error) {
+	if s == nil || start.IsZero() {
+		return
+	}
+
+	child := s.trace.newSpan(name, s.id, spanKindInternal, start)
+	child.SetError(err)
+	child.finish(end)
+}
+
+// SetAttribute sets an attribute of the span, values can be strings, booleans, integers or floats
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.attributes[key] = value
+	s.mu.Unlock()
+}
+
+// AddEvent records a named event with optional attributes at the current time
+func (s *Span) AddEvent(name string, attributes map[string]interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.events = append(s.events, spanEvent{name: name, time: time.Now(), attributes: attributes})
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed, a nil err is ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// End completes the span, ending the root span of a request exports all its spans
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.finish(time.Now())
+}
+
+func (s *Span) finish(end time.Time) {
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = end
+	root := s.kind == spanKindServer
+	s.mu.Unlock()
+
+	if !root {
+		return
+	}
+
+	err := s.trace.export()
+	if err != nil {
+		Warnf("Could not write trace: %s", err)
+	}
+}
+
+// export appends the completed spans to the trace file as a single OTLP ExportTraceServiceRequest line
+func (t *trace) export() error {
+	t.mu.Lock()
+	spans := make([]map[string]interface{}, 0, len(t.spans))
+	for _, s := range t.spans {
+		if span := s.otlp(t.id); span != nil {
+			spans = append(spans, span)
+		}
+	}
+	t.mu.Unlock()
+
+	line, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{"attributes": otlpAttributes(t.resource)},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": traceScope},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(t.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// lines from concurrent invocations must not interleave
+	lock, err := flock.WaitLock(ctx, t.path+".lock", 10*time.Millisecond)
+	if err != nil {
+		return fmt.Errorf("could not lock %s: %s", t.path, err)
+	}
+	defer lock.Unlock()
+
+	f, err := os.OpenFile(t.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// otlp is the OTLP JSON representation of the span, nil for spans that did not end
+func (s *Span) otlp(traceID string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.end.IsZero() {
+		return nil
+	}
+
+	span := map[string]interface{}{
+		"traceId":           traceID,
+		"spanId":            s.id,
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attributes),
+		"status":            map[string]interface{}{"code": spanStatusOK},
+	}
+
+	if s.parentID != "" {
+		span["parentSpanId"] = s.parentID
+	}
+
+	if s.err != nil {
+		span["status"] = map[string]interface{}{"code": spanStatusError, "message": secrets.redact(s.err.Error())}
+	}
+
+	if len(s.events) > 0 {
+		events := make([]interface{}, 0, len(s.events))
+		for _, e := range s.events {
+			events = append(events, map[string]interface{}{
+				"name":         e.name,
+				"timeUnixNano": strconv.FormatInt(e.time.UnixNano(), 10),
+				"attributes":   otlpAttributes(e.attributes),
+			})
+		}
+		span["events"] = events
+	}
+
+	return span
+}
+
+func otlpAttributes(attributes map[string]interface{}) []interface{} {
+	result := make([]interface{}, 0, len(attributes))
+	for _, k := range sortedKeys(attributes) {
+		result = append(result, map[string]interface{}{"key": k, "value": otlpValue(attributes[k])})
+	}
+
+	return result
+}
+
+func otlpValue(v interface{}) map[string]interface{} {
+	switch value := v.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": secrets.redact(value)}
+	case bool:
+		return map[string]interface{}{"boolValue": value}
+	case int:
+		return map[string]interface{}{"intValue": strconv.FormatInt(int64(value), 10)}
+	case int32:
+		return map[string]interface{}{"intValue": strconv.FormatInt(int64(value), 10)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case uint8:
+		return map[string]interface{}{"intValue": strconv.FormatInt(int64(value), 10)}
+	case float32:
+		return map[string]interface{}{"doubleValue": float64(value)}
+	case float64:
+		return map[string]interface{}{"doubleValue": value}
+	default:
+		return map[string]interface{}{"stringValue": secrets.redact(fmt.Sprintf("%v", v))}
+	}
+}
+
+// StartSpan starts a span that is a child of the span currently active for the request, the span must be ended
+// using End(), nil is returned when tracing is disabled
+func (r *Request) StartSpan(name string) *Span {
+	return r.span.StartSpan(name)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,177 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type otlpSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Attributes   []struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	} `json:"attributes"`
+	Events []struct {
+		Name string `json:"name"`
+	} `json:"events"`
+	Status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+func (s otlpSpan) attribute(key string) interface{} {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			for _, v := range a.Value {
+				return v
+			}
+		}
+	}
+
+	return nil
+}
+
+func readTrace(t *testing.T, path string) []map[string]otlpSpan {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("could not open trace: %s", err)
+	}
+	defer f.Close()
+
+	var traces []map[string]otlpSpan
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		export := struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}{}
+
+		err = json.Unmarshal(scanner.Bytes(), &export)
+		if err != nil {
+			t.Fatalf("invalid trace line: %s", err)
+		}
+
+		spans := map[string]otlpSpan{}
+		for _, s := range export.ResourceSpans[0].ScopeSpans[0].Spans {
+			spans[s.Name] = s
+		}
+		traces = append(traces, spans)
+	}
+
+	return traces
+}
+
+func TestTrace(t *testing.T) {
+	defer cleanEnv()
+
+	path := filepath.Join(tempDir(t), "trace.json")
+
+	a := NewAgent("helloworld")
+	a.SetTraceFile(path)
+	a.MustRegisterAction("ping", func(req *Request, rep *Reply, config map[string]string) {
+		span := req.StartSpan("lookup")
+		span.SetAttribute("lookup.items", 3)
+		span.AddEvent("cache miss", map[string]interface{}{"key": "x"})
+		span.SetError(fmt.Errorf("lookup failed"))
+		span.End()
+
+		rep.Abort("could not lookup")
+	})
+
+	processRPC(t, a, "testdata/pingrequest.json")
+
+	traces := readTrace(t, path)
+	if len(traces) != 1 {
+		t.Fatalf("expected 1 trace got %d", len(traces))
+	}
+	spans := traces[0]
+
+	root, ok := spans["helloworld#ping"]
+	if !ok {
+		t.Fatalf("no root span found: %v", spans)
+	}
+
+	if root.TraceID != "034c527089f746248822ada8a145f499" || root.ParentSpanID != "" || root.Kind != 2 {
+		t.Fatalf("invalid root span: %#v", root)
+	}
+
+	if root.attribute("choria.callerid") != "choria=rip.mcollective" || root.attribute("choria.statuscode") != "1" {
+		t.Fatalf("invalid root attributes: %#v", root.Attributes)
+	}
+
+	for _, name := range []string{"read_request", "decode_request", "lock", "handler", "validate_reply", "publish_reply"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("no %s span found", name)
+		}
+
+		if span.ParentSpanID != root.SpanID || span.TraceID != root.TraceID {
+			t.Fatalf("%s is not a child of the root span: %#v", name, span)
+		}
+	}
+
+	if spans["handler"].Status.Code != 2 || spans["handler"].Status.Message != "could not lookup" {
+		t.Fatalf("handler span status is not an error: %#v", spans["handler"].Status)
+	}
+
+	lookup := spans["lookup"]
+	if lookup.ParentSpanID != spans["handler"].SpanID {
+		t.Fatalf("lookup is not a child of the handler span")
+	}
+
+	if lookup.attribute("lookup.items") != "3" || len(lookup.Events) != 1 || lookup.Events[0].Name != "cache miss" || lookup.Status.Message != "lookup failed" {
+		t.Fatalf("invalid lookup span: %#v", lookup)
+	}
+
+	processRPC(t, a, "testdata/pingrequest.json")
+	if len(readTrace(t, path)) != 2 {
+		t.Fatalf("expected traces to be appended")
+	}
+}
+
+func TestTraceID(t *testing.T) {
+	if traceID("034c527089f746248822ada8a145f499") != "034c527089f746248822ada8a145f499" {
+		t.Fatalf("choria request ids should be used as trace ids")
+	}
+
+	id := traceID("custom-request")
+	if len(id) != 32 || id != traceID("custom-request") {
+		t.Fatalf("invalid derived trace id %q", id)
+	}
+
+	if traceID("") == traceID("") {
+		t.Fatalf("expected random trace ids without a request id")
+	}
+}
+
+func TestTraceDisabled(t *testing.T) {
+	defer cleanEnv()
+
+	a := NewAgent("helloworld")
+	a.MustRegisterAction("ping", func(req *Request, rep *Reply, config map[string]string) {
+		span := req.StartSpan("lookup")
+		span.SetAttribute("x", 1)
+		span.AddEvent("y", nil)
+		span.StartSpan("child").End()
+		span.End()
+	})
+
+	reply := processRPC(t, a, "testdata/pingrequest.json")
+	if reply.StatusCode != OK {
+		t.Fatalf("request failed: %#v", reply)
+	}
+}
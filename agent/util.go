@@ -3,6 +3,7 @@ package agent
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 )
 
 func fileExist(path string) bool {
@@ -13,12 +14,37 @@ func fileExist(path string) bool {
 	return true
 }
 
-// Errorf produce an error level message
-func Errorf(format string, a ...interface{}) {
-	fmt.Fprintf(os.Stderr, format+"\n", a...)
+// privateTempDir is the default location of state that should only be accessible to the current user
+func privateTempDir(name string) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("choria-external-%d", os.Geteuid()), name)
+}
+
+// ensurePrivateDirectory creates dir when needed and ensures other users cannot access or replace it
+func ensurePrivateDirectory(dir string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	return checkPrivateDirectory(dir)
+}
+
+// Debugf produce a debug level message using the default logger
+func Debugf(format string, a ...interface{}) {
+	defaultLogger.Debugf(format, a...)
 }
 
-// Infof produce an info level message
+// Infof produce an info level message using the default logger
 func Infof(format string, a ...interface{}) {
-	fmt.Printf(format+"\n", a...)
+	defaultLogger.Infof(format, a...)
+}
+
+// Warnf produce a warning level message using the default logger
+func Warnf(format string, a ...interface{}) {
+	defaultLogger.Warnf(format, a...)
+}
+
+// Errorf produce an error level message using the default logger
+func Errorf(format string, a ...interface{}) {
+	defaultLogger.Errorf(format, a...)
 }
@@ -1,6 +1,9 @@
 package agent
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -13,3 +16,36 @@ func TestFileExist(t *testing.T) {
 		t.Error("fileExist found a file that does not exist")
 	}
 }
+
+func TestEnsurePrivateDirectory(t *testing.T) {
+	dir := tempDir(t)
+
+	private := filepath.Join(dir, "private", "spool")
+	err := ensurePrivateDirectory(private)
+	if err != nil {
+		t.Fatalf("private directory was rejected: %s", err)
+	}
+
+	os.Chmod(private, 0750)
+	if ensurePrivateDirectory(private) == nil {
+		t.Fatalf("directory readable by the group was accepted")
+	}
+
+	// a directory others can write to lets them replace the private directory
+	shared := filepath.Join(dir, "shared")
+	os.Mkdir(shared, 0700)
+	os.Chmod(shared, 0777)
+	if ensurePrivateDirectory(filepath.Join(shared, "spool")) == nil {
+		t.Fatalf("directory in a shared directory was accepted")
+	}
+
+	os.Chmod(shared, 0777|os.ModeSticky)
+	if ensurePrivateDirectory(filepath.Join(shared, "spool")) != nil {
+		t.Fatalf("directory in a sticky directory was rejected")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0600)
+	if checkPrivateDirectory(filepath.Join(dir, "file")) == nil {
+		t.Fatalf("file was accepted")
+	}
+}
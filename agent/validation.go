@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/choria-io/go-external/schemas"
+)
+
+// SetSchemaValidation sets how requests and replies are checked against the protocol JSON schemas, same as
+// the schema_validation configuration that accepts off, warn or strict
+func (a *Agent) SetSchemaValidation(mode schemas.Mode) {
+	a.validation = mode
+}
+
+func (a *Agent) schemaValidation() schemas.Mode {
+	if a.validation != "" {
+		return a.validation
+	}
+
+	mode, err := schemas.ParseMode(a.configItem("schema_validation"))
+	if err != nil {
+		return schemas.Off
+	}
+
+	return mode
+}
+
+// validateDocument checks the JSON document doc against schema, failures are logged in warn mode and
+// returned in strict mode
+func (e externalAgent) validateDocument(schema string, doc []byte) error {
+	if e.validation == "" || e.validation == schemas.Off {
+		return nil
+	}
+
+	err := schemas.Validate(schema, doc)
+	if err == nil {
+		return nil
+	}
+
+	if e.validation == schemas.Warn {
+		Warnf("Schema validation failed: %s", err)
+		return nil
+	}
+
+	return err
+}
+
+// validateReply checks the reply that would be published for rep against schema
+func (e externalAgent) validateReply(schema string, rep interface{}) error {
+	if e.validation == "" || e.validation == schemas.Off {
+		return nil
+	}
+
+	j, err := json.Marshal(rep)
+	if err != nil {
+		return fmt.Errorf("could not JSON encode reply data: %s", err)
+	}
+
+	return e.validateDocument(schema, j)
+}
@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/choria-io/go-external/schemas"
+)
+
+func TestSchemaValidationRequest(t *testing.T) {
+	defer cleanEnv()
+
+	called := false
+	a := NewAgent("helloworld")
+	a.MustRegisterAction("ping", func(req *Request, rep *Reply, config map[string]string) {
+		called = true
+	})
+	a.SetSchemaValidation(schemas.Strict)
+
+	reply := processWithProtocol(t, a, "io.choria.mcorpc.external.v1.rpc_request", "testdata/pingrequest.json")
+	if reply["statuscode"].(float64) != float64(OK) || !called {
+		t.Fatalf("valid request failed: %v", reply)
+	}
+
+	// the request has no collective or msgtime
+	request := requestFile(t, "ping", map[string]string{})
+
+	called = false
+	reply = processWithProtocol(t, a, "io.choria.mcorpc.external.v1.rpc_request", request)
+	if reply["statuscode"].(float64) != float64(Aborted) || called {
+		t.Fatalf("invalid request was processed: %v", reply)
+	}
+
+	if !strings.Contains(reply["statusmsg"].(string), "required property collective is missing") {
+		t.Fatalf("unexpected status message: %v", reply["statusmsg"])
+	}
+
+	a.SetSchemaValidation(schemas.Warn)
+	reply = processWithProtocol(t, a, "io.choria.mcorpc.external.v1.rpc_request", request)
+	if reply["statuscode"].(float64) != float64(OK) || !called {
+		t.Fatalf("invalid request was not processed in warn mode: %v", reply)
+	}
+}
+
+func TestSchemaValidationReply(t *testing.T) {
+	defer cleanEnv()
+
+	a := NewAgent("helloworld")
+	a.MustRegisterAction("ping", func(req *Request, rep *Reply, config map[string]string) {
+		rep.StatusCode = StatusCode(9)
+	})
+	a.SetSchemaValidation(schemas.Strict)
+
+	reply := processWithProtocol(t, a, "io.choria.mcorpc.external.v2.rpc_request", "testdata/pingrequest_v2.json")
+	if reply["statuscode"].(float64) != float64(Aborted) || !strings.HasPrefix(reply["statusmsg"].(string), "invalid reply") {
+		t.Fatalf("invalid reply was published: %v", reply)
+	}
+
+	if reply["requestid"] != "034c527089f746248822ada8a145f499" {
+		t.Fatalf("abort reply did not identify the request: %v", reply)
+	}
+
+	a.SetSchemaValidation(schemas.Off)
+	reply = processWithProtocol(t, a, "io.choria.mcorpc.external.v2.rpc_request", "testdata/pingrequest_v2.json")
+	if reply["statuscode"].(float64) != 9 {
+		t.Fatalf("reply was changed with validation disabled: %v", reply)
+	}
+}
+
+func TestSchemaValidationConfig(t *testing.T) {
+	defer cleanEnv()
+
+	config := filepath.Join(tempDir(t), "plugin.conf")
+	err := ioutil.WriteFile(config, []byte("schema_validation = strict\n"), 0600)
+	if err != nil {
+		t.Fatalf("could not write config: %s", err)
+	}
+	os.Setenv("CHORIA_EXTERNAL_CONFIG", config)
+
+	a := NewAgent("helloworld")
+	if a.schemaValidation() != schemas.Strict {
+		t.Fatalf("expected strict mode got %q", a.schemaValidation())
+	}
+
+	reply := processWithProtocol(t, a, "io.choria.mcorpc.external.v1.activation_request", "testdata/activationrequest.json")
+	if reply["activate"] != true {
+		t.Fatalf("unexpected activation reply: %v", reply)
+	}
+}
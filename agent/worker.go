@@ -0,0 +1,351 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/choria-io/go-external/internal/flock"
+)
+
+const (
+	// DefaultWorkerIdleTimeout is how long a worker waits for requests before exiting when worker_idle_timeout is not configured
+	DefaultWorkerIdleTimeout = 5 * time.Minute
+
+	workerDialTimeout     = time.Second
+	workerRefreshInterval = 5 * time.Second
+)
+
+// workerRequest is sent by the shim to the worker over the worker socket
+type workerRequest struct {
+	Protocol  string          `json:"protocol"`
+	Request   json.RawMessage `json:"request"`
+	FactsPath string          `json:"facts"`
+
+	// ParentSpan is the span in the shim that dispatched the request when tracing
+	ParentSpan string `json:"span,omitempty"`
+}
+
+// workerReply is sent by the worker to the shim over the worker socket
+type workerReply struct {
+	Reply *Reply `json:"reply"`
+}
+
+// EnableWorker enables the persistent worker mode where requests are handed to a long running copy of the
+// agent over a Unix socket rather than being handled in a new process, same as the worker configuration
+func (a *Agent) EnableWorker() {
+	a.worker = true
+}
+
+func (a *Agent) workerEnabled() bool {
+	return a.worker || a.configItem("worker") == "true"
+}
+
+func (a *Agent) workerSocket() string {
+	if a.configItem("worker_socket") != "" {
+		return a.configItem("worker_socket")
+	}
+
+	return filepath.Join(privateTempDir("workers"), a.Name+".sock")
+}
+
+func (a *Agent) workerIdleTimeout() time.Duration {
+	timeout, err := time.ParseDuration(a.configItem("worker_idle_timeout"))
+	if err != nil || timeout <= 0 {
+		return DefaultWorkerIdleTimeout
+	}
+
+	return timeout
+}
+
+// dispatchToWorker hands the request to a running worker and returns its reply, when no worker is running
+// one is started for future requests and nil is returned so the request is handled in this process
+func (a *Agent) dispatchToWorker(jreq []byte, p *protocol, factsPath string, span *Span) *Reply {
+	socket := a.workerSocket()
+
+	// requests hold sensitive data and replies are trusted, only sockets in private directories are used
+	err := checkPrivateDirectory(filepath.Dir(socket))
+	if err != nil && !os.IsNotExist(err) {
+		Warnf("Not using worker socket %s: %s", socket, err)
+		return nil
+	}
+
+	conn, err := net.DialTimeout("unix", socket, workerDialTimeout)
+	if err != nil {
+		err = a.spawnWorker(socket)
+		if err != nil {
+			Warnf("Could not start worker: %s", err)
+		}
+
+		return nil
+	}
+	defer conn.Close()
+
+	err = checkPeer(conn)
+	if err != nil {
+		Warnf("Not using worker on %s: %s", socket, err)
+		return nil
+	}
+
+	err = json.NewEncoder(conn).Encode(workerRequest{Protocol: p.rpcRequest, Request: jreq, FactsPath: factsPath, ParentSpan: span.spanID()})
+	if err != nil {
+		// the worker did not receive the request so it is safe to handle it here
+		return nil
+	}
+
+	reply := &workerReply{}
+	err = json.NewDecoder(conn).Decode(reply)
+	if err != nil || reply.Reply == nil {
+		return abortReply("could not receive reply from worker %s: %v", socket, err)
+	}
+
+	return reply.Reply
+}
+
+func (a *Agent) spawnWorker(socket string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(self)
+	cmd.SysProcAttr = newProcessGroupAttr()
+	cmd.Env = []string{"CHORIA_EXTERNAL_WORKER=" + socket}
+	for _, e := range os.Environ() {
+		if strings.HasPrefix(e, "CHORIA_EXTERNAL_") && !strings.HasPrefix(e, "CHORIA_EXTERNAL_CONFIG=") {
+			continue
+		}
+
+		cmd.Env = append(cmd.Env, e)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	return cmd.Process.Release()
+}
+
+// processWorker runs the worker until it has been idle for the idle timeout, this is the entry point of the
+// process started by spawnWorker
+func (a *Agent) processWorker(socket string) {
+	err := ensurePrivateDirectory(filepath.Dir(socket))
+	if err != nil {
+		Errorf("worker failed: %s", err)
+		os.Exit(1)
+	}
+
+	// only one worker per socket, others exit silently
+	lock, err := flock.TryLock(socket + ".lock")
+	if err != nil {
+		return
+	}
+	defer lock.Unlock()
+
+	err = a.serveWorker(context.Background(), socket)
+	if err != nil {
+		Errorf("worker failed: %s", err)
+		os.Exit(1)
+	}
+}
+
+func (a *Agent) serveWorker(ctx context.Context, socket string) error {
+	err := ensurePrivateDirectory(filepath.Dir(socket))
+	if err != nil {
+		return err
+	}
+
+	os.Remove(socket)
+
+	listener, err := listenPrivateUnix(socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socket)
+	defer listener.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	activity := make(chan struct{}, 1)
+
+	go a.superviseWorker(ctx, cancel, activity)
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				wg.Wait()
+				return nil
+			}
+
+			return err
+		}
+
+		select {
+		case activity <- struct{}{}:
+		default:
+		}
+
+		err = checkPeer(conn)
+		if err != nil {
+			Warnf("Rejected worker connection: %s", err)
+			conn.Close()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.handleWorkerConnection(conn)
+		}()
+	}
+}
+
+// superviseWorker reloads the configuration when it changes and stops the worker when it was idle for too long
+// or when the binary was replaced by an upgrade
+func (a *Agent) superviseWorker(ctx context.Context, stop func(), activity chan struct{}) {
+	configPath := os.Getenv("CHORIA_EXTERNAL_CONFIG")
+	configStat, _ := os.Stat(configPath)
+
+	self, _ := os.Executable()
+	selfStat, _ := os.Stat(self)
+
+	interval := workerRefreshInterval
+	if a.workerIdleTimeout()/2 < interval {
+		interval = a.workerIdleTimeout() / 2
+	}
+
+	lastActivity := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-activity:
+			lastActivity = time.Now()
+
+		case <-ticker.C:
+			if time.Since(lastActivity) > a.workerIdleTimeout() {
+				stop()
+				return
+			}
+
+			stat, err := os.Stat(self)
+			if err == nil && selfStat != nil && (!os.SameFile(stat, selfStat) || !stat.ModTime().Equal(selfStat.ModTime())) {
+				Infof("Stopping worker after %s was updated", self)
+				stop()
+				return
+			}
+
+			stat, err = os.Stat(configPath)
+			if err == nil && (configStat == nil || !stat.ModTime().Equal(configStat.ModTime())) {
+				err = a.parseConfig()
+				if err != nil {
+					Errorf("Could not reload configuration: %s", err)
+					continue
+				}
+
+				configStat = stat
+				Infof("Reloaded configuration from %s", configPath)
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *Agent) handleWorkerConnection(conn net.Conn) {
+	defer conn.Close()
+
+	req := &workerRequest{}
+	err := json.NewDecoder(conn).Decode(req)
+	if err != nil {
+		Errorf("Could not read worker request: %s", err)
+		return
+	}
+
+	rpch, err := newRPC(a)
+	if err != nil {
+		Errorf("Could not create RPC handler: %s", err)
+		return
+	}
+	rpch.factsPath = req.FactsPath
+
+	var reply *Reply
+	defer func() {
+		err = json.NewEncoder(conn).Encode(workerReply{Reply: reply})
+		if err != nil {
+			Errorf("Could not send worker reply: %s", err)
+		}
+	}()
+
+	p, activation, found := protocolByName(req.Protocol)
+	if !found || activation {
+		reply = abortReply("invalid protocol '%s'", req.Protocol)
+		return
+	}
+	rpch.protocol = p
+
+	request, err := p.decodeRequest(req.Request)
+	if err != nil {
+		reply = abortReply("could not parse request")
+		return
+	}
+
+	// the handler may outlive this function when it times out, it is cancelled and keeps the secrets of the
+	// request registered until it returns
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	request.ctx = ctx
+
+	release := a.protectRequest(request)
+
+	root := a.startTrace(fmt.Sprintf("worker %s#%s", request.Agent, request.Action), request.RequestID, req.ParentSpan, time.Now())
+	setRequestAttributes(root, request)
+	request.span = root
+	defer root.End()
+
+	timeout := request.ttlDuration()
+
+	result := make(chan *Reply, 1)
+	go func() {
+		defer release()
+
+		var reply *Reply
+		func() {
+			defer func() {
+				if p := recover(); p != nil {
+					reply = &Reply{StatusCode: UnknownError, StatusMessage: fmt.Sprintf("action panicked: %v", p)}
+				}
+			}()
+
+			reply = rpch.processRequest(request)
+		}()
+
+		a.protectReply(request, reply)
+		result <- reply
+	}()
+
+	select {
+	case reply = <-result:
+	case <-time.After(timeout):
+		reply = abortReply("request %s timed out after %s in worker", request.RequestID, timeout)
+		root.SetError(errors.New(reply.StatusMessage))
+	}
+}
@@ -0,0 +1,264 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func workerPingAction(req *Request, rep *Reply, config map[string]string) {
+	rep.Data = map[string]interface{}{
+		"pid":   os.Getpid(),
+		"facts": req.FactsPath(),
+		"extra": config["extra"],
+	}
+}
+
+func TestWorker(t *testing.T) {
+	defer cleanEnv()
+
+	dir := tempDir(t)
+	socket := filepath.Join(dir, "helloworld.sock")
+	config := filepath.Join(dir, "helloworld.cfg")
+
+	err := ioutil.WriteFile(config, []byte(fmt.Sprintf("worker = true\nworker_socket = %s\nworker_idle_timeout = 2s\n", socket)), 0600)
+	if err != nil {
+		t.Fatalf("could not write config: %s", err)
+	}
+
+	os.Setenv("CHORIA_EXTERNAL_CONFIG", config)
+	os.Setenv("CHORIA_EXTERNAL_FACTS", "testdata/facts.json")
+
+	a := NewAgent("helloworld")
+	a.MustRegisterAction("ping", workerPingAction)
+
+	// no worker is running so the first request is handled here while a worker starts
+	reply := processRPC(t, a, requestFile(t, "ping", map[string]string{}))
+	data := reply.Data.(map[string]interface{})
+	if int(data["pid"].(float64)) != os.Getpid() {
+		t.Fatalf("expected the first request to be handled in process")
+	}
+
+	timeout := time.After(10 * time.Second)
+	for !fileExist(socket) {
+		select {
+		case <-timeout:
+			t.Fatalf("worker did not start")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	reply = processRPC(t, a, requestFile(t, "ping", map[string]string{}))
+	if reply.StatusCode != OK {
+		t.Fatalf("worker request failed: %s", reply.StatusMessage)
+	}
+
+	data = reply.Data.(map[string]interface{})
+	if int(data["pid"].(float64)) == os.Getpid() {
+		t.Fatalf("expected the request to be handled by the worker")
+	}
+
+	if data["facts"] != "testdata/facts.json" {
+		t.Fatalf("facts path was not passed to the worker: %v", data)
+	}
+
+	// the worker reloads its configuration when it changes
+	err = ioutil.WriteFile(config, []byte(fmt.Sprintf("worker = true\nworker_socket = %s\nworker_idle_timeout = 2s\nextra = reloaded\n", socket)), 0600)
+	if err != nil {
+		t.Fatalf("could not write config: %s", err)
+	}
+	future := time.Now().Add(time.Second)
+	os.Chtimes(config, future, future)
+
+	timeout = time.After(10 * time.Second)
+	for data["extra"] != "reloaded" {
+		select {
+		case <-timeout:
+			t.Fatalf("worker did not reload its configuration")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		data = processRPC(t, a, requestFile(t, "ping", map[string]string{})).Data.(map[string]interface{})
+	}
+
+	// once idle for its idle timeout the worker exits
+	timeout = time.After(10 * time.Second)
+	for fileExist(socket) {
+		select {
+		case <-timeout:
+			t.Fatalf("worker did not exit when idle")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func TestWorkerPrivateSocket(t *testing.T) {
+	defer cleanEnv()
+
+	dir := tempDir(t)
+	socket := filepath.Join(dir, "helloworld.sock")
+
+	a := NewAgent("helloworld")
+	a.MustRegisterAction("ping", workerPingAction)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- a.serveWorker(ctx, socket) }()
+
+	timeout := time.After(5 * time.Second)
+	for !fileExist(socket) {
+		select {
+		case <-timeout:
+			t.Fatalf("worker did not start")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	stat, err := os.Stat(socket)
+	if err != nil {
+		t.Fatalf("stat failed: %s", err)
+	}
+	if stat.Mode().Perm() != 0600 {
+		t.Fatalf("socket was created with mode %v", stat.Mode().Perm())
+	}
+
+	cancel()
+	err = <-done
+	if err != nil {
+		t.Fatalf("worker failed: %s", err)
+	}
+
+	// workers are not started in directories other users can access
+	shared := filepath.Join(dir, "shared")
+	err = os.Mkdir(shared, 0700)
+	if err != nil {
+		t.Fatalf("mkdir failed: %s", err)
+	}
+	os.Chmod(shared, 0777)
+
+	err = a.serveWorker(context.Background(), filepath.Join(shared, "helloworld.sock"))
+	if err == nil {
+		t.Fatalf("worker was started in a shared directory")
+	}
+}
+
+func TestWorkerSharedSocketNotUsed(t *testing.T) {
+	defer cleanEnv()
+
+	dir := tempDir(t)
+	shared := filepath.Join(dir, "shared")
+	err := os.Mkdir(shared, 0700)
+	if err != nil {
+		t.Fatalf("mkdir failed: %s", err)
+	}
+	socket := filepath.Join(shared, "helloworld.sock")
+
+	// a process of another user listening in a shared directory forges replies
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	defer listener.Close()
+	os.Chmod(shared, 0777)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			json.NewEncoder(conn).Encode(workerReply{Reply: &Reply{Data: map[string]interface{}{"pid": -1}}})
+			conn.Close()
+		}
+	}()
+
+	config := filepath.Join(dir, "helloworld.cfg")
+	err = ioutil.WriteFile(config, []byte(fmt.Sprintf("worker = true\nworker_socket = %s\n", socket)), 0600)
+	if err != nil {
+		t.Fatalf("could not write config: %s", err)
+	}
+	os.Setenv("CHORIA_EXTERNAL_CONFIG", config)
+
+	a := NewAgent("helloworld")
+	a.MustRegisterAction("ping", workerPingAction)
+
+	reply := processRPC(t, a, requestFile(t, "ping", map[string]string{}))
+	if reply.StatusCode != OK {
+		t.Fatalf("request failed: %s", reply.StatusMessage)
+	}
+
+	data := reply.Data.(map[string]interface{})
+	if int(data["pid"].(float64)) != os.Getpid() {
+		t.Fatalf("the request was sent to a worker in a shared directory")
+	}
+}
+
+func TestWorkerTimeout(t *testing.T) {
+	type state struct {
+		cancelled bool
+		masked    bool
+	}
+
+	handled := make(chan state, 1)
+
+	a := NewAgent("helloworld")
+	a.MustRegisterAction("login", func(req *Request, rep *Reply, config map[string]string) {
+		s := state{}
+
+		select {
+		case <-req.Context().Done():
+			s.cancelled = true
+		case <-time.After(10 * time.Second):
+		}
+
+		s.masked = Redact(testSecret) != testSecret
+		handled <- s
+	}, WithSensitiveInputs("password"))
+
+	request := map[string]interface{}{}
+	rj, _ := ioutil.ReadFile(requestFile(t, "login", map[string]string{"password": testSecret}))
+	json.Unmarshal(rj, &request)
+	request["ttl"] = 1
+	rj, _ = json.Marshal(request)
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go a.handleWorkerConnection(server)
+
+	reply := &workerReply{}
+	err := json.NewEncoder(client).Encode(workerRequest{Protocol: v1Protocol.rpcRequest, Request: rj})
+	if err == nil {
+		err = json.NewDecoder(client).Decode(reply)
+	}
+	if err != nil {
+		t.Fatalf("worker request failed: %s", err)
+	}
+
+	if reply.Reply == nil || reply.Reply.StatusCode != Aborted || !strings.Contains(reply.Reply.StatusMessage, "timed out") {
+		t.Fatalf("unexpected reply: %#v", reply.Reply)
+	}
+
+	// the abandoned handler is cancelled and its secrets stay masked until it returns
+	s := <-handled
+	if !s.cancelled || !s.masked {
+		t.Fatalf("abandoned handler was not cancelled or its secrets were released early: %#v", s)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for Redact(testSecret) != testSecret {
+		select {
+		case <-timeout:
+			t.Fatalf("secret was not released after the handler returned")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
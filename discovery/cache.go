@@ -0,0 +1,229 @@
+package discovery
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/choria-io/go-external/internal/flock"
+)
+
+// CacheRetention is how long entries are kept after they were last updated, entries are kept for at least twice
+// the cache TTL so they can be used when discovery fails
+const CacheRetention = 24 * time.Hour
+
+// cacheFile matches the names of entries, their lock files and temporary files in the cache directory
+var cacheFile = regexp.MustCompile(`^[0-9a-f]{64}\.json(\.lock|\.[0-9]+)?$`)
+
+// cacheEntry is a discovery result stored in the cache directory
+type cacheEntry struct {
+	Time  time.Time `json:"time"`
+	Nodes []string  `json:"nodes"`
+}
+
+// SetCache enables caching discovery results in dir for ttl, results are keyed by the collective, filter and
+// options, the last good result is used when discovery fails and --do nocache=true bypasses the cache entirely
+func (d *Discovery) SetCache(dir string, ttl time.Duration) {
+	d.cacheDir = dir
+	d.cacheTTL = ttl
+}
+
+// discover calls the discovery function through the cache when it is enabled
+func (d *Discovery) discover(ctx context.Context, timeout time.Duration, collective string, filter Filter, options map[string]string) ([]string, error) {
+	if d.cacheDir == "" {
+		return d.f(ctx, timeout, collective, filter, options)
+	}
+
+	key, err := cacheKey(collective, filter, options)
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(d.cacheDir, key+".json")
+	bypass := isTruthy(options["nocache"])
+
+	cached := readCacheEntry(path)
+	if !bypass && cached.fresh(d.cacheTTL) {
+		return cached.Nodes, nil
+	}
+
+	err = os.MkdirAll(d.cacheDir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("could not create cache directory: %s", err)
+	}
+
+	// only one invocation queries the backend for a key, the others use its result
+	lock, err := flock.WaitLock(ctx, path+".lock", 50*time.Millisecond)
+	if err != nil {
+		if !bypass && cached != nil {
+			fmt.Fprintf(os.Stderr, "Could not lock the discovery cache, using the result from %s: %s\n", cached.Time.Format(time.RFC3339), err)
+			return cached.Nodes, nil
+		}
+
+		return nil, fmt.Errorf("could not lock discovery cache: %s", err)
+	}
+	defer lock.Unlock()
+
+	if !bypass {
+		if latest := readCacheEntry(path); latest.fresh(d.cacheTTL) {
+			return latest.Nodes, nil
+		} else if latest != nil {
+			cached = latest
+		}
+	}
+
+	nodes, err := d.f(ctx, timeout, collective, filter, options)
+	if err != nil {
+		if !bypass && cached != nil {
+			fmt.Fprintf(os.Stderr, "Discovery failed, using the result from %s: %s\n", cached.Time.Format(time.RFC3339), err)
+			return cached.Nodes, nil
+		}
+
+		return nil, err
+	}
+
+	err = writeCacheEntry(path, &cacheEntry{Time: time.Now(), Nodes: nodes})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not update the discovery cache: %s\n", err)
+	}
+
+	d.expireCache()
+
+	return nodes, nil
+}
+
+// expireCache removes entries and their lock files that were not updated within the retention period, at worst
+// an invocation waiting on a removed lock file queries the backend at the same time as another
+func (d *Discovery) expireCache() {
+	entries, err := ioutil.ReadDir(d.cacheDir)
+	if err != nil {
+		return
+	}
+
+	retention := CacheRetention
+	if 2*d.cacheTTL > retention {
+		retention = 2 * d.cacheTTL
+	}
+
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || !cacheFile.MatchString(entry.Name()) || time.Since(entry.ModTime()) < retention {
+			continue
+		}
+
+		os.Remove(filepath.Join(d.cacheDir, entry.Name()))
+	}
+}
+
+// cachedNodes is the last cached result for a request, used when discovery times out unless the cache is bypassed
+func (d *Discovery) cachedNodes(collective string, filter Filter, options map[string]string) *cacheEntry {
+	if d.cacheDir == "" || isTruthy(options["nocache"]) {
+		return nil
+	}
+
+	key, err := cacheKey(collective, filter, options)
+	if err != nil {
+		return nil
+	}
+
+	return readCacheEntry(filepath.Join(d.cacheDir, key+".json"))
+}
+
+func (e *cacheEntry) fresh(ttl time.Duration) bool {
+	return e != nil && time.Since(e.Time) < ttl
+}
+
+// cacheKey identifies a request, lists in the filter are sorted as their order does not change the result
+func cacheKey(collective string, filter Filter, options map[string]string) (string, error) {
+	normal := Filter{
+		Fact:     append([]FactFilter{}, filter.Fact...),
+		Class:    sortedCopy(filter.Class),
+		Agent:    sortedCopy(filter.Agent),
+		Identity: sortedCopy(filter.Identity),
+		Compound: filter.Compound,
+	}
+
+	sort.Slice(normal.Fact, func(i, j int) bool {
+		a, b := normal.Fact[i], normal.Fact[j]
+		return a.Fact+"\x00"+a.Operator+"\x00"+a.Value < b.Fact+"\x00"+b.Operator+"\x00"+b.Value
+	})
+
+	opts := make(map[string]string)
+	for k, v := range options {
+		if k != "nocache" {
+			opts[k] = v
+		}
+	}
+
+	kj, err := json.Marshal(map[string]interface{}{
+		"collective": collective,
+		"filter":     normal,
+		"options":    opts,
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not create cache key: %s", err)
+	}
+
+	sum := sha256.Sum256(kj)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func sortedCopy(s []string) []string {
+	if len(s) == 0 {
+		return []string{}
+	}
+
+	c := append([]string{}, s...)
+	sort.Strings(c)
+
+	return c
+}
+
+func readCacheEntry(path string) *cacheEntry {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	entry := &cacheEntry{}
+	if json.Unmarshal(data, entry) != nil || entry.Time.IsZero() {
+		return nil
+	}
+
+	return entry
+}
+
+// writeCacheEntry replaces the entry atomically so readers that do not lock never see partial entries
+func writeCacheEntry(path string, entry *cacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
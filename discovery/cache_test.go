@@ -0,0 +1,214 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDiscoveryCache(t *testing.T) {
+	var calls int32
+	var fail atomic.Value
+	fail.Store(false)
+
+	d := NewDiscovery(func(ctx context.Context, timeout time.Duration, collective string, filter Filter, options map[string]string) ([]string, error) {
+		n := atomic.AddInt32(&calls, 1)
+		if fail.Load().(bool) {
+			return nil, errors.New("cmdb unavailable")
+		}
+
+		if n > 1 {
+			return []string{"web1", "web2"}, nil
+		}
+
+		return []string{"web1"}, nil
+	})
+	d.SetCache(testDir(t), time.Hour)
+
+	discover := func(filter Filter, options map[string]string) []string {
+		t.Helper()
+
+		nodes, err := d.discover(context.Background(), time.Second, "mcollective", filter, options)
+		if err != nil {
+			t.Fatalf("discover failed: %s", err)
+		}
+
+		return nodes
+	}
+
+	filter := NewFilter().Class("apache", "roles::web").Identity("/web/").MustBuild()
+	reordered := NewFilter().Identity("/web/").Class("roles::web", "apache").MustBuild()
+
+	if nodes := discover(filter, nil); !reflect.DeepEqual(nodes, []string{"web1"}) || calls != 1 {
+		t.Fatalf("unexpected nodes %v after %d calls", nodes, calls)
+	}
+
+	if nodes := discover(reordered, map[string]string{}); !reflect.DeepEqual(nodes, []string{"web1"}) || calls != 1 {
+		t.Fatalf("cached result was not used: %v after %d calls", nodes, calls)
+	}
+
+	if nodes := discover(filter, map[string]string{"nocache": "true"}); !reflect.DeepEqual(nodes, []string{"web1", "web2"}) || calls != 2 {
+		t.Fatalf("cache was not bypassed: %v after %d calls", nodes, calls)
+	}
+
+	// the bypass refreshed the cache
+	if nodes := discover(filter, nil); !reflect.DeepEqual(nodes, []string{"web1", "web2"}) || calls != 2 {
+		t.Fatalf("cache was not refreshed: %v after %d calls", nodes, calls)
+	}
+
+	discover(filter, map[string]string{"site": "eu"})
+	discover(NewFilter().Class("apache").MustBuild(), nil)
+	if calls != 4 {
+		t.Fatalf("different requests shared a cache entry, %d calls", calls)
+	}
+
+	// stale results are served when the backend fails unless the cache is bypassed
+	fail.Store(true)
+	_, err := d.discover(context.Background(), time.Second, "mcollective", filter, map[string]string{"nocache": "true"})
+	if err == nil || err.Error() != "cmdb unavailable" || calls != 5 {
+		t.Fatalf("expected the backend error when bypassing the cache got %v after %d calls", err, calls)
+	}
+
+	ageCacheEntry(t, d, "mcollective", filter, nil, 2*time.Hour)
+	if nodes := discover(filter, nil); !reflect.DeepEqual(nodes, []string{"web1", "web2"}) || calls != 6 {
+		t.Fatalf("stale result was not used: %v after %d calls", nodes, calls)
+	}
+
+	_, err = d.discover(context.Background(), time.Second, "other", filter, nil)
+	if err == nil || err.Error() != "cmdb unavailable" {
+		t.Fatalf("expected the backend error without a cached result got %v", err)
+	}
+}
+
+// ageCacheEntry makes the cached result of a request older by age
+func ageCacheEntry(t *testing.T, d *Discovery, collective string, filter Filter, options map[string]string, age time.Duration) {
+	t.Helper()
+
+	key, err := cacheKey(collective, filter, options)
+	if err != nil {
+		t.Fatalf("could not create key: %s", err)
+	}
+
+	path := filepath.Join(d.cacheDir, key+".json")
+	entry := readCacheEntry(path)
+	if entry == nil {
+		t.Fatalf("no cache entry for %s", key)
+	}
+
+	entry.Time = entry.Time.Add(-age)
+	err = writeCacheEntry(path, entry)
+	if err != nil {
+		t.Fatalf("could not write cache entry: %s", err)
+	}
+
+	os.Chtimes(path, entry.Time, entry.Time)
+}
+
+func TestDiscoveryCacheExpire(t *testing.T) {
+	d := NewDiscovery(func(ctx context.Context, timeout time.Duration, collective string, filter Filter, options map[string]string) ([]string, error) {
+		return []string{"web1"}, nil
+	})
+	dir := testDir(t)
+	d.SetCache(dir, time.Minute)
+
+	unrelated := filepath.Join(dir, "notes.txt")
+	ioutil.WriteFile(unrelated, []byte("keep"), 0600)
+
+	for _, collective := range []string{"old", "recent"} {
+		_, err := d.discover(context.Background(), time.Second, collective, Filter{}, nil)
+		if err != nil {
+			t.Fatalf("discover failed: %s", err)
+		}
+	}
+
+	ageCacheEntry(t, d, "old", Filter{}, nil, CacheRetention+time.Hour)
+	ageCacheEntry(t, d, "recent", Filter{}, nil, CacheRetention-time.Hour)
+
+	key, _ := cacheKey("old", Filter{}, nil)
+	old := time.Now().Add(-CacheRetention - time.Hour)
+	os.Chtimes(unrelated, old, old)
+	os.Chtimes(filepath.Join(dir, key+".json.lock"), old, old)
+
+	_, err := d.discover(context.Background(), time.Second, "other", Filter{}, nil)
+	if err != nil {
+		t.Fatalf("discover failed: %s", err)
+	}
+
+	if d.cachedNodes("old", Filter{}, nil) != nil {
+		t.Fatalf("expired entry was not removed")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, key+".json.lock")); !os.IsNotExist(err) {
+		t.Fatalf("lock file of the expired entry was not removed")
+	}
+
+	if d.cachedNodes("recent", Filter{}, nil) == nil {
+		t.Fatalf("entry within the retention period was removed")
+	}
+
+	if _, err := os.Stat(unrelated); err != nil {
+		t.Fatalf("unrelated file was removed: %s", err)
+	}
+}
+
+func TestDiscoveryCacheTTL(t *testing.T) {
+	var calls int32
+
+	d := NewDiscovery(func(ctx context.Context, timeout time.Duration, collective string, filter Filter, options map[string]string) ([]string, error) {
+		atomic.AddInt32(&calls, 1)
+		return []string{"web1"}, nil
+	})
+	d.SetCache(testDir(t), 50*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		d.discover(context.Background(), time.Second, "", Filter{}, nil)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	d.discover(context.Background(), time.Second, "", Filter{}, nil)
+
+	if calls != 2 {
+		t.Fatalf("expected 2 calls got %d", calls)
+	}
+}
+
+func TestDiscoveryCacheStampede(t *testing.T) {
+	var calls int32
+	dir := testDir(t)
+
+	f := func(ctx context.Context, timeout time.Duration, collective string, filter Filter, options map[string]string) ([]string, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(100 * time.Millisecond)
+		return []string{"web1"}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// separate instances behave like separate invocations sharing the cache directory
+			d := NewDiscovery(f)
+			d.SetCache(dir, time.Hour)
+
+			nodes, err := d.discover(context.Background(), time.Second, "", Filter{}, nil)
+			if err != nil || !reflect.DeepEqual(nodes, []string{"web1"}) {
+				t.Errorf("unexpected nodes %v: %v", nodes, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("backend was queried %d times", calls)
+	}
+}
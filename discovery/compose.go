@@ -0,0 +1,282 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SetOperation is how the nodes of composed sources are combined
+type SetOperation string
+
+// FailurePolicy is how composed discovery handles failing sources
+type FailurePolicy string
+
+const (
+	// OpUnion finds nodes returned by any source
+	OpUnion = SetOperation("union")
+
+	// OpIntersection finds nodes returned by every source
+	OpIntersection = SetOperation("intersection")
+
+	// OpDifference finds nodes returned by the first source that no other source returned
+	OpDifference = SetOperation("difference")
+
+	// FailStrict fails discovery when any source fails
+	FailStrict = FailurePolicy("strict")
+
+	// FailPartial leaves out failed sources of an OpUnion and reports their errors, discovery fails when every
+	// source fails. Leaving out sources would widen intersections and differences so those fail when any source fails
+	FailPartial = FailurePolicy("partial")
+)
+
+// Source is a named discovery source used in a Composition
+type Source struct {
+	Name     string
+	Discover DiscoverFunc
+}
+
+// SourceError is the failure of a source in a Composition
+type SourceError struct {
+	Source string
+	Err    error
+}
+
+func (e *SourceError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Source, e.Err)
+}
+
+// CompositionError lists the sources that failed in a Composition
+type CompositionError struct {
+	Errors []*SourceError
+}
+
+func (e *CompositionError) Error() string {
+	errs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err.Error()
+	}
+
+	return fmt.Sprintf("discovery sources failed: %s", strings.Join(errs, ", "))
+}
+
+// Composition combines the nodes of several sources that are queried concurrently under the same context
+type Composition struct {
+	op      SetOperation
+	sources []Source
+	policy  FailurePolicy
+	onError func(source string, err error)
+}
+
+// Union combines sources finding nodes returned by any of them
+func Union(sources ...Source) *Composition {
+	return newComposition(OpUnion, sources)
+}
+
+// Intersection combines sources finding nodes returned by all of them
+func Intersection(sources ...Source) *Composition {
+	return newComposition(OpIntersection, sources)
+}
+
+// Difference finds nodes returned by base that none of the other sources returned
+func Difference(base Source, subtract ...Source) *Composition {
+	return newComposition(OpDifference, append([]Source{base}, subtract...))
+}
+
+func newComposition(op SetOperation, sources []Source) *Composition {
+	return &Composition{
+		op:      op,
+		sources: sources,
+		policy:  FailStrict,
+		onError: func(source string, err error) {
+			fmt.Fprintf(os.Stderr, "Discovery source %s failed: %s\n", source, err)
+		},
+	}
+}
+
+// SetFailurePolicy sets how failing sources are handled, the default is FailStrict
+func (c *Composition) SetFailurePolicy(policy FailurePolicy) {
+	c.policy = policy
+}
+
+// OnError sets the function notified about sources left out under FailPartial, by default they are written to STDERR
+func (c *Composition) OnError(f func(source string, err error)) {
+	c.onError = f
+}
+
+// Discover implements DiscoverFunc
+func (c *Composition) Discover(ctx context.Context, timeout time.Duration, collective string, filter Filter, options map[string]string) ([]string, error) {
+	if len(c.sources) == 0 {
+		return nil, fmt.Errorf("no discovery sources configured")
+	}
+
+	results := make([][]string, len(c.sources))
+	errs := make([]error, len(c.sources))
+	var wg sync.WaitGroup
+
+	for i, source := range c.sources {
+		wg.Add(1)
+		go func(i int, source Source) {
+			defer wg.Done()
+
+			// a panic would otherwise take down the whole discovery process
+			defer func() {
+				if p := recover(); p != nil {
+					results[i] = nil
+					errs[i] = fmt.Errorf("discovery panicked: %v", p)
+				}
+			}()
+
+			if source.Discover == nil {
+				errs[i] = fmt.Errorf("no discovery implementation function specified")
+				return
+			}
+
+			results[i], errs[i] = source.Discover(ctx, timeout, collective, filter, options)
+		}(i, source)
+	}
+
+	wg.Wait()
+
+	var failed []*SourceError
+	var sets []map[string]bool
+
+	for i, source := range c.sources {
+		if errs[i] != nil {
+			failed = append(failed, &SourceError{Source: source.Name, Err: errs[i]})
+			continue
+		}
+
+		set := make(map[string]bool, len(results[i]))
+		for _, node := range results[i] {
+			set[node] = true
+		}
+
+		sets = append(sets, set)
+	}
+
+	if len(failed) > 0 {
+		if c.policy != FailPartial || c.op != OpUnion || len(sets) == 0 {
+			return nil, &CompositionError{Errors: failed}
+		}
+
+		for _, f := range failed {
+			if c.onError != nil {
+				c.onError(f.Source, f.Err)
+			}
+		}
+	}
+
+	return combineSets(c.op, sets), nil
+}
+
+func combineSets(op SetOperation, sets []map[string]bool) []string {
+	found := []string{}
+	if len(sets) == 0 {
+		return found
+	}
+
+	switch op {
+	case OpIntersection:
+		for node := range sets[0] {
+			inAll := true
+			for _, set := range sets[1:] {
+				if !set[node] {
+					inAll = false
+					break
+				}
+			}
+
+			if inAll {
+				found = append(found, node)
+			}
+		}
+
+	case OpDifference:
+		for node := range sets[0] {
+			inOther := false
+			for _, set := range sets[1:] {
+				if set[node] {
+					inOther = true
+					break
+				}
+			}
+
+			if !inOther {
+				found = append(found, node)
+			}
+		}
+
+	default:
+		all := make(map[string]bool)
+		for _, set := range sets {
+			for node := range set {
+				all[node] = true
+			}
+		}
+
+		for node := range all {
+			found = append(found, node)
+		}
+	}
+
+	sort.Strings(found)
+
+	return found
+}
+
+// Compose creates a DiscoverFunc that combines the named sources as selected by the options so one binary can
+// serve several strategies, the sources option lists the sources to use in order and defaults to all of them,
+// combine is union, intersection or difference and on_error is strict or partial
+func Compose(sources map[string]DiscoverFunc) DiscoverFunc {
+	return func(ctx context.Context, timeout time.Duration, collective string, filter Filter, options map[string]string) ([]string, error) {
+		var selected []Source
+
+		if options["sources"] == "" {
+			names := make([]string, 0, len(sources))
+			for name := range sources {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				selected = append(selected, Source{Name: name, Discover: sources[name]})
+			}
+		} else {
+			for _, name := range strings.Split(options["sources"], ",") {
+				name = strings.TrimSpace(name)
+				f, ok := sources[name]
+				if !ok {
+					return nil, fmt.Errorf("unknown discovery source %s", name)
+				}
+
+				selected = append(selected, Source{Name: name, Discover: f})
+			}
+		}
+
+		var c *Composition
+
+		switch op := SetOperation(options["combine"]); op {
+		case "", OpUnion:
+			c = newComposition(OpUnion, selected)
+		case OpIntersection, OpDifference:
+			c = newComposition(op, selected)
+		default:
+			return nil, fmt.Errorf("unknown combine operation %s, valid operations are union, intersection and difference", op)
+		}
+
+		switch policy := FailurePolicy(options["on_error"]); policy {
+		case "":
+		case FailStrict, FailPartial:
+			c.SetFailurePolicy(policy)
+		default:
+			return nil, fmt.Errorf("unknown on_error policy %s, valid policies are strict and partial", policy)
+		}
+
+		return c.Discover(ctx, timeout, collective, filter, options)
+	}
+}
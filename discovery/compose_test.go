@@ -0,0 +1,178 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func staticSource(nodes ...string) DiscoverFunc {
+	return func(ctx context.Context, timeout time.Duration, collective string, filter Filter, options map[string]string) ([]string, error) {
+		return nodes, nil
+	}
+}
+
+func failingSource(msg string) DiscoverFunc {
+	return func(ctx context.Context, timeout time.Duration, collective string, filter Filter, options map[string]string) ([]string, error) {
+		return nil, errors.New(msg)
+	}
+}
+
+func TestComposition(t *testing.T) {
+	cmdb := Source{"cmdb", staticSource("web1", "web2", "db1")}
+	eu := Source{"eu", staticSource("web1", "db1", "mail1")}
+	maint := Source{"maintenance", staticSource("db1")}
+
+	cases := []struct {
+		c      *Composition
+		expect []string
+	}{
+		{Union(cmdb, eu), []string{"db1", "mail1", "web1", "web2"}},
+		{Intersection(cmdb, eu), []string{"db1", "web1"}},
+		{Intersection(cmdb, eu, maint), []string{"db1"}},
+		{Difference(cmdb, maint), []string{"web1", "web2"}},
+		{Difference(cmdb, eu, maint), []string{"web2"}},
+		{Union(Source{"empty", staticSource()}), []string{}},
+	}
+
+	for _, c := range cases {
+		found, err := c.c.Discover(context.Background(), time.Second, "", Filter{}, nil)
+		if err != nil {
+			t.Fatalf("discover failed: %s", err)
+		}
+
+		if !reflect.DeepEqual(found, c.expect) {
+			t.Fatalf("%s: expected %v got %v", c.c.op, c.expect, found)
+		}
+	}
+}
+
+func TestCompositionConcurrency(t *testing.T) {
+	started := make(chan struct{}, 2)
+	slow := func(ctx context.Context, timeout time.Duration, collective string, filter Filter, options map[string]string) ([]string, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := Union(Source{"a", slow}, Source{"b", slow}).Discover(ctx, time.Second, "", Filter{}, nil)
+	if time.Since(start) > time.Second || len(started) != 2 {
+		t.Fatalf("sources were not queried concurrently under the shared context")
+	}
+
+	cerr, ok := err.(*CompositionError)
+	if !ok || len(cerr.Errors) != 2 || cerr.Errors[0].Source != "a" || cerr.Errors[0].Err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestCompositionFailures(t *testing.T) {
+	good := Source{"good", staticSource("web1", "web2")}
+	bad := Source{"bad", failingSource("connection refused")}
+
+	_, err := Union(good, bad).Discover(context.Background(), time.Second, "", Filter{}, nil)
+	if err == nil || err.Error() != "discovery sources failed: bad: connection refused" {
+		t.Fatalf("strict composition did not fail: %v", err)
+	}
+
+	var reported []string
+	partial := func(c *Composition) *Composition {
+		c.SetFailurePolicy(FailPartial)
+		c.OnError(func(source string, err error) { reported = append(reported, source+": "+err.Error()) })
+		return c
+	}
+
+	found, err := partial(Union(good, bad)).Discover(context.Background(), time.Second, "", Filter{}, nil)
+	if err != nil || !reflect.DeepEqual(found, []string{"web1", "web2"}) {
+		t.Fatalf("partial union failed: %v: %v", found, err)
+	}
+
+	if !reflect.DeepEqual(reported, []string{"bad: connection refused"}) {
+		t.Fatalf("failure was not reported: %v", reported)
+	}
+
+	// leaving out a failed source would widen intersections and differences
+	for _, c := range []*Composition{partial(Difference(good, bad)), partial(Difference(bad, good)), partial(Intersection(good, bad)), partial(Union(bad, Source{"worse", failingSource("timeout")})), Union()} {
+		found, err = c.Discover(context.Background(), time.Second, "", Filter{}, nil)
+		if err == nil {
+			t.Fatalf("%s composition did not fail: %v", c.op, found)
+		}
+
+		if _, ok := err.(*CompositionError); !ok && len(c.sources) > 0 {
+			t.Fatalf("%s composition failed with %T", c.op, err)
+		}
+	}
+}
+
+func TestCompositionPanic(t *testing.T) {
+	good := Source{"good", staticSource("web1", "web2")}
+	crash := Source{"crash", func(ctx context.Context, timeout time.Duration, collective string, filter Filter, options map[string]string) ([]string, error) {
+		panic("nil map")
+	}}
+
+	_, err := Union(good, crash).Discover(context.Background(), time.Second, "", Filter{}, nil)
+	cerr, ok := err.(*CompositionError)
+	if !ok || len(cerr.Errors) != 1 || cerr.Errors[0].Source != "crash" || cerr.Errors[0].Error() != "crash: discovery panicked: nil map" {
+		t.Fatalf("panic was not reported as a source error: %v", err)
+	}
+
+	c := Union(good, crash)
+	c.SetFailurePolicy(FailPartial)
+	c.OnError(func(source string, err error) {})
+
+	found, err := c.Discover(context.Background(), time.Second, "", Filter{}, nil)
+	if err != nil || !reflect.DeepEqual(found, []string{"web1", "web2"}) {
+		t.Fatalf("partial union did not leave out the panicking source: %v: %v", found, err)
+	}
+}
+
+func TestCompose(t *testing.T) {
+	f := Compose(map[string]DiscoverFunc{
+		"cmdb":        staticSource("web1", "web2", "db1"),
+		"maintenance": staticSource("db1"),
+		"broken":      failingSource("unavailable"),
+	})
+
+	cases := []struct {
+		options map[string]string
+		expect  []string
+	}{
+		{map[string]string{"sources": "cmdb,maintenance"}, []string{"db1", "web1", "web2"}},
+		{map[string]string{"sources": "cmdb, maintenance", "combine": "difference"}, []string{"web1", "web2"}},
+		{map[string]string{"sources": "maintenance,cmdb", "combine": "intersection"}, []string{"db1"}},
+		{map[string]string{"on_error": "partial"}, []string{"db1", "web1", "web2"}},
+	}
+
+	for _, c := range cases {
+		found, err := f(context.Background(), time.Second, "", Filter{}, c.options)
+		if err != nil {
+			t.Fatalf("%v: discover failed: %s", c.options, err)
+		}
+
+		if !reflect.DeepEqual(found, c.expect) {
+			t.Fatalf("%v: expected %v got %v", c.options, c.expect, found)
+		}
+	}
+
+	for _, c := range []struct {
+		options map[string]string
+		msg     string
+	}{
+		{map[string]string{}, "broken: unavailable"},
+		{map[string]string{"sources": "cmdb,other"}, "unknown discovery source other"},
+		{map[string]string{"combine": "xor"}, "unknown combine operation xor"},
+		{map[string]string{"on_error": "ignore"}, "unknown on_error policy ignore"},
+	} {
+		_, err := f(context.Background(), time.Second, "", Filter{}, c.options)
+		if err == nil || !strings.Contains(err.Error(), c.msg) {
+			t.Fatalf("%v: expected error %q got %v", c.options, c.msg, err)
+		}
+	}
+}
@@ -0,0 +1,606 @@
+package discovery
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// SyntaxError is a compound filter expression that could not be parsed
+type SyntaxError struct {
+	Expression string
+	Position   int
+	Message    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at position %d in %q: %s", e.Position, e.Expression, e.Message)
+}
+
+// Expression is a parsed compound filter expression
+//
+// Expressions combine statements using and, or, not (also &&, || and !) and parentheses. Statements are:
+//
+//   - a fact comparison like os.family=RedHat, memory>=4096 or role=~/^web/
+//   - a class name or /regex/, matching nodes that have the class
+//   - class('x'), agent('x') and identity('x') matching the name or /regex/ x
+//   - with('x') matching a class or agent named x, or a fact comparison like with('os=linux')
+//   - fact('x') comparisons like fact('os.family') == 'RedHat', or fact('x') alone when the fact exists
+type Expression struct {
+	source string
+	root   exprNode
+}
+
+// ParseExpression parses a compound filter expression
+func ParseExpression(expr string) (*Expression, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{source: expr, tokens: tokens}
+
+	if p.peek().kind == tokenEOF {
+		return nil, p.errorf(p.peek(), "empty expression")
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+
+	return &Expression{source: expr, root: root}, nil
+}
+
+// Match determines if the node matches the expression
+func (e *Expression) Match(node *Node) bool {
+	if node == nil {
+		return false
+	}
+
+	return e.root.eval(node)
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+// compoundExpression is the expression text of a compound filter, either the expr of the current Choria format
+// or the statements and operators of the older token list format
+func compoundExpression(items []map[string]string) (string, error) {
+	var exprs []string
+	var statements []string
+
+	for _, item := range items {
+		keys := make([]string, 0, len(item))
+		for k := range item {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			switch k {
+			case "expr":
+				exprs = append(exprs, item[k])
+			case "statement":
+				statements = append(statements, item[k])
+			case "and", "or", "not", "(", ")":
+				statements = append(statements, k)
+			case "fstatement":
+				return "", fmt.Errorf("data plugin statements are not supported in compound filters")
+			default:
+				return "", fmt.Errorf("unknown compound filter item %q", k)
+			}
+		}
+	}
+
+	switch {
+	case len(exprs) > 0 && len(statements) > 0:
+		return "", fmt.Errorf("compound filter mixes expressions and statements")
+	case len(exprs) == 1:
+		return exprs[0], nil
+	case len(exprs) > 1:
+		return "(" + strings.Join(exprs, ") and (") + ")", nil
+	default:
+		return strings.Join(statements, " "), nil
+	}
+}
+
+type exprNode interface {
+	eval(node *Node) bool
+}
+
+type andNode struct {
+	left  exprNode
+	right exprNode
+}
+
+func (n *andNode) eval(node *Node) bool {
+	return n.left.eval(node) && n.right.eval(node)
+}
+
+type orNode struct {
+	left  exprNode
+	right exprNode
+}
+
+func (n *orNode) eval(node *Node) bool {
+	return n.left.eval(node) || n.right.eval(node)
+}
+
+type notNode struct {
+	expr exprNode
+}
+
+func (n *notNode) eval(node *Node) bool {
+	return !n.expr.eval(node)
+}
+
+type factNode struct {
+	fact     string
+	operator string
+	value    string
+	re       *regexp.Regexp
+}
+
+func (n *factNode) eval(node *Node) bool {
+	fact, ok := lookupFact(node.Facts, n.fact)
+	if !ok {
+		return false
+	}
+
+	return compareFact(fact, n.operator, n.value, n.re)
+}
+
+type factExistsNode struct {
+	fact string
+}
+
+func (n *factExistsNode) eval(node *Node) bool {
+	_, ok := lookupFact(node.Facts, n.fact)
+	return ok
+}
+
+const (
+	memberClass = iota
+	memberAgent
+	memberIdentity
+	memberWith
+)
+
+type memberNode struct {
+	kind    int
+	pattern string
+	re      *regexp.Regexp
+}
+
+func (n *memberNode) eval(node *Node) bool {
+	switch n.kind {
+	case memberIdentity:
+		return n.match(node.Identity)
+	case memberAgent:
+		return n.matchAny(node.Agents)
+	case memberWith:
+		return n.matchAny(node.Classes) || n.matchAny(node.Agents)
+	default:
+		return n.matchAny(node.Classes)
+	}
+}
+
+func (n *memberNode) match(value string) bool {
+	return n.pattern == value || n.re != nil && n.re.MatchString(value)
+}
+
+func (n *memberNode) matchAny(values []string) bool {
+	for _, v := range values {
+		if n.match(v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+const (
+	tokenEOF = iota
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenOperator
+	tokenString
+	tokenRegex
+	tokenWord
+)
+
+type token struct {
+	kind  int
+	text  string
+	value string
+	pos   int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+
+	return fmt.Sprintf("'%s'", t.text)
+}
+
+// wordBreaks end a word, words include everything else so names like roles::web or web-1.example.net need no quoting
+const wordBreaks = " \t\r\n()',\"=!<>&|"
+
+func lex(src string) ([]token, error) {
+	var tokens []token
+
+	syntaxError := func(pos int, format string, a ...interface{}) error {
+		return &SyntaxError{Expression: src, Position: pos + 1, Message: fmt.Sprintf(format, a...)}
+	}
+
+	add := func(kind int, start int, end int, value string) {
+		tokens = append(tokens, token{kind: kind, text: src[start:end], value: value, pos: start})
+	}
+
+	// word adds the word starting at i and returns where it ends
+	word := func(i int) int {
+		end := i
+		for end < len(src) && strings.IndexByte(wordBreaks, src[end]) < 0 {
+			end++
+		}
+
+		word := src[i:end]
+		switch strings.ToLower(word) {
+		case "and":
+			add(tokenAnd, i, end, word)
+		case "or":
+			add(tokenOr, i, end, word)
+		case "not":
+			add(tokenNot, i, end, word)
+		default:
+			add(tokenWord, i, end, word)
+		}
+
+		return end
+	}
+
+	for i := 0; i < len(src); {
+		c := src[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+
+		case c == '(':
+			add(tokenLParen, i, i+1, "(")
+			i++
+
+		case c == ')':
+			add(tokenRParen, i, i+1, ")")
+			i++
+
+		case c == ',':
+			add(tokenComma, i, i+1, ",")
+			i++
+
+		case c == '&' || c == '|':
+			if i+1 >= len(src) || src[i+1] != c {
+				return nil, syntaxError(i, "unexpected '%c', use %c%c", c, c, c)
+			}
+
+			kind := tokenAnd
+			if c == '|' {
+				kind = tokenOr
+			}
+			add(kind, i, i+2, src[i:i+2])
+			i += 2
+
+		case c == '!' && (i+1 >= len(src) || src[i+1] != '='):
+			add(tokenNot, i, i+1, "!")
+			i++
+
+		case strings.IndexByte("=!<>", c) >= 0:
+			end := i + 1
+			if end < len(src) && (src[end] == '=' || c == '=' && src[end] == '~') {
+				end++
+			}
+			add(tokenOperator, i, end, src[i:end])
+			i = end
+
+		case c == '\'' || c == '"':
+			var value strings.Builder
+			end := -1
+
+			for j := i + 1; j < len(src); j++ {
+				if src[j] == '\\' && j+1 < len(src) && (src[j+1] == c || src[j+1] == '\\') {
+					value.WriteByte(src[j+1])
+					j++
+					continue
+				}
+
+				if src[j] == c {
+					end = j + 1
+					break
+				}
+
+				value.WriteByte(src[j])
+			}
+
+			if end < 0 {
+				return nil, syntaxError(i, "unterminated string")
+			}
+
+			add(tokenString, i, end, value.String())
+			i = end
+
+		case c == '/':
+			end := regexEnd(src, i)
+
+			// values starting with / like mount=/var are words unless they are a /regex/ given to an equality operator,
+			// =~ always takes a regex
+			if last := len(tokens) - 1; last >= 0 && tokens[last].kind == tokenOperator && tokens[last].value != "=~" {
+				op := tokens[last].value
+				delimited := end >= 0 && (end == len(src) || strings.IndexByte(wordBreaks, src[end]) >= 0)
+
+				if (op != "=" && op != "==") || !delimited {
+					i = word(i)
+					continue
+				}
+			}
+
+			if end < 0 {
+				return nil, syntaxError(i, "unterminated regular expression")
+			}
+
+			add(tokenRegex, i, end, src[i:end])
+			i = end
+
+		default:
+			i = word(i)
+		}
+	}
+
+	tokens = append(tokens, token{kind: tokenEOF, pos: len(src)})
+
+	return tokens, nil
+}
+
+// regexEnd finds the end of the /regex/ starting at i, -1 when it is not terminated
+func regexEnd(src string, i int) int {
+	for j := i + 1; j < len(src); j++ {
+		if src[j] == '\\' {
+			j++
+			continue
+		}
+
+		if src[j] == '/' {
+			return j + 1
+		}
+	}
+
+	return -1
+}
+
+type parser struct {
+	source string
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+func (p *parser) errorf(t token, format string, a ...interface{}) error {
+	return &SyntaxError{Expression: p.source, Position: t.pos + 1, Message: fmt.Sprintf(format, a...)}
+}
+
+func (p *parser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == tokenOr {
+		p.next()
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &orNode{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == tokenAnd {
+		p.next()
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &andNode{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseUnary() (exprNode, error) {
+	if p.peek().kind == tokenNot {
+		p.next()
+
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &notNode{expr: expr}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (exprNode, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokenLParen:
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if closing := p.peek(); closing.kind != tokenRParen {
+			return nil, p.errorf(closing, "expected ')' to close the '(' at position %d but found %s", t.pos+1, closing)
+		}
+		p.next()
+
+		return expr, nil
+
+	case tokenRegex:
+		return p.member(memberClass, t)
+
+	case tokenWord, tokenString:
+		if t.kind == tokenWord && p.peek().kind == tokenLParen {
+			return p.parseCall(t)
+		}
+
+		if p.peek().kind == tokenOperator {
+			return p.parseComparison(t)
+		}
+
+		return p.member(memberClass, t)
+
+	case tokenEOF:
+		return nil, p.errorf(t, "unexpected end of expression")
+
+	default:
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+}
+
+// parseComparison parses the operator and value of a fact comparison
+func (p *parser) parseComparison(fact token) (exprNode, error) {
+	op := p.next()
+
+	value := p.next()
+	if value.kind != tokenWord && value.kind != tokenString && value.kind != tokenRegex {
+		return nil, p.errorf(value, "expected a value after %s but found %s", op, value)
+	}
+
+	operator := op.value
+	if operator == "=" {
+		operator = "=="
+	}
+
+	if operator == "==" && value.kind == tokenRegex {
+		operator = "=~"
+	}
+
+	if !validFactOperator(operator) {
+		return nil, p.errorf(op, "invalid operator %s", op)
+	}
+
+	node := &factNode{fact: fact.value, operator: operator, value: value.value}
+
+	if operator == "=~" {
+		re, err := compileRegex(value.value, true)
+		if err != nil {
+			return nil, p.errorf(value, "%s", err)
+		}
+		node.re = re
+	}
+
+	return node, nil
+}
+
+func (p *parser) parseCall(name token) (exprNode, error) {
+	p.next()
+
+	arg := p.next()
+	if arg.kind != tokenWord && arg.kind != tokenString && arg.kind != tokenRegex {
+		return nil, p.errorf(arg, "expected an argument to %s() but found %s", name.value, arg)
+	}
+
+	if closing := p.next(); closing.kind != tokenRParen {
+		return nil, p.errorf(closing, "%s() takes one argument, expected ')' but found %s", name.value, closing)
+	}
+
+	switch strings.ToLower(name.value) {
+	case "class":
+		return p.member(memberClass, arg)
+
+	case "agent":
+		return p.member(memberAgent, arg)
+
+	case "identity":
+		return p.member(memberIdentity, arg)
+
+	case "with":
+		if arg.kind != tokenRegex {
+			if ff, err := ParseFactFilter(arg.value); err == nil {
+				node := &factNode{fact: ff.Fact, operator: ff.Operator, value: ff.Value}
+				if ff.Operator == "=~" {
+					node.re, err = compileRegex(ff.Value, true)
+					if err != nil {
+						return nil, p.errorf(arg, "%s", err)
+					}
+				}
+
+				return node, nil
+			}
+		}
+
+		return p.member(memberWith, arg)
+
+	case "fact":
+		if p.peek().kind == tokenOperator {
+			return p.parseComparison(arg)
+		}
+
+		return &factExistsNode{fact: arg.value}, nil
+
+	default:
+		return nil, p.errorf(name, "unknown function %s()", name.value)
+	}
+}
+
+func (p *parser) member(kind int, t token) (exprNode, error) {
+	node := &memberNode{kind: kind, pattern: t.value}
+
+	if isRegex(t.value) {
+		re, err := compileRegex(t.value, false)
+		if err != nil {
+			return nil, p.errorf(t, "%s", err)
+		}
+		node.re = re
+	}
+
+	return node, nil
+}
@@ -0,0 +1,149 @@
+package discovery
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpression(t *testing.T) {
+	nodes := testNodes(t)
+
+	cases := []struct {
+		expr   string
+		expect []string
+	}{
+		{"apache", []string{"web1.example.net"}},
+		{"/^roles::/", []string{"db1.example.net", "web1.example.net", "web2.example.net"}},
+		{"apache or mysql", []string{"db1.example.net", "web1.example.net"}},
+		{"roles::web and not apache", []string{"web2.example.net"}},
+		{"roles::web && !apache", []string{"web2.example.net"}},
+		{"nginx || mysql", []string{"db1.example.net", "web2.example.net"}},
+		{"os.family=RedHat", []string{"db1.example.net", "web1.example.net"}},
+		{"os.family = redhat and memory > 8192", []string{"db1.example.net"}},
+		{"role=/^w/", []string{"web1.example.net", "web2.example.net"}},
+		{"role =~ 'D'", []string{"db1.example.net"}},
+		{"(role=web or role=db) and not virtual=true", []string{"db1.example.net", "web2.example.net"}},
+		{"role=web or role=db and virtual=true", []string{"web1.example.net", "web2.example.net"}},
+		{"not (apache or nginx)", []string{"db1.example.net"}},
+		{"NOT apache AND NOT nginx", []string{"db1.example.net"}},
+		{"agent('package')", []string{"web2.example.net"}},
+		{"agent(/^pupp/) and class('apache')", []string{"web1.example.net"}},
+		{"identity(/^web/) and not identity('web1.example.net')", []string{"web2.example.net"}},
+		{"with('puppet') and with('nginx')", []string{"web2.example.net"}},
+		{"with('os.family=Debian')", []string{"web2.example.net"}},
+		{"fact('os.release.major') == '8'", []string{"db1.example.net"}},
+		{"fact(\"memory\") <= 4096", []string{"web1.example.net"}},
+		{"fact('os.name')", []string{"db1.example.net"}},
+		{"fact('missing') != 'x'", []string{}},
+		{"mount=/var", []string{"web1.example.net"}},
+		{"mount == /var/lib and role=db", []string{"db1.example.net"}},
+		{"mount != /var", []string{"db1.example.net"}},
+		{"(mount=/var)", []string{"web1.example.net"}},
+		{"mount=/^\\/var$/", []string{"web1.example.net"}},
+		{"mount=/lib/ or role=web", []string{"db1.example.net", "web1.example.net", "web2.example.net"}},
+		{"mount='/lib/'", []string{}},
+		{"fact('mount') == /var/lib", []string{"db1.example.net"}},
+	}
+
+	for _, c := range cases {
+		expr, err := ParseExpression(c.expr)
+		if err != nil {
+			t.Fatalf("%q: parse failed: %s", c.expr, err)
+		}
+
+		found := []string{}
+		for _, node := range nodes {
+			if expr.Match(node) {
+				found = append(found, node.Identity)
+			}
+		}
+
+		m, err := NewMatcher(Filter{Compound: [][]map[string]string{{{"expr": c.expr}}}})
+		if err != nil {
+			t.Fatalf("%q: could not create matcher: %s", c.expr, err)
+		}
+
+		expect := append([]string{}, c.expect...)
+		if !reflect.DeepEqual(m.Filter(nodes), expect) {
+			t.Fatalf("%q: matcher expected %v got %v", c.expr, expect, m.Filter(nodes))
+		}
+
+		if len(found) != len(expect) {
+			t.Fatalf("%q: expected %v got %v", c.expr, expect, found)
+		}
+	}
+}
+
+func TestExpressionSyntaxErrors(t *testing.T) {
+	cases := []struct {
+		expr     string
+		position int
+		message  string
+	}{
+		{"", 1, "empty expression"},
+		{"apache and", 11, "unexpected end of expression"},
+		{"(apache or nginx", 17, "expected ')' to close the '(' at position 1"},
+		{"apache nginx", 8, "unexpected 'nginx'"},
+		{"apache & nginx", 8, "unexpected '&'"},
+		{"role='web", 6, "unterminated string"},
+		{"/web", 1, "unterminated regular expression"},
+		{"role=~/web", 7, "unterminated regular expression"},
+		{"role=~/[/", 7, "invalid regular expression"},
+		{"role= and x", 7, "expected a value after '='"},
+		{"lookup('x')", 1, "unknown function lookup()"},
+		{"class('a', 'b')", 10, "takes one argument"},
+		{"role => x", 7, "expected a value after '=' but found '>'"},
+		{"apache or )", 11, "unexpected ')'"},
+	}
+
+	for _, c := range cases {
+		_, err := ParseExpression(c.expr)
+		serr, ok := err.(*SyntaxError)
+		if !ok {
+			t.Fatalf("%q: expected a syntax error got %v", c.expr, err)
+		}
+
+		if serr.Position != c.position || !strings.Contains(serr.Message, c.message) {
+			t.Fatalf("%q: expected %q at %d got %q at %d", c.expr, c.message, c.position, serr.Message, serr.Position)
+		}
+	}
+}
+
+func TestCompoundStatements(t *testing.T) {
+	nodes := testNodes(t)
+
+	filter := Filter{
+		Agent: []string{"rpcutil"},
+		Compound: [][]map[string]string{
+			{{"(": "("}, {"statement": "apache"}, {"or": "or"}, {"statement": "role=db"}, {")": ")"}, {"and": "and"}, {"not": "not"}, {"statement": "virtual=true"}},
+		},
+	}
+
+	found, err := MatchNodes(filter, nodes)
+	if err != nil {
+		t.Fatalf("match failed: %s", err)
+	}
+
+	if !reflect.DeepEqual(found, []string{"db1.example.net"}) {
+		t.Fatalf("unexpected nodes %v", found)
+	}
+
+	// every compound filter has to match
+	filter.Compound = [][]map[string]string{{{"expr": "roles::web"}}, {{"expr": "with('package')"}}}
+	found, _ = MatchNodes(filter, nodes)
+	if !reflect.DeepEqual(found, []string{"web2.example.net"}) {
+		t.Fatalf("unexpected nodes %v", found)
+	}
+
+	for _, compound := range [][]map[string]string{
+		{{"fstatement": "sysctl('x').value=1"}},
+		{{"expr": "apache"}, {"statement": "nginx"}},
+		{{"expr": "apache and"}},
+	} {
+		_, err = NewMatcher(Filter{Compound: [][]map[string]string{compound}})
+		if err == nil {
+			t.Fatalf("invalid compound %v was accepted", compound)
+		}
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"time"
+
+	"github.com/choria-io/go-external/schemas"
+	"github.com/choria-io/go-external/transport"
 )
 
 // DiscoverFunc implements aan external query interface
@@ -30,14 +32,17 @@ type Filter struct {
 
 // Response is the expected response from the external script on its STDOUT
 type Response struct {
-	Protocol string   `json:"protocol"`
-	Nodes    []string `json:"nodes"`
-	Error    string   `json:"error"`
+	Protocol  string   `json:"protocol"`
+	RequestID string   `json:"requestid,omitempty"`
+	Nodes     []string `json:"nodes"`
+	Error     string   `json:"error"`
 }
 
 // Request is the request sent to the external script on its STDIN
 type Request struct {
 	Protocol   string            `json:"protocol"`
+	RequestID  string            `json:"requestid,omitempty"`
+	CallerID   string            `json:"callerid,omitempty"`
 	Options    map[string]string `json:"options"`
 	Timeout    float64           `json:"timeout"`
 	Collective string            `json:"collective"`
@@ -52,7 +57,13 @@ const (
 )
 
 type Discovery struct {
-	f DiscoverFunc
+	f           DiscoverFunc
+	transport   transport.Transport
+	validation  schemas.Mode
+	metricsPath string
+	cacheDir    string
+	cacheTTL    time.Duration
+	partial     bool
 }
 
 // NewDiscovery creates a new external discovery source
@@ -62,27 +73,75 @@ func NewDiscovery(f DiscoverFunc) *Discovery {
 	}
 }
 
-func (d *Discovery) processRequest() (*Response, error) {
-	if d.f == nil {
-		return nil, fmt.Errorf("no discovery implementation function specified")
+// SetTransport sets the transport used to read requests and write replies, by default the transport is
+// selected using the CHORIA_EXTERNAL_TRANSPORT environment variable
+func (d *Discovery) SetTransport(t transport.Transport) {
+	d.transport = t
+}
+
+// SetSchemaValidation sets how requests and responses are checked against the protocol JSON schemas
+func (d *Discovery) SetSchemaValidation(mode schemas.Mode) {
+	d.validation = mode
+}
+
+// validateDocument checks the JSON document doc against schema, failures are logged in warn mode and
+// returned in strict mode
+func (d *Discovery) validateDocument(schema string, doc []byte) error {
+	if d.validation == "" || d.validation == schemas.Off {
+		return nil
+	}
+
+	err := schemas.Validate(schema, doc)
+	if err == nil {
+		return nil
+	}
+
+	if d.validation == schemas.Warn {
+		fmt.Fprintf(os.Stderr, "Schema validation failed: %s\n", err)
+		return nil
+	}
+
+	return err
+}
+
+func (d *Discovery) getTransport() (transport.Transport, error) {
+	if d.transport != nil {
+		return d.transport, nil
 	}
 
-	rj, err := ioutil.ReadFile(os.Getenv("CHORIA_EXTERNAL_REQUEST"))
+	return transport.FromEnvironment()
+}
+
+func (d *Discovery) readRequest(t transport.Transport, p *protocol) (*Request, error) {
+	rj, err := t.ReadRequest()
 	if err != nil {
-		return nil, fmt.Errorf("could not read request from CHORIA_EXTERNAL_REQUEST file")
+		return nil, err
 	}
 
-	var req Request
-	err = json.Unmarshal(rj, &req)
+	err = d.validateDocument(p.requestSchema, rj)
 	if err != nil {
-		return nil, fmt.Errorf("could not parse JSON request from CHORIA_EXTERNAL_REQUEST file")
+		return nil, fmt.Errorf("invalid request: %s", err)
+	}
+
+	return p.decodeRequest(rj)
+}
+
+func (d *Discovery) processRequest(req *Request) (*Response, error) {
+	if d.f == nil {
+		return nil, fmt.Errorf("no discovery implementation function specified")
 	}
 
-	to := time.Duration(req.Timeout) * time.Second
-	timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Duration(req.Timeout)*time.Second)
-	defer cancel()
+	to := time.Duration(req.Timeout * float64(time.Second))
+	if to <= 0 {
+		to = DefaultTimeout
+	}
+
+	filter := Filter{}
+	if req.Filter != nil {
+		filter = *req.Filter
+	}
 
-	nodes, err := d.f(timeoutCtx, to, req.Collective, *req.Filter, req.Options)
+	nodes, err := d.supervise(to, req.Collective, filter, req.Options)
 	if err != nil {
 		return nil, err
 	}
@@ -96,32 +155,47 @@ func (d *Discovery) processRequest() (*Response, error) {
 
 func (d *Discovery) ProcessRequest() {
 	protocol := os.Getenv("CHORIA_EXTERNAL_PROTOCOL")
+	p, found := protocolByName(protocol)
 
 	switch {
-	case protocol == RequestProtocol:
-		reply, err := d.processRequest()
+	case found:
+		t, err := d.getTransport()
+		if err != nil {
+			panic(fmt.Errorf("could not create transport: %s", err))
+		}
+
+		start := time.Now()
+
+		var reply *Response
+		req, err := d.readRequest(t, p)
+		if err == nil {
+			reply, err = d.processRequest(req)
+		}
 		if err != nil {
 			reply = &Response{Error: err.Error()}
 		}
 
-		reply.Protocol = ResponseProtocol
+		d.recordRequest(reply, time.Since(start))
 
-		rj, err := json.Marshal(&reply)
+		rj, err := json.Marshal(p.encodeResponse(req, reply))
 		if err != nil {
 			panic(fmt.Errorf("could not encode reply: %s", err))
 		}
 
-		stat, err := os.Stat(os.Getenv("CHORIA_EXTERNAL_REPLY"))
+		err = d.validateDocument(p.responseSchema, rj)
 		if err != nil {
-			panic(fmt.Errorf("could not read reply file from CHORIA_EXTERNAL_REPLY: %s", err))
+			rj, err = json.Marshal(p.encodeResponse(req, &Response{Error: fmt.Sprintf("invalid response: %s", err)}))
+			if err != nil {
+				panic(fmt.Errorf("could not encode reply: %s", err))
+			}
 		}
 
-		err = ioutil.WriteFile(os.Getenv("CHORIA_EXTERNAL_REPLY"), rj, stat.Mode())
+		err = t.WriteReply(rj)
 		if err != nil {
-			panic(fmt.Errorf("could not write reply file from CHORIA_EXTERNAL_REPLY: %s", err))
+			panic(fmt.Errorf("could not write reply: %s", err))
 		}
 
-	case os.Getenv("CHORIA_EXTERNAL_PROTOCOL") == "" || os.Getenv("CHORIA_EXTERNAL_REPLY") == "" || os.Getenv("CHORIA_EXTERNAL_REQUEST") == "":
+	case os.Getenv("CHORIA_EXTERNAL_PROTOCOL") == "" || os.Getenv("CHORIA_EXTERNAL_TRANSPORT") == "" && (os.Getenv("CHORIA_EXTERNAL_REPLY") == "" || os.Getenv("CHORIA_EXTERNAL_REQUEST") == ""):
 		fmt.Println("This binary is a Plugin for the Choria Orchestrator and should only be called from within Choria")
 		fmt.Println()
 		fmt.Fprintf(os.Stderr, "Invalid environment")
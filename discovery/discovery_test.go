@@ -1,14 +1,20 @@
 package discovery
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/choria-io/go-external/schemas"
+	"github.com/choria-io/go-external/transport"
 )
 
 func cleanEnv() {
@@ -129,3 +135,131 @@ func TestDiscover(t *testing.T) {
 		t.Fatalf("incorrect nodes received")
 	}
 }
+
+func TestDiscoverStdioTransport(t *testing.T) {
+	cleanEnv()
+	defer cleanEnv()
+
+	rj, err := json.Marshal(newRequest())
+	if err != nil {
+		t.Fatalf("marshal failed: %s", err)
+	}
+
+	out := &bytes.Buffer{}
+	os.Setenv("CHORIA_EXTERNAL_PROTOCOL", RequestProtocol)
+
+	d := NewDiscovery(func(ctx context.Context, timeout time.Duration, collective string, filter Filter, opt map[string]string) ([]string, error) {
+		return []string{"one"}, nil
+	})
+	d.SetTransport(&transport.Stdio{In: bytes.NewReader(rj), Out: out})
+	d.ProcessRequest()
+
+	var reply Response
+	err = json.Unmarshal(out.Bytes(), &reply)
+	if err != nil {
+		t.Fatalf("could not parse reply: %s", err)
+	}
+
+	if !reflect.DeepEqual(reply.Nodes, []string{"one"}) {
+		t.Fatalf("incorrect nodes received: %v", reply.Nodes)
+	}
+}
+
+func TestDiscoverProtocolV2(t *testing.T) {
+	cleanEnv()
+	defer cleanEnv()
+
+	req := newRequest()
+	req.Protocol = RequestProtocolV2
+	req.RequestID = "034c527089f746248822ada8a145f499"
+
+	reqfile, repfile := setupExecution(t, req)
+	defer os.Remove(reqfile.Name())
+	defer os.Remove(repfile.Name())
+	os.Setenv("CHORIA_EXTERNAL_PROTOCOL", RequestProtocolV2)
+
+	d := NewDiscovery(func(ctx context.Context, timeout time.Duration, collective string, filter Filter, opt map[string]string) ([]string, error) {
+		return []string{"one"}, nil
+	})
+	d.ProcessRequest()
+
+	reply := readResponse(t, repfile.Name())
+	if reply.Protocol != ResponseProtocolV2 || reply.RequestID != req.RequestID {
+		t.Fatalf("reply was not in version 2 format: %#v", reply)
+	}
+
+	if !reflect.DeepEqual(reply.Nodes, []string{"one"}) {
+		t.Fatalf("incorrect nodes received: %v", reply.Nodes)
+	}
+}
+
+func TestDiscoverSchemaValidation(t *testing.T) {
+	cleanEnv()
+	defer cleanEnv()
+
+	req := newRequest()
+	req.Filter.Fact = []FactFilter{{Fact: "country", Operator: "~", Value: "mt"}}
+
+	reqfile, repfile := setupExecution(t, req)
+	defer os.Remove(reqfile.Name())
+	defer os.Remove(repfile.Name())
+
+	called := false
+	d := NewDiscovery(func(ctx context.Context, timeout time.Duration, collective string, filter Filter, opt map[string]string) ([]string, error) {
+		called = true
+		return []string{"one"}, nil
+	})
+	d.SetSchemaValidation(schemas.Strict)
+	d.ProcessRequest()
+
+	reply := readResponse(t, repfile.Name())
+	if called || !strings.Contains(reply.Error, "filter.fact[0].operator") {
+		t.Fatalf("invalid request was processed: %#v", reply)
+	}
+
+	d.SetSchemaValidation(schemas.Warn)
+	d.ProcessRequest()
+
+	reply = readResponse(t, repfile.Name())
+	if !called || reply.Error != "" || !reflect.DeepEqual(reply.Nodes, []string{"one"}) {
+		t.Fatalf("invalid request was not processed in warn mode: %#v", reply)
+	}
+}
+
+func TestDiscoverMetrics(t *testing.T) {
+	cleanEnv()
+	defer cleanEnv()
+
+	reqfile, repfile := setupExecution(t, newRequest())
+	defer os.Remove(reqfile.Name())
+	defer os.Remove(repfile.Name())
+
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := NewDiscovery(func(ctx context.Context, timeout time.Duration, collective string, filter Filter, opt map[string]string) ([]string, error) {
+		return []string{"one", "two"}, nil
+	})
+	d.SetMetricsFile(filepath.Join(dir, "discovery.prom"))
+	d.ProcessRequest()
+
+	tf, err := ioutil.ReadFile(filepath.Join(dir, "discovery.prom"))
+	if err != nil {
+		t.Fatalf("could not read metrics: %s", err)
+	}
+
+	name := filepath.Base(os.Args[0])
+	for _, expected := range []string{
+		fmt.Sprintf(`choria_external_discovery_requests_total{discovery=%q,status="ok"} 1`, name),
+		fmt.Sprintf(`choria_external_discovery_nodes_bucket{discovery=%q,le="1"} 0`, name),
+		fmt.Sprintf(`choria_external_discovery_nodes_sum{discovery=%q} 2`, name),
+		fmt.Sprintf(`choria_external_discovery_duration_seconds_count{discovery=%q} 1`, name),
+	} {
+		if !strings.Contains(string(tf), expected+"\n") {
+			t.Fatalf("metrics did not include %s:\n%s", expected, tf)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	factFileSuffix    = ".json"
+	classesFileSuffix = ".classes"
+	agentsFileSuffix  = ".agents"
+)
+
+// MalformedFilesError lists the files in a fact directory that could not be parsed
+type MalformedFilesError struct {
+	Files map[string]error
+}
+
+func (e *MalformedFilesError) Error() string {
+	names := make([]string, 0, len(e.Files))
+	for name := range e.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	errs := make([]string, len(names))
+	for i, name := range names {
+		errs[i] = fmt.Sprintf("%s: %s", name, e.Files[name])
+	}
+
+	return fmt.Sprintf("%d malformed fact files: %s", len(names), strings.Join(errs, ", "))
+}
+
+// FactDirectory discovers nodes from a directory holding a <identity>.json facts file per node, classes and
+// agents are read from optional <identity>.classes and <identity>.agents files listing one per line
+type FactDirectory struct {
+	dir         string
+	cachePath   string
+	concurrency int
+}
+
+// factCacheEntry is the parsed content of a file in the fact directory
+type factCacheEntry struct {
+	ModTime int64                  `json:"mtime"`
+	Size    int64                  `json:"size"`
+	Facts   map[string]interface{} `json:"facts,omitempty"`
+	Lines   []string               `json:"lines,omitempty"`
+}
+
+// NewFactDirectory creates a source for the fact files in dir, parsed files are cached in the user cache directory
+func NewFactDirectory(dir string) *FactDirectory {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		abs = dir
+	}
+	sum := sha256.Sum256([]byte(abs))
+
+	return &FactDirectory{
+		dir:         dir,
+		cachePath:   filepath.Join(cacheDir, "choria-external", "facts-"+hex.EncodeToString(sum[:8])+".json"),
+		concurrency: runtime.NumCPU(),
+	}
+}
+
+// SetCacheFile sets where parsed files are cached between invocations, an empty path disables the cache
+func (d *FactDirectory) SetCacheFile(path string) {
+	d.cachePath = path
+}
+
+// SetConcurrency sets how many files are parsed at the same time
+func (d *FactDirectory) SetConcurrency(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	d.concurrency = workers
+}
+
+// Discover implements DiscoverFunc, nodes are in every collective
+func (d *FactDirectory) Discover(ctx context.Context, _ time.Duration, _ string, filter Filter, _ map[string]string) ([]string, error) {
+	m, err := NewMatcher(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := d.Nodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.Filter(nodes), nil
+}
+
+// Nodes reads the node records from the directory, a *MalformedFilesError is returned when any files could not be parsed
+func (d *FactDirectory) Nodes(ctx context.Context) ([]*Node, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read fact directory: %s", err)
+	}
+
+	cache := d.readCache()
+	current := make(map[string]*factCacheEntry)
+	var stale []os.FileInfo
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !isFactDirFile(name) {
+			continue
+		}
+
+		cached, ok := cache[name]
+		if ok && cached.ModTime == entry.ModTime().UnixNano() && cached.Size == entry.Size() {
+			current[name] = cached
+			continue
+		}
+
+		stale = append(stale, entry)
+	}
+
+	parsed, err := d.parseFiles(ctx, stale)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, entry := range parsed {
+		current[name] = entry
+	}
+
+	if len(parsed) > 0 || len(current) != len(cache) {
+		d.writeCache(current)
+	}
+
+	var nodes []*Node
+	for name, entry := range current {
+		if !strings.HasSuffix(name, factFileSuffix) {
+			continue
+		}
+
+		identity := strings.TrimSuffix(name, factFileSuffix)
+		node := &Node{Identity: identity, Facts: entry.Facts}
+
+		if classes, ok := current[identity+classesFileSuffix]; ok {
+			node.Classes = classes.Lines
+		}
+
+		if agents, ok := current[identity+agentsFileSuffix]; ok {
+			node.Agents = agents.Lines
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Identity < nodes[j].Identity })
+
+	return nodes, nil
+}
+
+func isFactDirFile(name string) bool {
+	for _, suffix := range []string{factFileSuffix, classesFileSuffix, agentsFileSuffix} {
+		if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseFiles parses files using a bounded number of workers, stopping when ctx is done
+func (d *FactDirectory) parseFiles(ctx context.Context, files []os.FileInfo) (map[string]*factCacheEntry, error) {
+	parsed := make(map[string]*factCacheEntry)
+	if len(files) == 0 {
+		return parsed, nil
+	}
+
+	workers := d.concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan os.FileInfo)
+	malformed := make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for file := range jobs {
+				entry, err := parseFactDirFile(filepath.Join(d.dir, file.Name()))
+
+				mu.Lock()
+				if err != nil {
+					malformed[file.Name()] = err
+				} else {
+					entry.ModTime = file.ModTime().UnixNano()
+					entry.Size = file.Size()
+					parsed[file.Name()] = entry
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var cancelled error
+
+feed:
+	for _, file := range files {
+		select {
+		case jobs <- file:
+		case <-ctx.Done():
+			cancelled = ctx.Err()
+			break feed
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	if cancelled != nil {
+		return nil, cancelled
+	}
+
+	if len(malformed) > 0 {
+		return nil, &MalformedFilesError{Files: malformed}
+	}
+
+	return parsed, nil
+}
+
+func parseFactDirFile(path string) (*factCacheEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &factCacheEntry{}
+
+	if strings.HasSuffix(path, factFileSuffix) {
+		err = json.Unmarshal(data, &entry.Facts)
+		if err != nil {
+			return nil, err
+		}
+
+		if entry.Facts == nil {
+			return nil, fmt.Errorf("facts are not a JSON object")
+		}
+
+		return entry, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		entry.Lines = append(entry.Lines, line)
+	}
+
+	return entry, scanner.Err()
+}
+
+func (d *FactDirectory) readCache() map[string]*factCacheEntry {
+	cache := make(map[string]*factCacheEntry)
+	if d.cachePath == "" {
+		return cache
+	}
+
+	data, err := ioutil.ReadFile(d.cachePath)
+	if err != nil {
+		return cache
+	}
+
+	// a damaged cache is rebuilt from the files
+	if json.Unmarshal(data, &cache) != nil {
+		return make(map[string]*factCacheEntry)
+	}
+
+	return cache
+}
+
+// writeCache replaces the cache file atomically so concurrent invocations always read a complete cache
+func (d *FactDirectory) writeCache(cache map[string]*factCacheEntry) {
+	if d.cachePath == "" {
+		return
+	}
+
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(d.cachePath), 0700)
+	if err != nil {
+		return
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(d.cachePath), filepath.Base(d.cachePath)+".*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return
+	}
+
+	if tmp.Close() != nil {
+		return
+	}
+
+	os.Rename(tmp.Name(), d.cachePath)
+}
@@ -0,0 +1,185 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFactDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := testDir(t)
+	for name, content := range files {
+		writeInventory(t, dir, name, content)
+	}
+
+	return dir
+}
+
+func TestFactDirectory(t *testing.T) {
+	dir := writeFactDir(t, map[string]string{
+		"web1.example.net.json":     `{"os": {"family": "RedHat"}, "role": "web"}`,
+		"web1.example.net.classes":  "# puppet classes\napache\nroles::web\n",
+		"web1.example.net.agents":   "rpcutil\npuppet\n",
+		"db1.example.net.json":      `{"os": {"family": "Debian"}, "role": "db"}`,
+		"db1.example.net.classes":   "mysql\n",
+		"orphan.example.net.agents": "rpcutil\n",
+		".hidden.json":              `broken`,
+		"README.md":                 "not facts",
+	})
+
+	fd := NewFactDirectory(dir)
+	fd.SetCacheFile(filepath.Join(testDir(t), "cache.json"))
+
+	nodes, err := fd.Nodes(context.Background())
+	if err != nil {
+		t.Fatalf("reading nodes failed: %s", err)
+	}
+
+	expect := []*Node{
+		{Identity: "db1.example.net", Facts: map[string]interface{}{"os": map[string]interface{}{"family": "Debian"}, "role": "db"}, Classes: []string{"mysql"}},
+		{Identity: "web1.example.net", Facts: map[string]interface{}{"os": map[string]interface{}{"family": "RedHat"}, "role": "web"}, Classes: []string{"apache", "roles::web"}, Agents: []string{"rpcutil", "puppet"}},
+	}
+
+	if !reflect.DeepEqual(nodes, expect) {
+		t.Fatalf("unexpected nodes %#v", nodes)
+	}
+
+	for filter, expect := range map[string][]string{
+		"":                          {"db1.example.net", "web1.example.net"},
+		"-F os.family=RedHat":       {"web1.example.net"},
+		"-C mysql":                  {"db1.example.net"},
+		"-A puppet -C /^roles::/":   {"web1.example.net"},
+		"-S 'not with(\"apache\")'": {"db1.example.net"},
+	} {
+		f, err := ParseFilter(filter)
+		if err != nil {
+			t.Fatalf("invalid filter %q: %s", filter, err)
+		}
+
+		found, err := fd.Discover(context.Background(), time.Second, "mcollective", f, nil)
+		if err != nil {
+			t.Fatalf("discover failed: %s", err)
+		}
+
+		if !reflect.DeepEqual(found, expect) {
+			t.Fatalf("%q: expected %v got %v", filter, expect, found)
+		}
+	}
+}
+
+func TestFactDirectoryCache(t *testing.T) {
+	dir := writeFactDir(t, map[string]string{
+		"web1.example.net.json": `{"role": "web"}`,
+		"db1.example.net.json":  `{"role": "db"}`,
+	})
+
+	cacheFile := filepath.Join(testDir(t), "cache", "facts.json")
+
+	fd := NewFactDirectory(dir)
+	fd.SetCacheFile(cacheFile)
+
+	_, err := fd.Nodes(context.Background())
+	if err != nil {
+		t.Fatalf("reading nodes failed: %s", err)
+	}
+
+	cache := map[string]*factCacheEntry{}
+	data, err := ioutil.ReadFile(cacheFile)
+	if err != nil {
+		t.Fatalf("cache was not written: %s", err)
+	}
+
+	err = json.Unmarshal(data, &cache)
+	if err != nil || len(cache) != 2 {
+		t.Fatalf("unexpected cache %s: %v", data, err)
+	}
+
+	// unchanged files are not parsed again so the cached facts are returned
+	cache["web1.example.net.json"].Facts["role"] = "cached"
+	data, _ = json.Marshal(cache)
+	ioutil.WriteFile(cacheFile, data, 0600)
+
+	fd = NewFactDirectory(dir)
+	fd.SetCacheFile(cacheFile)
+
+	found, err := fd.Discover(context.Background(), time.Second, "", NewFilter().FactString("role=cached").MustBuild(), nil)
+	if err != nil || !reflect.DeepEqual(found, []string{"web1.example.net"}) {
+		t.Fatalf("cache was not used: %v: %v", found, err)
+	}
+
+	// changed files are parsed again
+	writeInventory(t, dir, "web1.example.net.json", `{"role": "changed"}`)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "web1.example.net.json"), future, future)
+
+	found, err = fd.Discover(context.Background(), time.Second, "", NewFilter().FactString("role=changed").MustBuild(), nil)
+	if err != nil || !reflect.DeepEqual(found, []string{"web1.example.net"}) {
+		t.Fatalf("changed file was not parsed: %v: %v", found, err)
+	}
+
+	// a damaged cache is ignored
+	ioutil.WriteFile(cacheFile, []byte("{"), 0600)
+	nodes, err := fd.Nodes(context.Background())
+	if err != nil || len(nodes) != 2 {
+		t.Fatalf("damaged cache was not rebuilt: %v", err)
+	}
+}
+
+func TestFactDirectoryMalformed(t *testing.T) {
+	dir := writeFactDir(t, map[string]string{
+		"web1.example.net.json": `{"role": "web"}`,
+		"web2.example.net.json": `{"role": `,
+		"web3.example.net.json": `["web"]`,
+	})
+
+	fd := NewFactDirectory(dir)
+	fd.SetCacheFile("")
+	fd.SetConcurrency(1)
+
+	_, err := fd.Nodes(context.Background())
+	merr, ok := err.(*MalformedFilesError)
+	if !ok {
+		t.Fatalf("expected a malformed files error got %v", err)
+	}
+
+	if len(merr.Files) != 2 || merr.Files["web2.example.net.json"] == nil || merr.Files["web3.example.net.json"] == nil {
+		t.Fatalf("unexpected malformed files %v", merr.Files)
+	}
+
+	if !strings.HasPrefix(err.Error(), "2 malformed fact files: web2.example.net.json: ") {
+		t.Fatalf("unexpected error %q", err)
+	}
+}
+
+func TestFactDirectoryContext(t *testing.T) {
+	files := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		files[fmt.Sprintf("node%d.json", i)] = `{"role": "web"}`
+	}
+
+	fd := NewFactDirectory(writeFactDir(t, files))
+	fd.SetCacheFile("")
+	fd.SetConcurrency(4)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := fd.Discover(ctx, time.Second, "", Filter{}, nil)
+	if err != context.Canceled {
+		t.Fatalf("expected a canceled error got %v", err)
+	}
+
+	nodes, err := fd.Nodes(context.Background())
+	if err != nil || len(nodes) != 100 {
+		t.Fatalf("expected 100 nodes got %d: %v", len(nodes), err)
+	}
+}
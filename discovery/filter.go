@@ -0,0 +1,287 @@
+package discovery
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FilterBuilder creates a Filter, errors in any of the parts are returned by Build
+type FilterBuilder struct {
+	filter Filter
+	err    error
+}
+
+// NewFilter starts building a Filter
+func NewFilter() *FilterBuilder {
+	return &FilterBuilder{}
+}
+
+// Fact adds a fact filter like Fact("os.family", "==", "RedHat")
+func (b *FilterBuilder) Fact(fact string, operator string, value string) *FilterBuilder {
+	b.filter.Fact = append(b.filter.Fact, FactFilter{Fact: fact, Operator: operator, Value: value})
+	return b
+}
+
+// FactString adds fact filters given as strings like os.family=RedHat
+func (b *FilterBuilder) FactString(filters ...string) *FilterBuilder {
+	for _, f := range filters {
+		ff, err := ParseFactFilter(f)
+		if err != nil {
+			b.fail(err)
+			continue
+		}
+
+		b.filter.Fact = append(b.filter.Fact, ff)
+	}
+
+	return b
+}
+
+// Class adds class filters, names or /regex/
+func (b *FilterBuilder) Class(classes ...string) *FilterBuilder {
+	b.filter.Class = append(b.filter.Class, classes...)
+	return b
+}
+
+// Agent adds agent filters, names or /regex/
+func (b *FilterBuilder) Agent(agents ...string) *FilterBuilder {
+	b.filter.Agent = append(b.filter.Agent, agents...)
+	return b
+}
+
+// Identity adds identity filters, names or /regex/
+func (b *FilterBuilder) Identity(identities ...string) *FilterBuilder {
+	b.filter.Identity = append(b.filter.Identity, identities...)
+	return b
+}
+
+// With adds fact filters for items like os=linux and class filters for all other items, like the -W CLI option
+func (b *FilterBuilder) With(items ...string) *FilterBuilder {
+	for _, item := range items {
+		if ff, err := ParseFactFilter(item); err == nil {
+			b.filter.Fact = append(b.filter.Fact, ff)
+			continue
+		}
+
+		b.filter.Class = append(b.filter.Class, item)
+	}
+
+	return b
+}
+
+// Compound adds a compound filter expression, see ParseExpression
+func (b *FilterBuilder) Compound(expr string) *FilterBuilder {
+	b.filter.Compound = append(b.filter.Compound, []map[string]string{{"expr": expr}})
+	return b
+}
+
+func (b *FilterBuilder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Build validates and returns the Filter
+func (b *FilterBuilder) Build() (Filter, error) {
+	if b.err != nil {
+		return Filter{}, b.err
+	}
+
+	_, err := NewMatcher(b.filter)
+	if err != nil {
+		return Filter{}, err
+	}
+
+	return b.filter, nil
+}
+
+// MustBuild returns the Filter and panics if it is not valid
+func (b *FilterBuilder) MustBuild() Filter {
+	f, err := b.Build()
+	if err != nil {
+		panic(err)
+	}
+
+	return f
+}
+
+// ParseFilter parses filter options in the Choria CLI syntax like -F os=linux -C apache -I /web\d+/ -A puppet,
+// values with spaces can be quoted using single or double quotes
+func ParseFilter(args string) (Filter, error) {
+	words, err := splitArgs(args)
+	if err != nil {
+		return Filter{}, err
+	}
+
+	return ParseFilterArgs(words)
+}
+
+// ParseFilterArgs parses filter options in the Choria CLI syntax that were already split into arguments,
+// -F, -C, -A, -I, -W and -S are supported in their short and long forms
+func ParseFilterArgs(args []string) (Filter, error) {
+	b := NewFilter()
+
+	for i := 0; i < len(args); i++ {
+		flag := args[i]
+		value := ""
+		hasValue := false
+
+		if strings.HasPrefix(flag, "--") && strings.Contains(flag, "=") {
+			parts := strings.SplitN(flag, "=", 2)
+			flag, value, hasValue = parts[0], parts[1], true
+		}
+
+		if !hasValue {
+			if i+1 >= len(args) {
+				return Filter{}, fmt.Errorf("%s requires a value", flag)
+			}
+
+			i++
+			value = args[i]
+		}
+
+		switch flag {
+		case "-F", "--wf", "--with-fact":
+			b.FactString(value)
+		case "-C", "--wc", "--with-class":
+			b.Class(value)
+		case "-A", "--wa", "--with-agent":
+			b.Agent(value)
+		case "-I", "--wi", "--with-identity":
+			b.Identity(value)
+		case "-W", "--with":
+			b.With(strings.Fields(value)...)
+		case "-S", "--select":
+			b.Compound(value)
+		default:
+			return Filter{}, fmt.Errorf("unknown filter option %s", flag)
+		}
+	}
+
+	return b.Build()
+}
+
+// String formats the filter in the Choria CLI syntax accepted by ParseFilter
+func (f Filter) String() string {
+	var args []string
+
+	for _, ff := range f.Fact {
+		operator := ff.Operator
+		if operator == "==" && !isRegex(ff.Value) {
+			operator = "="
+		}
+		args = append(args, "-F", quoteArg(ff.Fact+operator+ff.Value))
+	}
+
+	for _, c := range f.Class {
+		args = append(args, "-C", quoteArg(c))
+	}
+
+	for _, a := range f.Agent {
+		args = append(args, "-A", quoteArg(a))
+	}
+
+	for _, i := range f.Identity {
+		args = append(args, "-I", quoteArg(i))
+	}
+
+	for _, items := range f.Compound {
+		expr, err := compoundExpression(items)
+		if err != nil || expr == "" {
+			continue
+		}
+		args = append(args, "-S", quoteArg(expr))
+	}
+
+	return strings.Join(args, " ")
+}
+
+// splitArgs splits a command line like a shell does for quoted words, backslashes only escape quotes, spaces
+// and backslashes so regular expressions like /web\d+/ need no quoting
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inWord := false
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inWord {
+				args = append(args, current.String())
+				current.Reset()
+				inWord = false
+			}
+
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote at position %d", i+1)
+			}
+			current.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+
+		case c == '"':
+			closed := false
+			for i++; i < len(s); i++ {
+				if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+					i++
+					current.WriteByte(s[i])
+					continue
+				}
+
+				if s[i] == '"' {
+					closed = true
+					break
+				}
+
+				current.WriteByte(s[i])
+			}
+
+			if !closed {
+				return nil, fmt.Errorf("unterminated quote in %q", s)
+			}
+			inWord = true
+
+		case c == '\\' && i+1 < len(s) && isEscapable(s[i+1]):
+			i++
+			current.WriteByte(s[i])
+			inWord = true
+
+		default:
+			current.WriteByte(c)
+			inWord = true
+		}
+	}
+
+	if inWord {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
+
+func isEscapable(c byte) bool {
+	return strings.IndexByte(" \t\n\r'\"\\", c) >= 0
+}
+
+// quoteArg quotes s for splitArgs when needed
+func quoteArg(s string) string {
+	needsQuotes := s == ""
+	for i := 0; i < len(s) && !needsQuotes; i++ {
+		switch {
+		case s[i] == '\'' || s[i] == '"' || s[i] == ' ' || s[i] == '\t' || s[i] == '\n' || s[i] == '\r':
+			needsQuotes = true
+		case s[i] == '\\' && (i+1 == len(s) || isEscapable(s[i+1])):
+			needsQuotes = true
+		}
+	}
+
+	if !needsQuotes {
+		return s
+	}
+
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,125 @@
+package discovery
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFilterBuilder(t *testing.T) {
+	f, err := NewFilter().
+		Fact("os.family", "==", "RedHat").
+		FactString("memory>=4096", "role=/^web/").
+		Class("apache", "/roles::/").
+		Agent("puppet").
+		Identity("/web\\d+/").
+		With("country=mt", "nginx").
+		Compound("with('rpcutil')").
+		Build()
+	if err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	expect := Filter{
+		Fact: []FactFilter{
+			{"os.family", "==", "RedHat"},
+			{"memory", ">=", "4096"},
+			{"role", "=~", "/^web/"},
+			{"country", "==", "mt"},
+		},
+		Class:    []string{"apache", "/roles::/", "nginx"},
+		Agent:    []string{"puppet"},
+		Identity: []string{"/web\\d+/"},
+		Compound: [][]map[string]string{{{"expr": "with('rpcutil')"}}},
+	}
+
+	if !reflect.DeepEqual(f, expect) {
+		t.Fatalf("unexpected filter %#v", f)
+	}
+
+	for _, b := range []*FilterBuilder{
+		NewFilter().Fact("os", "~", "linux"),
+		NewFilter().FactString("os"),
+		NewFilter().Class("/[/"),
+		NewFilter().Compound("apache and"),
+	} {
+		_, err = b.Build()
+		if err == nil {
+			t.Fatalf("invalid filter was built: %#v", b.filter)
+		}
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	f, err := ParseFilter(`-F os=linux -C apache -I /web\d+/ -A puppet --wf "memory >= 4096" --with-class=/^roles::/ -W 'country=mt nginx' -S "apache and not fact('virtual') == 'true'" --wi web1.example.net`)
+	if err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
+
+	expect := Filter{
+		Fact: []FactFilter{
+			{"os", "==", "linux"},
+			{"memory", ">=", "4096"},
+			{"country", "==", "mt"},
+		},
+		Class:    []string{"apache", "/^roles::/", "nginx"},
+		Agent:    []string{"puppet"},
+		Identity: []string{"/web\\d+/", "web1.example.net"},
+		Compound: [][]map[string]string{{{"expr": "apache and not fact('virtual') == 'true'"}}},
+	}
+
+	if !reflect.DeepEqual(f, expect) {
+		t.Fatalf("unexpected filter %#v", f)
+	}
+
+	empty, err := ParseFilter("")
+	if err != nil || !reflect.DeepEqual(empty, Filter{}) {
+		t.Fatalf("unexpected empty filter %#v: %v", empty, err)
+	}
+
+	for args, msg := range map[string]string{
+		"-F os~linux":           "invalid fact filter",
+		"-F os=~/[/":            "invalid regular expression",
+		"-I /web(/":             "invalid regular expression",
+		"-C":                    "-C requires a value",
+		"-X foo":                "unknown filter option -X",
+		"-C 'apache":            "unterminated quote",
+		"-S \"apache and\"":     "syntax error",
+		"-F 'os=linux' extra":   "extra requires a value",
+		"--with-fact=os>":       "invalid fact filter",
+		"-W \"os=~/[/ apache\"": "invalid regular expression",
+	} {
+		_, err = ParseFilter(args)
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Fatalf("%s: expected error %q got %v", args, msg, err)
+		}
+	}
+}
+
+func TestFilterString(t *testing.T) {
+	for _, args := range []string{
+		`-F os=linux -C apache -A puppet -I /web\d+/`,
+		`-F os==/^linux/ -F role=~/^web/ -F memory<=4096 -F 'motd=it'\''s a "node"' -S 'apache or nginx'`,
+		`-C 'name with spaces' -I 'trailing\'`,
+		``,
+	} {
+		f, err := ParseFilter(args)
+		if err != nil {
+			t.Fatalf("%s: parse failed: %s", args, err)
+		}
+
+		if f.String() != args {
+			t.Fatalf("expected %q got %q", args, f.String())
+		}
+
+		again, err := ParseFilter(f.String())
+		if err != nil || !reflect.DeepEqual(again, f) {
+			t.Fatalf("%s: did not round trip: %#v %v", args, again, err)
+		}
+	}
+
+	legacy := Filter{Compound: [][]map[string]string{{{"statement": "apache"}, {"and": "and"}, {"statement": "os=linux"}}}}
+	if legacy.String() != `-S 'apache and os=linux'` {
+		t.Fatalf("unexpected legacy compound format %q", legacy.String())
+	}
+}
@@ -0,0 +1,341 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxHTTPResponseSize is the largest response read from HTTP inventories and PuppetDB, larger responses fail discovery
+const MaxHTTPResponseSize = 64 << 20
+
+// httpOptions are the options that configure the HTTP client, they are not sent to the inventory
+var httpOptions = []string{"url", "token", "token_file", "tls_ca", "tls_cert", "tls_key", "tls_insecure"}
+
+// HTTPInventory discovers nodes using a HTTP JSON inventory service
+//
+// GET requests pass the collective and filter as query parameters collective, identity, class, agent, fact and
+// compound while POST requests send a JSON body with the collective, filter and options. The url, token, token_file,
+// tls_ca, tls_cert, tls_key and tls_insecure options configure the request
+type HTTPInventory struct {
+	url          string
+	method       string
+	identityPath string
+	headers      map[string]string
+	client       *http.Client
+}
+
+// NewHTTPInventory creates a source that sends GET requests to url and expects a JSON list of identities
+func NewHTTPInventory(url string) *HTTPInventory {
+	return &HTTPInventory{
+		url:     url,
+		method:  http.MethodGet,
+		headers: make(map[string]string),
+	}
+}
+
+// SetMethod sets the HTTP method, GET sends the filter as query parameters and POST as a JSON body
+func (h *HTTPInventory) SetMethod(method string) error {
+	method = strings.ToUpper(method)
+	if method != http.MethodGet && method != http.MethodPost {
+		return fmt.Errorf("unsupported method %s", method)
+	}
+
+	h.method = method
+
+	return nil
+}
+
+// SetIdentityPath sets where the identities are found in the response, keys are separated by dots, * selects
+// all items of a list or object and numbers select list items, for example data.nodes.*.name
+func (h *HTTPInventory) SetIdentityPath(path string) {
+	h.identityPath = path
+}
+
+// SetHeader sets a header sent with every request
+func (h *HTTPInventory) SetHeader(name string, value string) {
+	h.headers[name] = value
+}
+
+// SetHTTPClient sets the client used when the options have no TLS settings
+func (h *HTTPInventory) SetHTTPClient(client *http.Client) {
+	h.client = client
+}
+
+// Discover implements DiscoverFunc, the request is cancelled when ctx is done
+func (h *HTTPInventory) Discover(ctx context.Context, _ time.Duration, collective string, filter Filter, options map[string]string) ([]string, error) {
+	req, err := h.newRequest(ctx, collective, filter, options)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := optionsHTTPClient(options, h.client)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("inventory request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := readResponseBody(resp)
+	if err != nil {
+		return nil, fmt.Errorf("could not read inventory response: %s", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := strings.TrimSpace(string(body))
+		if len(msg) > 256 {
+			msg = msg[:256]
+		}
+
+		return nil, fmt.Errorf("inventory request failed: %s: %s", resp.Status, msg)
+	}
+
+	var doc interface{}
+	err = json.Unmarshal(body, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse inventory response: %s", err)
+	}
+
+	return jsonPathStrings(doc, h.identityPath)
+}
+
+func (h *HTTPInventory) newRequest(ctx context.Context, collective string, filter Filter, options map[string]string) (*http.Request, error) {
+	target := h.url
+	if options["url"] != "" {
+		target = options["url"]
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid inventory url: %s", err)
+	}
+
+	var body io.Reader
+
+	switch h.method {
+	case http.MethodPost:
+		bj, err := json.Marshal(map[string]interface{}{
+			"collective": collective,
+			"filter":     filter,
+			"options":    inventoryOptions(options),
+		})
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(bj)
+
+	default:
+		q := u.Query()
+		if collective != "" {
+			q.Set("collective", collective)
+		}
+		for _, f := range filter.Fact {
+			q.Add("fact", f.Fact+f.Operator+f.Value)
+		}
+		for _, c := range filter.Class {
+			q.Add("class", c)
+		}
+		for _, a := range filter.Agent {
+			q.Add("agent", a)
+		}
+		for _, i := range filter.Identity {
+			q.Add("identity", i)
+		}
+		for _, items := range filter.Compound {
+			expr, err := compoundExpression(items)
+			if err != nil {
+				return nil, err
+			}
+			if expr != "" {
+				q.Add("compound", expr)
+			}
+		}
+		u.RawQuery = q.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, h.method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	for k, v := range h.headers {
+		req.Header.Set(k, v)
+	}
+
+	err = setBearerToken(req, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// setBearerToken adds the token or the content of token_file from options as a bearer token
+func setBearerToken(req *http.Request, options map[string]string) error {
+	token := options["token"]
+	if options["token_file"] != "" {
+		tj, err := ioutil.ReadFile(options["token_file"])
+		if err != nil {
+			return fmt.Errorf("could not read token: %s", err)
+		}
+		token = strings.TrimSpace(string(tj))
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return nil
+}
+
+// inventoryOptions are the options sent to the inventory, without the ones configuring the client
+func inventoryOptions(options map[string]string) map[string]string {
+	result := make(map[string]string)
+
+	for k, v := range options {
+		result[k] = v
+	}
+
+	for _, k := range httpOptions {
+		delete(result, k)
+	}
+
+	return result
+}
+
+// optionsHTTPClient creates a client using the TLS settings in options, fallback or the default client is used
+// when there are none
+func optionsHTTPClient(options map[string]string, fallback *http.Client) (*http.Client, error) {
+	if options["tls_ca"] == "" && options["tls_cert"] == "" && options["tls_key"] == "" && options["tls_insecure"] == "" {
+		if fallback != nil {
+			return fallback, nil
+		}
+
+		return http.DefaultClient, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if options["tls_ca"] != "" {
+		pem, err := ioutil.ReadFile(options["tls_ca"])
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA: %s", err)
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA %s", options["tls_ca"])
+		}
+	}
+
+	if options["tls_cert"] != "" || options["tls_key"] != "" {
+		cert, err := tls.LoadX509KeyPair(options["tls_cert"], options["tls_key"])
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %s", err)
+		}
+
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	cfg.InsecureSkipVerify = isTruthy(options["tls_insecure"])
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// jsonPathStrings finds the strings at path in a parsed JSON document, see SetIdentityPath
+func jsonPathStrings(doc interface{}, path string) ([]string, error) {
+	values := []interface{}{doc}
+
+	if path != "" {
+		for _, key := range strings.Split(path, ".") {
+			var next []interface{}
+
+			for _, v := range values {
+				switch node := v.(type) {
+				case map[string]interface{}:
+					if key == "*" {
+						for _, item := range node {
+							next = append(next, item)
+						}
+					} else if item, ok := node[key]; ok {
+						next = append(next, item)
+					}
+
+				case []interface{}:
+					if key == "*" {
+						next = append(next, node...)
+						continue
+					}
+
+					idx, err := strconv.Atoi(key)
+					if err != nil {
+						return nil, fmt.Errorf("identity path %s: %s is a list, use * or an index to select its items", path, key)
+					}
+					if idx >= 0 && idx < len(node) {
+						next = append(next, node[idx])
+					}
+				}
+			}
+
+			values = next
+		}
+	}
+
+	// a list at the end of the path holds the identities
+	if len(values) == 1 {
+		if list, ok := values[0].([]interface{}); ok {
+			values = list
+		}
+	}
+
+	identities := []string{}
+	for _, v := range values {
+		id, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("identity path %q selects a %T, expected strings", path, v)
+		}
+
+		identities = append(identities, id)
+	}
+
+	sort.Strings(identities)
+
+	return identities, nil
+}
+
+// readResponseBody reads the body of a response up to MaxHTTPResponseSize
+func readResponseBody(resp *http.Response) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxHTTPResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > MaxHTTPResponseSize {
+		return nil, fmt.Errorf("response exceeds %d bytes", MaxHTTPResponseSize)
+	}
+
+	return body, nil
+}
@@ -0,0 +1,194 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPInventoryGet(t *testing.T) {
+	var query map[string][]string
+	var auth string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("unexpected method %s", r.Method)
+		}
+
+		query = r.URL.Query()
+		auth = r.Header.Get("Authorization")
+		w.Write([]byte(`{"data": {"nodes": [{"name": "web2.example.net"}, {"name": "web1.example.net"}]}}`))
+	}))
+	defer srv.Close()
+
+	inv := NewHTTPInventory(srv.URL + "/nodes?site=eu")
+	inv.SetIdentityPath("data.nodes.*.name")
+
+	filter := NewFilter().FactString("os=linux").Class("apache").Agent("puppet").Identity("/web/").Compound("with('rpcutil')").MustBuild()
+
+	found, err := inv.Discover(context.Background(), time.Second, "mcollective", filter, map[string]string{"token": "s3cret"})
+	if err != nil {
+		t.Fatalf("discover failed: %s", err)
+	}
+
+	if !reflect.DeepEqual(found, []string{"web1.example.net", "web2.example.net"}) {
+		t.Fatalf("unexpected nodes %v", found)
+	}
+
+	expect := map[string][]string{
+		"site":       {"eu"},
+		"collective": {"mcollective"},
+		"fact":       {"os==linux"},
+		"class":      {"apache"},
+		"agent":      {"puppet"},
+		"identity":   {"/web/"},
+		"compound":   {"with('rpcutil')"},
+	}
+
+	if !reflect.DeepEqual(query, expect) {
+		t.Fatalf("unexpected query %v", query)
+	}
+
+	if auth != "Bearer s3cret" {
+		t.Fatalf("unexpected authorization %q", auth)
+	}
+}
+
+func TestHTTPInventoryPost(t *testing.T) {
+	var body map[string]interface{}
+	var header string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+
+		header = r.Header.Get("X-Api-Key")
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(`["db1.example.net"]`))
+	}))
+	defer srv.Close()
+
+	tokenFile := filepath.Join(testDir(t), "token")
+	ioutil.WriteFile(tokenFile, []byte("file-token\n"), 0600)
+
+	inv := NewHTTPInventory("http://localhost:1")
+	inv.SetHeader("X-Api-Key", "key")
+	err := inv.SetMethod("post")
+	if err != nil {
+		t.Fatalf("set method failed: %s", err)
+	}
+
+	found, err := inv.Discover(context.Background(), time.Second, "eu", NewFilter().Class("mysql").MustBuild(), map[string]string{"url": srv.URL, "token_file": tokenFile, "site": "eu"})
+	if err != nil {
+		t.Fatalf("discover failed: %s", err)
+	}
+
+	if !reflect.DeepEqual(found, []string{"db1.example.net"}) {
+		t.Fatalf("unexpected nodes %v", found)
+	}
+
+	if header != "key" || body["collective"] != "eu" || !reflect.DeepEqual(body["options"], map[string]interface{}{"site": "eu"}) {
+		t.Fatalf("unexpected request %q %v", header, body)
+	}
+
+	if !reflect.DeepEqual(body["filter"].(map[string]interface{})["cf_class"], []interface{}{"mysql"}) {
+		t.Fatalf("unexpected filter %v", body["filter"])
+	}
+
+	if inv.SetMethod("DELETE") == nil {
+		t.Fatalf("unsupported method was accepted")
+	}
+}
+
+func TestHTTPInventoryTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"a": "one.example.net", "b": "two.example.net"}`))
+	}))
+	defer srv.Close()
+
+	inv := NewHTTPInventory(srv.URL)
+	inv.SetIdentityPath("*")
+
+	_, err := inv.Discover(context.Background(), time.Second, "", Filter{}, nil)
+	if err == nil {
+		t.Fatalf("untrusted server was accepted")
+	}
+
+	ca := filepath.Join(testDir(t), "ca.pem")
+	ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+
+	for _, opts := range []map[string]string{{"tls_ca": ca}, {"tls_insecure": "true"}} {
+		found, err := inv.Discover(context.Background(), time.Second, "", Filter{}, opts)
+		if err != nil {
+			t.Fatalf("discover with %v failed: %s", opts, err)
+		}
+
+		if !reflect.DeepEqual(found, []string{"one.example.net", "two.example.net"}) {
+			t.Fatalf("unexpected nodes %v", found)
+		}
+	}
+
+	_, err = inv.Discover(context.Background(), time.Second, "", Filter{}, map[string]string{"tls_cert": ca, "tls_key": filepath.Join(testDir(t), "missing")})
+	if err == nil || !strings.Contains(err.Error(), "could not load client certificate") {
+		t.Fatalf("expected a certificate error got %v", err)
+	}
+}
+
+func TestHTTPInventoryErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		case "/denied":
+			http.Error(w, "token required", http.StatusUnauthorized)
+		case "/numbers":
+			w.Write([]byte(`[1, 2]`))
+		case "/huge":
+			chunk := bytes.Repeat([]byte("a"), 1<<20)
+			w.Write([]byte(`["`))
+			for i := 0; i < MaxHTTPResponseSize/len(chunk); i++ {
+				w.Write(chunk)
+			}
+			w.Write([]byte(`"]`))
+		default:
+			w.Write([]byte(`not json`))
+		}
+	}))
+	defer srv.Close()
+
+	inv := NewHTTPInventory(srv.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := inv.Discover(ctx, 50*time.Millisecond, "", Filter{}, map[string]string{"url": srv.URL + "/slow"})
+	if err == nil || time.Since(start) > 2*time.Second {
+		t.Fatalf("deadline was not honoured: %v", err)
+	}
+
+	for path, msg := range map[string]string{
+		"/denied":  "401 Unauthorized: token required",
+		"/numbers": "expected strings",
+		"/other":   "could not parse inventory response",
+		"/huge":    "response exceeds 67108864 bytes",
+	} {
+		_, err = inv.Discover(context.Background(), time.Second, "", Filter{}, map[string]string{"url": srv.URL + path})
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Fatalf("%s: expected error %q got %v", path, msg, err)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InventoryNode is a node listed in an inventory
+type InventoryNode struct {
+	Node
+
+	// Collectives the node belongs to, nodes without collectives are in all collectives
+	Collectives []string `json:"collectives"`
+
+	// Groups the node is in, selectable using the group option
+	Groups []string `json:"groups"`
+}
+
+// inventoryFile is the JSON inventory format, groups can list their members in addition to the groups of the nodes
+type inventoryFile struct {
+	Nodes  []*InventoryNode    `json:"nodes"`
+	Groups map[string][]string `json:"groups"`
+}
+
+// FileInventory discovers nodes listed in an inventory file that is reloaded when it changes
+//
+// JSON inventories are either an object with nodes and groups, a list of nodes or a list of identities, plain
+// text inventories list one identity per line with # comments
+type FileInventory struct {
+	path    string
+	nodes   []*InventoryNode
+	groups  map[string]map[string]bool
+	modTime time.Time
+	size    int64
+	mu      sync.Mutex
+}
+
+// NewFileInventory creates an inventory backed by the file path
+func NewFileInventory(path string) *FileInventory {
+	return &FileInventory{path: path}
+}
+
+// Discover implements DiscoverFunc, the group option selects nodes in any of the comma separated groups
+func (i *FileInventory) Discover(ctx context.Context, _ time.Duration, collective string, filter Filter, options map[string]string) ([]string, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, groups, err := i.load()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes = inCollective(nodes, collective)
+
+	if options["group"] != "" {
+		nodes, err = inGroups(nodes, groups, options["group"])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return filterInventory(filter, nodes)
+}
+
+// Nodes are the nodes in the inventory, the file is read again when it changed
+func (i *FileInventory) Nodes() ([]*InventoryNode, error) {
+	nodes, _, err := i.load()
+	return nodes, err
+}
+
+func (i *FileInventory) load() ([]*InventoryNode, map[string]map[string]bool, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	stat, err := os.Stat(i.path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read inventory: %s", err)
+	}
+
+	if i.nodes != nil && stat.ModTime().Equal(i.modTime) && stat.Size() == i.size {
+		return i.nodes, i.groups, nil
+	}
+
+	data, err := ioutil.ReadFile(i.path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read inventory: %s", err)
+	}
+
+	nodes, err := parseInventory(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse inventory %s: %s", i.path, err)
+	}
+
+	i.nodes = nodes.Nodes
+	i.groups = inventoryGroups(nodes)
+	i.modTime = stat.ModTime()
+	i.size = stat.Size()
+
+	return i.nodes, i.groups, nil
+}
+
+func parseInventory(data []byte) (*inventoryFile, error) {
+	trimmed := bytes.TrimSpace(data)
+	inv := &inventoryFile{}
+
+	switch {
+	case len(trimmed) > 0 && trimmed[0] == '{':
+		err := json.Unmarshal(trimmed, inv)
+		if err != nil {
+			return nil, err
+		}
+
+	case len(trimmed) > 0 && trimmed[0] == '[':
+		var identities []string
+		if json.Unmarshal(trimmed, &identities) == nil {
+			for _, id := range identities {
+				inv.Nodes = append(inv.Nodes, &InventoryNode{Node: Node{Identity: id}})
+			}
+			break
+		}
+
+		err := json.Unmarshal(trimmed, &inv.Nodes)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		seen := make(map[string]bool)
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") || seen[line] {
+				continue
+			}
+
+			if strings.ContainsAny(line, " \t") {
+				return nil, fmt.Errorf("invalid identity %q", line)
+			}
+
+			seen[line] = true
+			inv.Nodes = append(inv.Nodes, &InventoryNode{Node: Node{Identity: line}})
+		}
+
+		err := scanner.Err()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	seen := make(map[string]bool)
+	for idx, node := range inv.Nodes {
+		if node == nil || node.Identity == "" {
+			return nil, fmt.Errorf("node %d has no identity", idx+1)
+		}
+
+		if seen[node.Identity] {
+			return nil, fmt.Errorf("node %s is listed more than once", node.Identity)
+		}
+		seen[node.Identity] = true
+	}
+
+	return inv, nil
+}
+
+// inventoryGroups maps group names to their members, both from node groups and the groups list
+func inventoryGroups(inv *inventoryFile) map[string]map[string]bool {
+	groups := make(map[string]map[string]bool)
+
+	add := func(group string, identity string) {
+		if groups[group] == nil {
+			groups[group] = make(map[string]bool)
+		}
+		groups[group][identity] = true
+	}
+
+	for _, node := range inv.Nodes {
+		for _, g := range node.Groups {
+			add(g, node.Identity)
+		}
+	}
+
+	for g, members := range inv.Groups {
+		for _, m := range members {
+			add(g, m)
+		}
+	}
+
+	return groups
+}
+
+func inCollective(nodes []*InventoryNode, collective string) []*InventoryNode {
+	if collective == "" {
+		return nodes
+	}
+
+	var matched []*InventoryNode
+	for _, node := range nodes {
+		if len(node.Collectives) == 0 {
+			matched = append(matched, node)
+			continue
+		}
+
+		for _, c := range node.Collectives {
+			if c == collective {
+				matched = append(matched, node)
+				break
+			}
+		}
+	}
+
+	return matched
+}
+
+func inGroups(nodes []*InventoryNode, groups map[string]map[string]bool, selected string) ([]*InventoryNode, error) {
+	var names []string
+	for _, g := range strings.Split(selected, ",") {
+		g = strings.TrimSpace(g)
+		if g == "" {
+			continue
+		}
+
+		if _, ok := groups[g]; !ok {
+			known := make([]string, 0, len(groups))
+			for k := range groups {
+				known = append(known, k)
+			}
+			sort.Strings(known)
+
+			return nil, fmt.Errorf("unknown group %s, known groups are: %s", g, strings.Join(known, ", "))
+		}
+
+		names = append(names, g)
+	}
+
+	var matched []*InventoryNode
+	for _, node := range nodes {
+		for _, g := range names {
+			if groups[g][node.Identity] {
+				matched = append(matched, node)
+				break
+			}
+		}
+	}
+
+	return matched, nil
+}
+
+func filterInventory(filter Filter, nodes []*InventoryNode) ([]string, error) {
+	records := make([]*Node, len(nodes))
+	for i, node := range nodes {
+		records[i] = &node.Node
+	}
+
+	return MatchNodes(filter, records)
+}
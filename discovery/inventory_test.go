@@ -0,0 +1,152 @@
+package discovery
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeInventory(t *testing.T, dir string, name string, content string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("could not write inventory: %s", err)
+	}
+
+	return path
+}
+
+func testDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
+
+const testInventory = `{
+	"nodes": [
+		{"identity": "web1.example.net", "collectives": ["mcollective", "eu"], "facts": {"os": "linux"}, "classes": ["apache"], "agents": ["rpcutil"], "groups": ["web"]},
+		{"identity": "web2.example.net", "collectives": ["us"], "facts": {"os": "linux"}, "classes": ["nginx"], "agents": ["rpcutil"], "groups": ["web"]},
+		{"identity": "db1.example.net", "facts": {"os": "freebsd"}, "classes": ["mysql"], "agents": ["rpcutil"]}
+	],
+	"groups": {
+		"database": ["db1.example.net"]
+	}
+}`
+
+func TestFileInventory(t *testing.T) {
+	inv := NewFileInventory(writeInventory(t, testDir(t), "inventory.json", testInventory))
+	ctx := context.Background()
+
+	cases := []struct {
+		collective string
+		filter     Filter
+		options    map[string]string
+		expect     []string
+	}{
+		{"", Filter{}, nil, []string{"db1.example.net", "web1.example.net", "web2.example.net"}},
+		{"mcollective", Filter{}, nil, []string{"db1.example.net", "web1.example.net"}},
+		{"us", Filter{Fact: []FactFilter{{"os", "==", "linux"}}}, nil, []string{"web2.example.net"}},
+		{"", Filter{Class: []string{"/^(apache|mysql)$/"}}, nil, []string{"db1.example.net", "web1.example.net"}},
+		{"", Filter{}, map[string]string{"group": "web"}, []string{"web1.example.net", "web2.example.net"}},
+		{"", Filter{}, map[string]string{"group": "database"}, []string{"db1.example.net"}},
+		{"", Filter{Class: []string{"nginx"}}, map[string]string{"group": "web,database"}, []string{"web2.example.net"}},
+		{"", NewFilter().Compound("with('apache') or os=freebsd").MustBuild(), nil, []string{"db1.example.net", "web1.example.net"}},
+	}
+
+	for _, c := range cases {
+		found, err := inv.Discover(ctx, time.Second, c.collective, c.filter, c.options)
+		if err != nil {
+			t.Fatalf("discover failed: %s", err)
+		}
+
+		if !reflect.DeepEqual(found, c.expect) {
+			t.Fatalf("expected %v got %v for %#v", c.expect, found, c)
+		}
+	}
+
+	_, err := inv.Discover(ctx, time.Second, "", Filter{}, map[string]string{"group": "mail"})
+	if err == nil || !strings.Contains(err.Error(), "unknown group mail, known groups are: database, web") {
+		t.Fatalf("expected an unknown group error got %v", err)
+	}
+}
+
+func TestFileInventoryFormats(t *testing.T) {
+	dir := testDir(t)
+
+	for name, content := range map[string]string{
+		"identities.json": `["web1.example.net", "db1.example.net"]`,
+		"nodes.json":      `[{"identity": "web1.example.net"}, {"identity": "db1.example.net"}]`,
+		"nodes.txt":       "# all the nodes\nweb1.example.net\n\n  db1.example.net\nweb1.example.net\n",
+	} {
+		inv := NewFileInventory(writeInventory(t, dir, name, content))
+
+		found, err := inv.Discover(context.Background(), time.Second, "mcollective", Filter{}, nil)
+		if err != nil {
+			t.Fatalf("%s: discover failed: %s", name, err)
+		}
+
+		if !reflect.DeepEqual(found, []string{"db1.example.net", "web1.example.net"}) {
+			t.Fatalf("%s: unexpected nodes %v", name, found)
+		}
+	}
+
+	for name, content := range map[string]string{
+		"invalid.json":   `{"nodes": [`,
+		"duplicate.json": `["web1", "web1"]`,
+		"noid.json":      `[{"facts": {}}]`,
+		"spaces.txt":     "web1 web2\n",
+	} {
+		_, err := NewFileInventory(writeInventory(t, dir, name, content)).Nodes()
+		if err == nil {
+			t.Fatalf("%s: invalid inventory was accepted", name)
+		}
+	}
+
+	_, err := NewFileInventory(filepath.Join(dir, "missing.json")).Nodes()
+	if err == nil {
+		t.Fatalf("missing inventory was accepted")
+	}
+}
+
+func TestFileInventoryReload(t *testing.T) {
+	path := writeInventory(t, testDir(t), "nodes.txt", "web1.example.net\n")
+	inv := NewFileInventory(path)
+
+	found, err := inv.Discover(context.Background(), time.Second, "", Filter{}, nil)
+	if err != nil || !reflect.DeepEqual(found, []string{"web1.example.net"}) {
+		t.Fatalf("unexpected nodes %v: %v", found, err)
+	}
+
+	err = ioutil.WriteFile(path, []byte("web1.example.net\nweb2.example.net\n"), 0644)
+	if err != nil {
+		t.Fatalf("could not update inventory: %s", err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(path, future, future)
+
+	found, err = inv.Discover(context.Background(), time.Second, "", Filter{}, nil)
+	if err != nil || !reflect.DeepEqual(found, []string{"web1.example.net", "web2.example.net"}) {
+		t.Fatalf("inventory was not reloaded: %v: %v", found, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = inv.Discover(ctx, time.Second, "", Filter{}, nil)
+	if err != context.Canceled {
+		t.Fatalf("expected a canceled error got %v", err)
+	}
+}
@@ -0,0 +1,447 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Node is the inventory record of a node that filters are evaluated against
+type Node struct {
+	Identity string                 `json:"identity"`
+	Facts    map[string]interface{} `json:"facts"`
+	Classes  []string               `json:"classes"`
+	Agents   []string               `json:"agents"`
+}
+
+// FactOperators are the operators supported in fact filters
+var FactOperators = []string{"==", "=~", "!=", "<=", ">=", "<", ">"}
+
+var factFilterPattern = regexp.MustCompile(`^\s*([^=!<>~\s]+)\s*(==|=~|!=|<=|>=|=|<|>)\s*(.+?)\s*$`)
+
+// Matcher evaluates a Filter against node records using the same rules as the Choria server
+type Matcher struct {
+	filter       Filter
+	compound     []*Expression
+	patterns     map[string]*regexp.Regexp
+	factPatterns map[string]*regexp.Regexp
+}
+
+// NewMatcher creates a matcher for filter, regular expressions and fact operators are validated
+func NewMatcher(filter Filter) (*Matcher, error) {
+	m := &Matcher{
+		filter:       filter,
+		patterns:     make(map[string]*regexp.Regexp),
+		factPatterns: make(map[string]*regexp.Regexp),
+	}
+
+	for _, items := range [][]string{filter.Identity, filter.Class, filter.Agent} {
+		for _, item := range items {
+			if !isRegex(item) {
+				continue
+			}
+
+			err := m.compile(item, false)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, f := range filter.Fact {
+		if f.Fact == "" {
+			return nil, fmt.Errorf("fact filter with operator '%s' has no fact name", f.Operator)
+		}
+
+		if !validFactOperator(f.Operator) {
+			return nil, fmt.Errorf("invalid operator '%s' in fact filter on %s", f.Operator, f.Fact)
+		}
+
+		if f.Operator == "=~" {
+			err := m.compile(f.Value, true)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, items := range filter.Compound {
+		if len(items) == 0 {
+			continue
+		}
+
+		src, err := compoundExpression(items)
+		if err != nil {
+			return nil, err
+		}
+
+		expr, err := ParseExpression(src)
+		if err != nil {
+			return nil, err
+		}
+
+		m.compound = append(m.compound, expr)
+	}
+
+	return m, nil
+}
+
+// Match determines if the node matches all parts of the filter
+func (m *Matcher) Match(node *Node) bool {
+	if node == nil {
+		return false
+	}
+
+	return m.matchIdentity(node.Identity) &&
+		m.matchAll(m.filter.Class, node.Classes) &&
+		m.matchAll(m.filter.Agent, node.Agents) &&
+		m.matchFacts(node.Facts) &&
+		m.matchCompound(node)
+}
+
+// Filter returns the sorted identities of the nodes that match the filter
+func (m *Matcher) Filter(nodes []*Node) []string {
+	found := []string{}
+	for _, node := range nodes {
+		if m.Match(node) {
+			found = append(found, node.Identity)
+		}
+	}
+
+	sort.Strings(found)
+
+	return found
+}
+
+// MatchNodes returns the sorted identities of the nodes that match filter
+func MatchNodes(filter Filter, nodes []*Node) ([]string, error) {
+	m, err := NewMatcher(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.Filter(nodes), nil
+}
+
+// ParseFactFilter parses a fact filter like os.family=RedHat, = compares for equality or matches when the
+// value is a /regex/
+func ParseFactFilter(filter string) (FactFilter, error) {
+	parts := factFilterPattern.FindStringSubmatch(filter)
+	if parts == nil {
+		return FactFilter{}, fmt.Errorf("invalid fact filter '%s'", filter)
+	}
+
+	ff := FactFilter{Fact: parts[1], Operator: parts[2], Value: parts[3]}
+	if ff.Operator == "=" {
+		ff.Operator = "=="
+		if isRegex(ff.Value) {
+			ff.Operator = "=~"
+		}
+	}
+
+	return ff, nil
+}
+
+// compile parses a /regex/ filter, fact regex are case insensitive and may omit the slashes
+func (m *Matcher) compile(pattern string, fact bool) error {
+	re, err := compileRegex(pattern, fact)
+	if err != nil {
+		return err
+	}
+
+	if fact {
+		m.factPatterns[pattern] = re
+	} else {
+		m.patterns[pattern] = re
+	}
+
+	return nil
+}
+
+// matchIdentity matches if the identity matches any identity filter
+func (m *Matcher) matchIdentity(identity string) bool {
+	if len(m.filter.Identity) == 0 {
+		return true
+	}
+
+	for _, f := range m.filter.Identity {
+		if m.matchItem(f, identity) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchAll matches if every filter matches at least one of the known classes or agents
+func (m *Matcher) matchAll(filters []string, known []string) bool {
+	for _, f := range filters {
+		if !m.matchAny(f, known) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *Matcher) matchAny(filter string, known []string) bool {
+	for _, k := range known {
+		if m.matchItem(filter, k) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchItem compares a class, agent or identity filter that is either an exact value or a /regex/
+func (m *Matcher) matchItem(filter string, value string) bool {
+	if filter == value {
+		return true
+	}
+
+	if re, ok := m.patterns[filter]; ok && isRegex(filter) {
+		return re.MatchString(value)
+	}
+
+	return false
+}
+
+// matchCompound matches if every compound expression matches
+func (m *Matcher) matchCompound(node *Node) bool {
+	for _, expr := range m.compound {
+		if !expr.Match(node) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *Matcher) matchFacts(facts map[string]interface{}) bool {
+	for _, f := range m.filter.Fact {
+		value, ok := lookupFact(facts, f.Fact)
+		if !ok {
+			return false
+		}
+
+		if !compareFact(value, f.Operator, f.Value, m.factPatterns[f.Value]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compareFact applies a fact operator, re is the compiled value of =~ comparisons
+func compareFact(fact interface{}, operator string, value string, re *regexp.Regexp) bool {
+	switch operator {
+	case "==":
+		return factEqual(fact, value)
+	case "!=":
+		return !factEqual(fact, value)
+	case "=~":
+		if re == nil {
+			return false
+		}
+		return re.MatchString(factString(fact))
+	case "<", ">", "<=", ">=":
+		cmp, ok := factCompare(fact, value)
+		if !ok {
+			return false
+		}
+
+		switch operator {
+		case "<":
+			return cmp < 0
+		case ">":
+			return cmp > 0
+		case "<=":
+			return cmp <= 0
+		default:
+			return cmp >= 0
+		}
+	}
+
+	return false
+}
+
+func compileRegex(pattern string, ignoreCase bool) (*regexp.Regexp, error) {
+	expr := strings.TrimSuffix(strings.TrimPrefix(pattern, "/"), "/")
+	if ignoreCase {
+		expr = "(?i)" + expr
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression %s: %s", pattern, err)
+	}
+
+	return re, nil
+}
+
+func isRegex(s string) bool {
+	return len(s) >= 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/")
+}
+
+func validFactOperator(op string) bool {
+	for _, o := range FactOperators {
+		if o == op {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lookupFact finds a fact by name, names with dots select nested values when no fact has that exact name
+func lookupFact(facts map[string]interface{}, name string) (interface{}, bool) {
+	if facts == nil {
+		return nil, false
+	}
+
+	if v, ok := facts[name]; ok {
+		return v, true
+	}
+
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+
+	switch v := facts[parts[0]].(type) {
+	case map[string]interface{}:
+		return lookupFact(v, parts[1])
+
+	case []interface{}:
+		idx := strings.SplitN(parts[1], ".", 2)
+		i, err := strconv.Atoi(idx[0])
+		if err != nil || i < 0 || i >= len(v) {
+			return nil, false
+		}
+		if len(idx) == 1 {
+			return v[i], true
+		}
+		if nested, ok := v[i].(map[string]interface{}); ok {
+			return lookupFact(nested, idx[1])
+		}
+	}
+
+	return nil, false
+}
+
+// factNumber is the numeric value of a fact
+func factNumber(fact interface{}) (float64, bool) {
+	switch v := fact.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+
+	return 0, false
+}
+
+// factString is the string form of a fact, structured facts are represented as JSON
+func factString(fact interface{}) string {
+	switch v := fact.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	}
+
+	if n, ok := factNumber(fact); ok {
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+
+	if b, ok := fact.(bool); ok {
+		return strconv.FormatBool(b)
+	}
+
+	j, err := json.Marshal(fact)
+	if err != nil {
+		return fmt.Sprintf("%v", fact)
+	}
+
+	return string(j)
+}
+
+// factEqual compares strings case insensitively, numbers numerically and booleans to the usual truthy and falsy words
+func factEqual(fact interface{}, value string) bool {
+	switch v := fact.(type) {
+	case string:
+		return strings.EqualFold(v, value)
+	case bool:
+		if v {
+			return isTruthy(value)
+		}
+		return isFalsy(value)
+	}
+
+	if n, ok := factNumber(fact); ok {
+		f, err := strconv.ParseFloat(value, 64)
+		return err == nil && n == f
+	}
+
+	return false
+}
+
+// factCompare orders the fact relative to value, numerically for numbers and lexically for strings
+func factCompare(fact interface{}, value string) (int, bool) {
+	if n, ok := factNumber(fact); ok {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, false
+		}
+
+		switch {
+		case n < f:
+			return -1, true
+		case n > f:
+			return 1, true
+		default:
+			return 0, true
+		}
+	}
+
+	if s, ok := fact.(string); ok {
+		return strings.Compare(s, value), true
+	}
+
+	return 0, false
+}
+
+func isTruthy(s string) bool {
+	switch strings.ToLower(s) {
+	case "true", "t", "yes", "y", "1":
+		return true
+	}
+
+	return false
+}
+
+func isFalsy(s string) bool {
+	switch strings.ToLower(s) {
+	case "false", "f", "no", "n", "0":
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,96 @@
+package discovery
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func testNodes(t *testing.T) []*Node {
+	t.Helper()
+
+	nodes := []*Node{}
+	err := json.Unmarshal([]byte(`[
+		{"identity": "web1.example.net", "facts": {"os": {"family": "RedHat", "release": {"major": "7"}}, "memory": 4096, "virtual": true, "role": "web", "disks": ["sda", "sdb"], "mount": "/var"}, "classes": ["apache", "roles::web"], "agents": ["rpcutil", "puppet"]},
+		{"identity": "web2.example.net", "facts": {"os": {"family": "Debian", "release": {"major": "10"}}, "memory": 8192, "virtual": false, "role": "web"}, "classes": ["nginx", "roles::web"], "agents": ["rpcutil", "puppet", "package"]},
+		{"identity": "db1.example.net", "facts": {"os": {"family": "RedHat", "release": {"major": "8"}}, "memory": 65536.5, "virtual": false, "role": "db", "os.name": "CentOS", "mount": "/var/lib"}, "classes": ["mysql", "roles::db"], "agents": ["rpcutil"]}
+	]`), &nodes)
+	if err != nil {
+		t.Fatalf("could not parse nodes: %s", err)
+	}
+
+	return nodes
+}
+
+func TestMatcher(t *testing.T) {
+	nodes := testNodes(t)
+
+	cases := []struct {
+		name   string
+		filter Filter
+		expect []string
+	}{
+		{"empty", Filter{}, []string{"db1.example.net", "web1.example.net", "web2.example.net"}},
+		{"identity", Filter{Identity: []string{"web1.example.net"}}, []string{"web1.example.net"}},
+		{"identity regex", Filter{Identity: []string{"/^web\\d/"}}, []string{"web1.example.net", "web2.example.net"}},
+		{"identities are or", Filter{Identity: []string{"db1.example.net", "/web2/"}}, []string{"db1.example.net", "web2.example.net"}},
+		{"class", Filter{Class: []string{"roles::web"}}, []string{"web1.example.net", "web2.example.net"}},
+		{"class regex", Filter{Class: []string{"/^(apache|mysql)$/"}}, []string{"db1.example.net", "web1.example.net"}},
+		{"classes are and", Filter{Class: []string{"roles::web", "nginx"}}, []string{"web2.example.net"}},
+		{"class is exact", Filter{Class: []string{"roles"}}, []string{}},
+		{"agents are and", Filter{Agent: []string{"puppet", "/^pack/"}}, []string{"web2.example.net"}},
+		{"fact equals ignores case", Filter{Fact: []FactFilter{{"os.family", "==", "redhat"}}}, []string{"db1.example.net", "web1.example.net"}},
+		{"fact not equal", Filter{Fact: []FactFilter{{"role", "!=", "web"}}}, []string{"db1.example.net"}},
+		{"fact regex", Filter{Fact: []FactFilter{{"os.family", "=~", "/^deb/"}}}, []string{"web2.example.net"}},
+		{"fact regex without slashes", Filter{Fact: []FactFilter{{"role", "=~", "^d"}}}, []string{"db1.example.net"}},
+		{"fact numeric", Filter{Fact: []FactFilter{{"memory", ">=", "8192"}}}, []string{"db1.example.net", "web2.example.net"}},
+		{"fact numeric equal", Filter{Fact: []FactFilter{{"memory", "==", "4096.0"}}}, []string{"web1.example.net"}},
+		{"fact float", Filter{Fact: []FactFilter{{"memory", ">", "65536"}}}, []string{"db1.example.net"}},
+		{"fact numeric against word", Filter{Fact: []FactFilter{{"memory", "<", "lots"}}}, []string{}},
+		{"fact string order is lexical", Filter{Fact: []FactFilter{{"os.release.major", "<", "8"}}}, []string{"web1.example.net", "web2.example.net"}},
+		{"fact boolean", Filter{Fact: []FactFilter{{"virtual", "==", "yes"}}}, []string{"web1.example.net"}},
+		{"fact boolean false", Filter{Fact: []FactFilter{{"virtual", "==", "false"}}}, []string{"db1.example.net", "web2.example.net"}},
+		{"fact with dotted name", Filter{Fact: []FactFilter{{"os.name", "==", "CentOS"}}}, []string{"db1.example.net"}},
+		{"fact array index", Filter{Fact: []FactFilter{{"disks.1", "==", "sdb"}}}, []string{"web1.example.net"}},
+		{"missing fact", Filter{Fact: []FactFilter{{"datacenter", "!=", "x"}}}, []string{}},
+		{"types are and", Filter{Fact: []FactFilter{{"os.family", "==", "RedHat"}}, Class: []string{"roles::web"}, Agent: []string{"puppet"}, Identity: []string{"/example/"}}, []string{"web1.example.net"}},
+	}
+
+	for _, c := range cases {
+		m, err := NewMatcher(c.filter)
+		if err != nil {
+			t.Fatalf("%s: could not create matcher: %s", c.name, err)
+		}
+
+		found := m.Filter(nodes)
+
+		expect := append([]string{}, c.expect...)
+		sort.Strings(expect)
+
+		if !reflect.DeepEqual(found, expect) {
+			t.Fatalf("%s: expected %v got %v", c.name, expect, found)
+		}
+	}
+}
+
+func TestMatcherInvalid(t *testing.T) {
+	for _, filter := range []Filter{
+		{Identity: []string{"/web[/"}},
+		{Class: []string{"/(/"}},
+		{Agent: []string{"/*/"}},
+		{Fact: []FactFilter{{"os", "~=", "x"}}},
+		{Fact: []FactFilter{{"", "==", "x"}}},
+		{Fact: []FactFilter{{"os", "=~", "/[/"}}},
+	} {
+		_, err := NewMatcher(filter)
+		if err == nil {
+			t.Fatalf("invalid filter %#v was accepted", filter)
+		}
+	}
+
+	_, err := MatchNodes(Filter{Fact: []FactFilter{{"os", "=", "x"}}}, nil)
+	if err == nil {
+		t.Fatalf("invalid operator was accepted")
+	}
+}
@@ -0,0 +1,46 @@
+package discovery
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/choria-io/go-external/internal/metrics"
+)
+
+var (
+	// durationBuckets are the upper bounds in seconds of the discovery duration histogram buckets
+	durationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 2, 5, 10, 30}
+
+	// nodeBuckets are the upper bounds of the discovered node count histogram buckets
+	nodeBuckets = []float64{0, 1, 10, 100, 1000, 10000, 100000}
+)
+
+// SetMetricsFile enables metrics that are merged into a node-exporter textfile collector file, the file
+// name should end in .prom
+func (d *Discovery) SetMetricsFile(path string) {
+	d.metricsPath = path
+}
+
+func (d *Discovery) recordRequest(reply *Response, duration time.Duration) {
+	if d.metricsPath == "" {
+		return
+	}
+
+	labels := metrics.Labels{"discovery": filepath.Base(os.Args[0])}
+	status := "ok"
+	if reply.Error != "" {
+		status = "error"
+	}
+
+	set := metrics.NewSet()
+	set.Counter("choria_external_discovery_requests_total", "Discovery requests handled", metrics.Labels{"discovery": labels["discovery"], "status": status}, 1)
+	set.Observe("choria_external_discovery_duration_seconds", "Time taken to discover nodes", durationBuckets, labels, duration.Seconds())
+	set.Observe("choria_external_discovery_nodes", "Nodes found by discovery requests", nodeBuckets, labels, float64(len(reply.Nodes)))
+
+	err := set.Write(d.metricsPath, metrics.DefaultLockTimeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write metrics: %s\n", err)
+	}
+}
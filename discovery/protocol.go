@@ -0,0 +1,113 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	// ResponseProtocolV2 is the protocol version 2 responses from the external script should have
+	ResponseProtocolV2 = "io.choria.choria.discovery.v2.external_reply"
+	// RequestProtocolV2 is the protocol set in version 2 requests
+	RequestProtocolV2 = "io.choria.choria.discovery.v2.external_request"
+)
+
+// protocol is a version of the external discovery protocol
+type protocol struct {
+	version  int
+	request  string
+	response string
+
+	// schemas of the request and response documents, see the schemas package
+	requestSchema  string
+	responseSchema string
+
+	// decodeRequest parses a request into the normalized Request
+	decodeRequest func(data []byte) (*Request, error)
+
+	// encodeResponse creates the document to publish for a response to req, req is nil when the request could not be parsed
+	encodeResponse func(req *Request, resp *Response) interface{}
+}
+
+var protocols = []*protocol{v1Protocol, v2Protocol}
+
+func protocolByName(name string) (*protocol, bool) {
+	for _, p := range protocols {
+		if p.request == name {
+			return p, true
+		}
+	}
+
+	return nil, false
+}
+
+func decodeRequest(data []byte, protocol string) (*Request, error) {
+	req := &Request{}
+	err := json.Unmarshal(data, req)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse JSON request")
+	}
+
+	if req.Protocol != "" && req.Protocol != protocol {
+		return nil, fmt.Errorf("unexpected protocol '%s'", req.Protocol)
+	}
+
+	return req, nil
+}
+
+var v1Protocol = &protocol{
+	version:  1,
+	request:  RequestProtocol,
+	response: ResponseProtocol,
+
+	requestSchema:  "https://choria.io/schemas/choria/discovery/v1/external_request.json",
+	responseSchema: "https://choria.io/schemas/choria/discovery/v1/external_reply.json",
+
+	decodeRequest: func(data []byte) (*Request, error) {
+		req, err := decodeRequest(data, RequestProtocol)
+		if err != nil {
+			return nil, err
+		}
+
+		// request and caller ids are only part of version 2
+		req.RequestID = ""
+		req.CallerID = ""
+
+		return req, nil
+	},
+
+	encodeResponse: func(_ *Request, resp *Response) interface{} {
+		return &Response{
+			Protocol: ResponseProtocol,
+			Nodes:    resp.Nodes,
+			Error:    resp.Error,
+		}
+	},
+}
+
+var v2Protocol = &protocol{
+	version:  2,
+	request:  RequestProtocolV2,
+	response: ResponseProtocolV2,
+
+	requestSchema:  "https://choria.io/schemas/choria/discovery/v2/external_request.json",
+	responseSchema: "https://choria.io/schemas/choria/discovery/v2/external_reply.json",
+
+	decodeRequest: func(data []byte) (*Request, error) {
+		return decodeRequest(data, RequestProtocolV2)
+	},
+
+	encodeResponse: func(req *Request, resp *Response) interface{} {
+		response := &Response{
+			Protocol: ResponseProtocolV2,
+			Nodes:    resp.Nodes,
+			Error:    resp.Error,
+		}
+
+		if req != nil {
+			response.RequestID = req.RequestID
+		}
+
+		return response
+	},
+}
@@ -0,0 +1,282 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var puppetFactName = regexp.MustCompile(`^[a-zA-Z0-9_]+(\.[a-zA-Z0-9_]+)*$`)
+
+// PuppetDB discovers nodes using PQL queries against the PuppetDB v4 query API
+type PuppetDB struct {
+	url    string
+	client *http.Client
+}
+
+// NewPuppetDB creates a source querying the PuppetDB at url like https://puppetdb.example.net:8081, the url, token,
+// token_file, tls_ca, tls_cert, tls_key and tls_insecure options configure the request like for HTTPInventory
+func NewPuppetDB(url string) *PuppetDB {
+	return &PuppetDB{url: strings.TrimSuffix(url, "/")}
+}
+
+// SetHTTPClient sets the client used when the options have no TLS settings
+func (p *PuppetDB) SetHTTPClient(client *http.Client) {
+	p.client = client
+}
+
+// Discover implements DiscoverFunc, the filter is translated to PQL and the certnames of active nodes are returned
+func (p *PuppetDB) Discover(ctx context.Context, _ time.Duration, collective string, filter Filter, options map[string]string) ([]string, error) {
+	query, err := PQL(filter, collective)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.Query(ctx, query, options)
+}
+
+// Query runs a PQL query selecting certname and deactivated and returns the certnames of the active nodes
+func (p *PuppetDB) Query(ctx context.Context, query string, options map[string]string) ([]string, error) {
+	base := p.url
+	if options["url"] != "" {
+		base = strings.TrimSuffix(options["url"], "/")
+	}
+
+	target := fmt.Sprintf("%s/pdb/query/v4?%s", base, url.Values{"query": []string{query}}.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	err = setBearerToken(req, options)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := optionsHTTPClient(options, p.client)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("PuppetDB request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := readResponseBody(resp)
+	if err != nil {
+		return nil, fmt.Errorf("could not read PuppetDB response: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("PuppetDB request failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var nodes []struct {
+		Certname    string      `json:"certname"`
+		Deactivated interface{} `json:"deactivated"`
+	}
+
+	err = json.Unmarshal(body, &nodes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse PuppetDB response: %s", err)
+	}
+
+	found := []string{}
+	for _, node := range nodes {
+		if node.Deactivated == nil && node.Certname != "" {
+			found = append(found, node.Certname)
+		}
+	}
+
+	sort.Strings(found)
+
+	return found, nil
+}
+
+// PQL translates a filter and collective into a PuppetDB query, agents are found using their
+// Class["Mcollective::Agent::X"] resources and collectives using the mcollective fact
+func PQL(filter Filter, collective string) (string, error) {
+	if len(filter.Compound) > 0 {
+		return "", fmt.Errorf("compound filters cannot be translated to PQL")
+	}
+
+	var queries []string
+
+	if collective != "" {
+		queries = append(queries, fmt.Sprintf(`certname in inventory[certname] { facts.mcollective.server.collectives.match("\d+") = %s }`, pqlString(collective)))
+	}
+
+	if len(filter.Identity) > 0 {
+		var ids []string
+		for _, id := range filter.Identity {
+			if isRegex(id) {
+				ids = append(ids, "certname ~ "+pqlString(regexBody(id)))
+			} else {
+				ids = append(ids, "certname = "+pqlString(id))
+			}
+		}
+		queries = append(queries, "("+strings.Join(ids, " or ")+")")
+	}
+
+	for _, class := range filter.Class {
+		queries = append(queries, pqlClass(class))
+	}
+
+	for _, agent := range filter.Agent {
+		queries = append(queries, pqlAgent(agent))
+	}
+
+	for _, fact := range filter.Fact {
+		q, err := pqlFact(fact)
+		if err != nil {
+			return "", err
+		}
+		queries = append(queries, q)
+	}
+
+	if len(queries) == 0 {
+		return "nodes[certname, deactivated] {}", nil
+	}
+
+	return fmt.Sprintf("nodes[certname, deactivated] { %s }", strings.Join(queries, " and ")), nil
+}
+
+// pqlClass selects nodes with a class resource, puppet capitalizes every part of class titles
+func pqlClass(class string) string {
+	if isRegex(class) {
+		return fmt.Sprintf(`certname in resources[certname] { type = "Class" and title ~ %s }`, pqlString(capitalizeRegex(regexBody(class))))
+	}
+
+	return fmt.Sprintf(`certname in resources[certname] { type = "Class" and title = %s }`, pqlString(capitalizeResource(class)))
+}
+
+// pqlAgent selects nodes with the class that installs an agent, rpcutil is part of every Choria server
+func pqlAgent(agent string) string {
+	switch {
+	case agent == "rpcutil" || agent == "scout":
+		return fmt.Sprintf("(%s or %s)", pqlClass("choria::service"), pqlClass("mcollective::service"))
+	case isRegex(agent):
+		// the regex is anchored to the prefix so unanchored regexes may match anywhere in the agent name
+		body := regexBody(agent)
+		if strings.HasPrefix(body, "^") {
+			body = body[1:]
+		} else {
+			body = ".*" + body
+		}
+		return pqlClass("/^mcollective::agent::" + body + "/")
+	default:
+		return pqlClass("mcollective::agent::" + agent)
+	}
+}
+
+// pqlFact selects nodes by fact, strings are compared case insensitively like Matcher does
+func pqlFact(f FactFilter) (string, error) {
+	if !puppetFactName.MatchString(f.Fact) {
+		return "", fmt.Errorf("fact %s cannot be used in PQL", f.Fact)
+	}
+
+	fact := "facts." + f.Fact
+	var cond string
+
+	_, numErr := strconv.ParseFloat(f.Value, 64)
+	numeric := numErr == nil
+
+	switch f.Operator {
+	case "=~":
+		cond = fmt.Sprintf("%s ~ %s", fact, pqlString("(?i)"+regexBody(f.Value)))
+
+	case "==", "!=":
+		exact := pqlString("(?i)^" + regexp.QuoteMeta(f.Value) + "$")
+
+		switch {
+		case numeric:
+			cond = fmt.Sprintf("%s = %s or %s = %s", fact, f.Value, fact, pqlString(f.Value))
+		case f.Value == "true" || f.Value == "false":
+			cond = fmt.Sprintf("%s = %s or %s ~ %s", fact, f.Value, fact, exact)
+		default:
+			cond = fmt.Sprintf("%s ~ %s", fact, exact)
+		}
+
+		// nodes without the fact do not match
+		if f.Operator == "!=" {
+			cond = fmt.Sprintf("%s is not null and !(%s)", fact, cond)
+		}
+
+	case "<", ">", "<=", ">=":
+		if !numeric {
+			return "", fmt.Errorf("fact %s %s %s: PuppetDB only compares numbers", f.Fact, f.Operator, f.Value)
+		}
+		cond = fmt.Sprintf("%s %s %s", fact, f.Operator, f.Value)
+
+	default:
+		return "", fmt.Errorf("invalid operator '%s' in fact filter on %s", f.Operator, f.Fact)
+	}
+
+	return fmt.Sprintf("certname in inventory[certname] { %s }", cond), nil
+}
+
+func regexBody(s string) string {
+	if isRegex(s) {
+		return s[1 : len(s)-1]
+	}
+
+	return s
+}
+
+func capitalizeResource(name string) string {
+	parts := strings.Split(name, "::")
+	for i, p := range parts {
+		if p != "" {
+			parts[i] = strings.ToUpper(p[:1]) + p[1:]
+		}
+	}
+
+	return strings.Join(parts, "::")
+}
+
+// capitalizeRegex lets the first letter of every part of a class regex match the capitalized title
+func capitalizeRegex(re string) string {
+	var b strings.Builder
+	start := true
+
+	for i := 0; i < len(re); i++ {
+		c := re[i]
+
+		switch {
+		case c == '\\' && i+1 < len(re):
+			b.WriteByte(c)
+			b.WriteByte(re[i+1])
+			i++
+			start = false
+		case start && c >= 'a' && c <= 'z':
+			fmt.Fprintf(&b, "[%c%c]", c-32, c)
+			start = false
+		case c == '^':
+			b.WriteByte(c)
+		case c == ':':
+			b.WriteByte(c)
+			start = true
+		default:
+			b.WriteByte(c)
+			start = false
+		}
+	}
+
+	return b.String()
+}
+
+// pqlString quotes s as a PQL string
+func pqlString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
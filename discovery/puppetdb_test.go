@@ -0,0 +1,110 @@
+package discovery
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPQL(t *testing.T) {
+	cases := []struct {
+		filter     Filter
+		collective string
+		expect     string
+	}{
+		{Filter{}, "", `nodes[certname, deactivated] {}`},
+		{Filter{}, "mcollective", `nodes[certname, deactivated] { certname in inventory[certname] { facts.mcollective.server.collectives.match("\d+") = "mcollective" } }`},
+		{Filter{Identity: []string{"web1.example.net", `/^db\d+/`}}, "", `nodes[certname, deactivated] { (certname = "web1.example.net" or certname ~ "^db\\d+") }`},
+		{Filter{Class: []string{"apache", "roles::web"}}, "", `nodes[certname, deactivated] { certname in resources[certname] { type = "Class" and title = "Apache" } and certname in resources[certname] { type = "Class" and title = "Roles::Web" } }`},
+		{Filter{Class: []string{"/^roles::web/"}}, "", `nodes[certname, deactivated] { certname in resources[certname] { type = "Class" and title ~ "^[Rr]oles::[Ww]eb" } }`},
+		{Filter{Agent: []string{"package"}}, "", `nodes[certname, deactivated] { certname in resources[certname] { type = "Class" and title = "Mcollective::Agent::Package" } }`},
+		{Filter{Agent: []string{"/^pack/"}}, "", `nodes[certname, deactivated] { certname in resources[certname] { type = "Class" and title ~ "^[Mm]collective::[Aa]gent::[Pp]ack" } }`},
+		{Filter{Agent: []string{"/ackage/"}}, "", `nodes[certname, deactivated] { certname in resources[certname] { type = "Class" and title ~ "^[Mm]collective::[Aa]gent::.*ackage" } }`},
+		{Filter{Agent: []string{"rpcutil"}}, "", `nodes[certname, deactivated] { (certname in resources[certname] { type = "Class" and title = "Choria::Service" } or certname in resources[certname] { type = "Class" and title = "Mcollective::Service" }) }`},
+		{Filter{Fact: []FactFilter{{"os.family", "==", "RedHat"}}}, "", `nodes[certname, deactivated] { certname in inventory[certname] { facts.os.family ~ "(?i)^RedHat$" } }`},
+		{Filter{Fact: []FactFilter{{"processorcount", "==", "4"}}}, "", `nodes[certname, deactivated] { certname in inventory[certname] { facts.processorcount = 4 or facts.processorcount = "4" } }`},
+		{Filter{Fact: []FactFilter{{"is_virtual", "!=", "true"}}}, "", `nodes[certname, deactivated] { certname in inventory[certname] { facts.is_virtual is not null and !(facts.is_virtual = true or facts.is_virtual ~ "(?i)^true$") } }`},
+		{Filter{Fact: []FactFilter{{"os.family", "!=", "Debian"}}}, "", `nodes[certname, deactivated] { certname in inventory[certname] { facts.os.family is not null and !(facts.os.family ~ "(?i)^Debian$") } }`},
+		{Filter{Fact: []FactFilter{{"kernel", "=~", "/^lin/"}}}, "", `nodes[certname, deactivated] { certname in inventory[certname] { facts.kernel ~ "(?i)^lin" } }`},
+		{Filter{Fact: []FactFilter{{"memorysize_mb", ">=", "4096"}}}, "", `nodes[certname, deactivated] { certname in inventory[certname] { facts.memorysize_mb >= 4096 } }`},
+		{Filter{Fact: []FactFilter{{"motd", "==", `say "hi".`}}}, "", `nodes[certname, deactivated] { certname in inventory[certname] { facts.motd ~ "(?i)^say \"hi\"\\.$" } }`},
+		{NewFilter().FactString("kernel=Linux").Class("apache").MustBuild(), "eu", `nodes[certname, deactivated] { certname in inventory[certname] { facts.mcollective.server.collectives.match("\d+") = "eu" } and certname in resources[certname] { type = "Class" and title = "Apache" } and certname in inventory[certname] { facts.kernel ~ "(?i)^Linux$" } }`},
+	}
+
+	for _, c := range cases {
+		pql, err := PQL(c.filter, c.collective)
+		if err != nil {
+			t.Fatalf("%#v: translation failed: %s", c.filter, err)
+		}
+
+		if pql != c.expect {
+			t.Fatalf("expected\n%s\ngot\n%s", c.expect, pql)
+		}
+	}
+
+	for _, filter := range []Filter{
+		{Fact: []FactFilter{{"memory", ">", "lots"}}},
+		{Fact: []FactFilter{{"os family", "==", "x"}}},
+		{Fact: []FactFilter{{"os", "~", "x"}}},
+		NewFilter().Compound("apache").MustBuild(),
+	} {
+		_, err := PQL(filter, "")
+		if err == nil {
+			t.Fatalf("invalid filter %#v was translated", filter)
+		}
+	}
+}
+
+func TestPuppetDBDiscover(t *testing.T) {
+	var query string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pdb/query/v4" {
+			http.NotFound(w, r)
+			return
+		}
+
+		query = r.URL.Query().Get("query")
+		if strings.Contains(query, "broken") {
+			http.Error(w, "PQL parse error", http.StatusBadRequest)
+			return
+		}
+
+		w.Write([]byte(`[
+			{"certname": "web2.example.net", "deactivated": null},
+			{"certname": "old.example.net", "deactivated": "2021-01-01T00:00:00.000Z"},
+			{"certname": "web1.example.net", "deactivated": null}
+		]`))
+	}))
+	defer srv.Close()
+
+	pdb := NewPuppetDB(srv.URL + "/")
+
+	found, err := pdb.Discover(context.Background(), time.Second, "mcollective", NewFilter().Class("apache").MustBuild(), nil)
+	if err != nil {
+		t.Fatalf("discover failed: %s", err)
+	}
+
+	if !reflect.DeepEqual(found, []string{"web1.example.net", "web2.example.net"}) {
+		t.Fatalf("unexpected nodes %v", found)
+	}
+
+	expect, _ := PQL(NewFilter().Class("apache").MustBuild(), "mcollective")
+	if query != expect {
+		t.Fatalf("unexpected query %s", query)
+	}
+
+	_, err = pdb.Query(context.Background(), "broken", nil)
+	if err == nil || !strings.Contains(err.Error(), "400 Bad Request: PQL parse error") {
+		t.Fatalf("expected a query error got %v", err)
+	}
+
+	_, err = NewPuppetDB("http://localhost:1").Discover(context.Background(), time.Second, "", Filter{}, map[string]string{"url": srv.URL + "/missing"})
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected a not found error got %v", err)
+	}
+}
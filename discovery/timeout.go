@@ -0,0 +1,111 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is used when a request does not have a positive timeout
+const DefaultTimeout = 10 * time.Second
+
+// TimeoutError is returned when discovery does not complete before the request timeout
+type TimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("discovery did not complete within %v", e.Timeout)
+}
+
+type nodeReporterKey struct{}
+
+// nodeReporter collects the nodes a discovery function found so far
+type nodeReporter struct {
+	mu    sync.Mutex
+	nodes map[string]bool
+}
+
+// ReportNodes records nodes found so far by the discovery function using the ctx it was called with, when
+// partial results are enabled using SetPartialResults these nodes are returned should discovery time out
+func ReportNodes(ctx context.Context, nodes ...string) {
+	r, ok := ctx.Value(nodeReporterKey{}).(*nodeReporter)
+	if !ok {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, node := range nodes {
+		r.nodes[node] = true
+	}
+}
+
+func (r *nodeReporter) found() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	return nodes
+}
+
+// SetPartialResults returns the nodes reported using ReportNodes instead of a timeout error when discovery
+// does not complete in time
+func (d *Discovery) SetPartialResults(partial bool) {
+	d.partial = partial
+}
+
+// supervise runs discovery in the background so the timeout is enforced even when the discovery function
+// does not honor its context
+func (d *Discovery) supervise(timeout time.Duration, collective string, filter Filter, options map[string]string) ([]string, error) {
+	reporter := &nodeReporter{nodes: make(map[string]bool)}
+
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), nodeReporterKey{}, reporter), timeout)
+	defer cancel()
+
+	type result struct {
+		nodes []string
+		err   error
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+		nodes, err := d.discover(ctx, timeout, collective, filter, options)
+		done <- result{nodes: nodes, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		// failures caused by the context expiring are reported as timeouts
+		if res.err == nil || ctx.Err() == nil {
+			return res.nodes, res.err
+		}
+
+	case <-ctx.Done():
+	}
+
+	if cached := d.cachedNodes(collective, filter, options); cached != nil {
+		fmt.Fprintf(os.Stderr, "Discovery did not complete within %v, using the result from %s\n", timeout, cached.Time.Format(time.RFC3339))
+		return cached.Nodes, nil
+	}
+
+	if d.partial {
+		nodes := reporter.found()
+		if len(nodes) > 0 {
+			fmt.Fprintf(os.Stderr, "Discovery did not complete within %v, using %d nodes found so far\n", timeout, len(nodes))
+			return nodes, nil
+		}
+	}
+
+	return nil, &TimeoutError{Timeout: timeout}
+}
@@ -0,0 +1,160 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiscoveryTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	d := NewDiscovery(func(ctx context.Context, timeout time.Duration, collective string, filter Filter, options map[string]string) ([]string, error) {
+		ReportNodes(ctx, "web2", "web1")
+		ReportNodes(ctx, "web1")
+
+		// ignores ctx
+		<-release
+
+		return []string{"web1", "web2", "web3"}, nil
+	})
+
+	req := newRequest()
+	req.Timeout = 0.1
+
+	start := time.Now()
+	_, err := d.processRequest(&req)
+	if time.Since(start) > time.Second {
+		t.Fatalf("timeout was not enforced, took %v", time.Since(start))
+	}
+
+	var terr *TimeoutError
+	if !errors.As(err, &terr) || terr.Timeout != 100*time.Millisecond {
+		t.Fatalf("expected a timeout error got %v", err)
+	}
+
+	if err.Error() != "discovery did not complete within 100ms" {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	d.SetPartialResults(true)
+
+	reply, err := d.processRequest(&req)
+	if err != nil {
+		t.Fatalf("expected partial results got %s", err)
+	}
+
+	if !reflect.DeepEqual(reply.Nodes, []string{"web1", "web2"}) {
+		t.Fatalf("unexpected partial nodes %v", reply.Nodes)
+	}
+}
+
+func TestDiscoveryTimeoutContext(t *testing.T) {
+	d := NewDiscovery(func(ctx context.Context, timeout time.Duration, collective string, filter Filter, options map[string]string) ([]string, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	d.SetPartialResults(true)
+
+	req := newRequest()
+	req.Timeout = 0.05
+
+	// nothing was reported so the timeout is an error even with partial results enabled
+	_, err := d.processRequest(&req)
+	var terr *TimeoutError
+	if !errors.As(err, &terr) {
+		t.Fatalf("expected a timeout error got %v", err)
+	}
+}
+
+func TestDiscoveryDefaultTimeout(t *testing.T) {
+	d := NewDiscovery(func(ctx context.Context, timeout time.Duration, collective string, filter Filter, options map[string]string) ([]string, error) {
+		if timeout != DefaultTimeout {
+			return nil, errors.New("default timeout was not used")
+		}
+
+		deadline, ok := ctx.Deadline()
+		if !ok || time.Until(deadline) < DefaultTimeout-time.Second {
+			return nil, errors.New("context does not have the default timeout")
+		}
+
+		return append(filter.Class, "web1"), nil
+	})
+
+	for _, timeout := range []float64{0, -1} {
+		req := newRequest()
+		req.Timeout = timeout
+		req.Filter = nil
+
+		reply, err := d.processRequest(&req)
+		if err != nil {
+			t.Fatalf("timeout %v: discovery failed: %s", timeout, err)
+		}
+
+		if !reflect.DeepEqual(reply.Nodes, []string{"web1"}) {
+			t.Fatalf("timeout %v: unexpected nodes %v", timeout, reply.Nodes)
+		}
+	}
+}
+
+func TestDiscoveryTimeoutCache(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	slow := false
+
+	d := NewDiscovery(func(ctx context.Context, timeout time.Duration, collective string, filter Filter, options map[string]string) ([]string, error) {
+		if slow {
+			// ignores ctx
+			<-release
+		}
+
+		return []string{"web1", "web2"}, nil
+	})
+	d.SetCache(testDir(t), time.Hour)
+
+	req := newRequest()
+	req.Timeout = 0.1
+
+	_, err := d.processRequest(&req)
+	if err != nil {
+		t.Fatalf("discovery failed: %s", err)
+	}
+
+	// the backend is slow and the cached result has expired, the stale result is used rather than failing
+	slow = true
+	ageCacheEntry(t, d, req.Collective, *req.Filter, req.Options, 2*time.Hour)
+
+	reply, err := d.processRequest(&req)
+	if err != nil {
+		t.Fatalf("expected the cached result got %s", err)
+	}
+
+	if !reflect.DeepEqual(reply.Nodes, []string{"web1", "web2"}) {
+		t.Fatalf("unexpected nodes %v", reply.Nodes)
+	}
+
+	var terr *TimeoutError
+
+	// bypassing the cache never uses it
+	options := req.Options
+	req.Options = map[string]string{"nocache": "true"}
+	for k, v := range options {
+		req.Options[k] = v
+	}
+
+	_, err = d.processRequest(&req)
+	if !errors.As(err, &terr) {
+		t.Fatalf("expected a timeout error when bypassing the cache got %v", err)
+	}
+
+	req.Options = options
+	req.Collective = "other"
+	_, err = d.processRequest(&req)
+	if !errors.As(err, &terr) {
+		t.Fatalf("expected a timeout error without a cached result got %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+// Package flock provides advisory file locks that are shared between processes
+package flock
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrLocked indicates the lock is held by another process
+var ErrLocked = errors.New("lock is held by another process")
+
+// Lock is a held advisory lock on a file
+type Lock struct {
+	f *os.File
+}
+
+// TryLock attempts to obtain an exclusive lock on path without waiting, ErrLocked is returned when it is held elsewhere
+func TryLock(path string) (*Lock, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lockFile(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &Lock{f: f}, nil
+}
+
+// WaitLock attempts to obtain an exclusive lock on path, retrying every interval until ctx is done
+func WaitLock(ctx context.Context, path string, interval time.Duration) (*Lock, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		lock, err := TryLock(path)
+		if err != ErrLocked {
+			return lock, err
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, ErrLocked
+		}
+	}
+}
+
+// File is the open lock file, it can be used to store information about the holder
+func (l *Lock) File() *os.File {
+	return l.f
+}
+
+// Unlock releases the lock and closes the lock file
+func (l *Lock) Unlock() error {
+	err := unlockFile(l.f)
+	cerr := l.f.Close()
+	if err != nil {
+		return err
+	}
+
+	return cerr
+}
@@ -0,0 +1,273 @@
+// Package metrics records Prometheus metrics into a node-exporter textfile collector file, every process
+// merges its updates into the file while holding a lock so concurrent invocations do not lose updates
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/choria-io/go-external/internal/flock"
+)
+
+// Labels are the labels of a sample
+type Labels map[string]string
+
+// DefaultLockTimeout is how long Write waits for other processes to finish updating the file
+const DefaultLockTimeout = 2 * time.Second
+
+// Set is a set of metric updates to merge into a textfile
+type Set struct {
+	families map[string]*family
+	order    []string
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    string
+	samples map[string]float64
+	order   []string
+}
+
+// NewSet creates an empty set of updates
+func NewSet() *Set {
+	return &Set{families: make(map[string]*family)}
+}
+
+func (s *Set) family(name string, help string, kind string) *family {
+	f, ok := s.families[name]
+	if !ok {
+		f = &family{name: name, help: help, kind: kind, samples: make(map[string]float64)}
+		s.families[name] = f
+		s.order = append(s.order, name)
+	}
+
+	if f.help == "" {
+		f.help = help
+	}
+
+	if f.kind == "" {
+		f.kind = kind
+	}
+
+	return f
+}
+
+func (f *family) add(sample string, v float64) {
+	_, ok := f.samples[sample]
+	if !ok {
+		f.order = append(f.order, sample)
+	}
+
+	f.samples[sample] += v
+}
+
+// Counter adds v to the counter name
+func (s *Set) Counter(name string, help string, labels Labels, v float64) {
+	s.family(name, help, "counter").add(sampleName(name, labels, "", ""), v)
+}
+
+// Observe records v in the histogram name, buckets are the upper bounds of the histogram buckets
+func (s *Set) Observe(name string, help string, buckets []float64, labels Labels, v float64) {
+	f := s.family(name, help, "histogram")
+
+	for _, b := range buckets {
+		inc := 0.0
+		if v <= b {
+			inc = 1
+		}
+
+		f.add(sampleName(name+"_bucket", labels, "le", formatFloat(b)), inc)
+	}
+
+	f.add(sampleName(name+"_bucket", labels, "le", "+Inf"), 1)
+	f.add(sampleName(name+"_sum", labels, "", ""), v)
+	f.add(sampleName(name+"_count", labels, "", ""), 1)
+}
+
+// Write merges the updates into the textfile at path, waiting up to timeout for other processes updating it
+func (s *Set) Write(path string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	lock, err := flock.WaitLock(ctx, path+".lock", 10*time.Millisecond)
+	if err != nil {
+		return fmt.Errorf("could not lock %s: %s", path, err)
+	}
+	defer lock.Unlock()
+
+	current, err := readFile(path)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range s.order {
+		f := s.families[name]
+		cf := current.family(name, f.help, f.kind)
+		for _, sample := range f.order {
+			cf.add(sample, f.samples[sample])
+		}
+	}
+
+	return writeFile(path, current.bytes())
+}
+
+// readFile parses a textfile previously written by Write, a missing file is an empty set
+func readFile(path string) (*Set, error) {
+	set := NewSet()
+
+	tf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return set, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var current *family
+	scanner := bufio.NewScanner(bytes.NewReader(tf))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			parts := strings.SplitN(line, " ", 4)
+			if len(parts) < 3 {
+				continue
+			}
+
+			switch parts[1] {
+			case "HELP":
+				current = set.family(parts[2], "", "")
+				if len(parts) == 4 {
+					current.help = parts[3]
+				}
+
+			case "TYPE":
+				current = set.family(parts[2], "", "")
+				if len(parts) == 4 {
+					current.kind = parts[3]
+				}
+			}
+
+			continue
+		}
+
+		i := strings.LastIndex(line, " ")
+		if i == -1 {
+			return nil, fmt.Errorf("invalid sample in %s: %s", path, line)
+		}
+
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sample in %s: %s", path, line)
+		}
+
+		sample := line[:i]
+		if current == nil || !strings.HasPrefix(sample, current.name) {
+			name := sample
+			if j := strings.Index(name, "{"); j > -1 {
+				name = name[:j]
+			}
+			current = set.family(name, "", "untyped")
+		}
+
+		current.add(sample, v)
+	}
+
+	return set, scanner.Err()
+}
+
+func (s *Set) bytes() []byte {
+	names := append([]string{}, s.order...)
+	sort.Strings(names)
+
+	buf := &bytes.Buffer{}
+	for _, name := range names {
+		f := s.families[name]
+		if f.help != "" {
+			fmt.Fprintf(buf, "# HELP %s %s\n", name, f.help)
+		}
+		if f.kind != "" {
+			fmt.Fprintf(buf, "# TYPE %s %s\n", name, f.kind)
+		}
+
+		for _, sample := range f.order {
+			fmt.Fprintf(buf, "%s %s\n", sample, formatFloat(f.samples[sample]))
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// writeFile atomically replaces path so the collector never sees a partial file
+func writeFile(path string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	// the collector only reads files ending in .prom so the temporary file is ignored
+	tf, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+
+	_, err = tf.Write(data)
+	if err != nil {
+		tf.Close()
+		return err
+	}
+
+	err = tf.Chmod(0644)
+	if err != nil {
+		tf.Close()
+		return err
+	}
+
+	err = tf.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tf.Name(), path)
+}
+
+func sampleName(name string, labels Labels, extraName string, extraValue string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys)+1)
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, labels[k]))
+	}
+
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extraName, extraValue))
+	}
+
+	if len(pairs) == 0 {
+		return name
+	}
+
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
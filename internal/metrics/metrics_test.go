@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
+
+func TestWrite(t *testing.T) {
+	path := filepath.Join(tempDir(t), "agent.prom")
+
+	for i := 0; i < 2; i++ {
+		set := NewSet()
+		set.Counter("test_requests_total", "Test requests", Labels{"action": "ping"}, 1)
+		set.Observe("test_duration_seconds", "Test durations", []float64{0.1, 1}, Labels{"action": "ping"}, 0.5)
+
+		err := set.Write(path, time.Second)
+		if err != nil {
+			t.Fatalf("write failed: %s", err)
+		}
+	}
+
+	tf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+
+	expected := `# HELP test_duration_seconds Test durations
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{action="ping",le="0.1"} 0
+test_duration_seconds_bucket{action="ping",le="1"} 2
+test_duration_seconds_bucket{action="ping",le="+Inf"} 2
+test_duration_seconds_sum{action="ping"} 1
+test_duration_seconds_count{action="ping"} 2
+# HELP test_requests_total Test requests
+# TYPE test_requests_total counter
+test_requests_total{action="ping"} 2
+`
+
+	if string(tf) != expected {
+		t.Fatalf("unexpected textfile:\n%s", tf)
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat failed: %s", err)
+	}
+
+	if stat.Mode().Perm() != 0644 {
+		t.Fatalf("expected textfile to be world readable got %v", stat.Mode())
+	}
+}
+
+func TestWriteConcurrent(t *testing.T) {
+	path := filepath.Join(tempDir(t), "agent.prom")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			set := NewSet()
+			set.Counter("test_requests_total", "Test requests", nil, 1)
+			err := set.Write(path, 10*time.Second)
+			if err != nil {
+				t.Errorf("write failed: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	tf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+
+	if !strings.Contains(string(tf), "\ntest_requests_total 20\n") {
+		t.Fatalf("updates were lost:\n%s", tf)
+	}
+}
+
+func TestWriteKeepsOtherMetrics(t *testing.T) {
+	path := filepath.Join(tempDir(t), "agent.prom")
+
+	err := ioutil.WriteFile(path, []byte("# HELP other_total Other\n# TYPE other_total counter\nother_total{x=\"y\"} 5\n"), 0644)
+	if err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+
+	set := NewSet()
+	set.Counter("test_requests_total", "Test requests", nil, 1)
+	err = set.Write(path, time.Second)
+	if err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+
+	tf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+
+	if !strings.Contains(string(tf), "# TYPE other_total counter\nother_total{x=\"y\"} 5\n") {
+		t.Fatalf("existing metrics were lost:\n%s", tf)
+	}
+}
@@ -0,0 +1,102 @@
+// Package schemas holds the JSON schemas of the Choria external agent and discovery protocols and a small
+// validator supporting the subset of JSON Schema they use, no network access is needed to validate documents
+package schemas
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Mode determines what happens when a document does not match its schema
+type Mode string
+
+const (
+	// Off disables schema validation
+	Off = Mode("off")
+
+	// Warn logs validation failures but continues processing
+	Warn = Mode("warn")
+
+	// Strict fails processing of documents that do not match their schema
+	Strict = Mode("strict")
+)
+
+// ParseMode parses a validation mode, an empty string is Off
+func ParseMode(mode string) (Mode, error) {
+	switch Mode(mode) {
+	case "", Off:
+		return Off, nil
+	case Warn, Strict:
+		return Mode(mode), nil
+	default:
+		return Off, fmt.Errorf("invalid schema validation mode %q", mode)
+	}
+}
+
+const baseURL = "https://choria.io/schemas/"
+
+//go:embed mcorpc choria
+var files embed.FS
+
+// Schema returns the JSON schema identified by its URL, for example https://choria.io/schemas/mcorpc/external/v1/rpc_request.json
+func Schema(url string) ([]byte, error) {
+	if !strings.HasPrefix(url, baseURL) {
+		return nil, fmt.Errorf("unknown schema %s", url)
+	}
+
+	s, err := files.ReadFile(strings.TrimPrefix(url, baseURL))
+	if err != nil {
+		return nil, fmt.Errorf("unknown schema %s", url)
+	}
+
+	return s, nil
+}
+
+// Validate validates the JSON document doc against the schema identified by url
+func Validate(url string, doc []byte) error {
+	sj, err := Schema(url)
+	if err != nil {
+		return err
+	}
+
+	schema := &schema{}
+	err = json.Unmarshal(sj, schema)
+	if err != nil {
+		return fmt.Errorf("invalid schema %s: %s", url, err)
+	}
+
+	var data interface{}
+	err = json.Unmarshal(doc, &data)
+	if err != nil {
+		return fmt.Errorf("invalid JSON document: %s", err)
+	}
+
+	errs := &ValidationError{Schema: url}
+	schema.validate("", data, errs)
+
+	if len(errs.Errors) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// ValidationError lists all the ways in which a document does not match its schema
+type ValidationError struct {
+	Schema string
+	Errors []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("document does not match %s: %s", e.Schema, strings.Join(e.Errors, ", "))
+}
+
+func (e *ValidationError) add(path string, format string, a ...interface{}) {
+	if path == "" {
+		path = "(root)"
+	}
+
+	e.Errors = append(e.Errors, fmt.Sprintf("%s: %s", path, fmt.Sprintf(format, a...)))
+}
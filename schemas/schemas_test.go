@@ -0,0 +1,99 @@
+package schemas
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMode(t *testing.T) {
+	for in, expected := range map[string]Mode{"": Off, "off": Off, "warn": Warn, "strict": Strict} {
+		mode, err := ParseMode(in)
+		if err != nil {
+			t.Fatalf("parsing %q failed: %s", in, err)
+		}
+
+		if mode != expected {
+			t.Fatalf("expected %q for %q got %q", expected, in, mode)
+		}
+	}
+
+	_, err := ParseMode("loud")
+	if err == nil {
+		t.Fatalf("expected invalid mode to fail")
+	}
+}
+
+func TestSchema(t *testing.T) {
+	for _, s := range []string{
+		"https://choria.io/schemas/mcorpc/external/v1/rpc_request.json",
+		"https://choria.io/schemas/mcorpc/external/v1/rpc_reply.json",
+		"https://choria.io/schemas/mcorpc/external/v1/activation_request.json",
+		"https://choria.io/schemas/mcorpc/external/v1/activation_reply.json",
+		"https://choria.io/schemas/mcorpc/external/v2/rpc_request.json",
+		"https://choria.io/schemas/mcorpc/external/v2/rpc_reply.json",
+		"https://choria.io/schemas/mcorpc/external/v2/activation_request.json",
+		"https://choria.io/schemas/mcorpc/external/v2/activation_reply.json",
+		"https://choria.io/schemas/choria/discovery/v1/external_request.json",
+		"https://choria.io/schemas/choria/discovery/v1/external_reply.json",
+		"https://choria.io/schemas/choria/discovery/v2/external_request.json",
+		"https://choria.io/schemas/choria/discovery/v2/external_reply.json",
+	} {
+		_, err := Schema(s)
+		if err != nil {
+			t.Fatalf("schema %s failed: %s", s, err)
+		}
+
+		// an empty object is not a valid document for any of the schemas but the schema should parse
+		err = Validate(s, []byte(`{}`))
+		if _, ok := err.(*ValidationError); !ok {
+			t.Fatalf("expected a validation error for %s got %v", s, err)
+		}
+	}
+
+	_, err := Schema("https://choria.io/schemas/mcorpc/external/v9/rpc_request.json")
+	if err == nil {
+		t.Fatalf("expected unknown schema to fail")
+	}
+
+	_, err = Schema("https://example.net/schemas/mcorpc/external/v1/rpc_request.json")
+	if err == nil {
+		t.Fatalf("expected foreign schema to fail")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	reply := "https://choria.io/schemas/mcorpc/external/v1/rpc_reply.json"
+
+	err := Validate(reply, []byte(`{"statuscode": 0, "statusmsg": "", "data": {"message": "pong"}}`))
+	if err != nil {
+		t.Fatalf("valid reply failed: %s", err)
+	}
+
+	err = Validate(reply, []byte(`{"statuscode": 9, "statusmsg": 1}`))
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error got %v", err)
+	}
+
+	expected := []string{
+		"(root): required property data is missing",
+		"statuscode: 9 is greater than the maximum 5",
+		"statusmsg: expected string but got integer",
+	}
+
+	if strings.Join(verr.Errors, "|") != strings.Join(expected, "|") {
+		t.Fatalf("unexpected errors: %v", verr.Errors)
+	}
+
+	err = Validate(reply, []byte(`{`))
+	if err == nil || !strings.HasPrefix(err.Error(), "invalid JSON document") {
+		t.Fatalf("expected invalid JSON to fail: %v", err)
+	}
+
+	request := "https://choria.io/schemas/choria/discovery/v1/external_request.json"
+	err = Validate(request, []byte(`{"protocol": "io.choria.choria.discovery.v1.external_request", "timeout": 2, "collective": "mcollective", "filter": {"fact": [{"fact": "country", "operator": "~", "value": "mt"}]}}`))
+	verr, ok = err.(*ValidationError)
+	if !ok || len(verr.Errors) != 1 || verr.Errors[0] != "filter.fact[0].operator: ~ is not one of the allowed values" {
+		t.Fatalf("unexpected result: %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+package schemas
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// schema is the supported subset of a JSON Schema draft 7 document
+type schema struct {
+	Type                 typeList           `json:"type"`
+	Properties           map[string]*schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *additional        `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	Enum                 []interface{}      `json:"enum"`
+	Pattern              string             `json:"pattern"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	MinItems             *int               `json:"minItems"`
+	AnyOf                []*schema          `json:"anyOf"`
+}
+
+// typeList is the type keyword that can be a single type or a list of types
+type typeList []string
+
+func (t *typeList) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*t = typeList{single}
+		return nil
+	}
+
+	var list []string
+	err := json.Unmarshal(data, &list)
+	if err != nil {
+		return err
+	}
+
+	*t = list
+
+	return nil
+}
+
+// additional is the additionalProperties keyword that can be a boolean or a schema
+type additional struct {
+	allowed bool
+	schema  *schema
+}
+
+func (a *additional) UnmarshalJSON(data []byte) error {
+	if json.Unmarshal(data, &a.allowed) == nil {
+		return nil
+	}
+
+	a.allowed = true
+	a.schema = &schema{}
+
+	return json.Unmarshal(data, a.schema)
+}
+
+func (s *schema) validate(path string, data interface{}, errs *ValidationError) {
+	if len(s.Type) > 0 && !s.matchesType(data) {
+		errs.add(path, "expected %s but got %s", strings.Join(s.Type, " or "), typeName(data))
+		return
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(e, data) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			errs.add(path, "%v is not one of the allowed values", data)
+		}
+	}
+
+	if len(s.AnyOf) > 0 {
+		matched := false
+		for _, option := range s.AnyOf {
+			oerrs := &ValidationError{}
+			option.validate(path, data, oerrs)
+			if len(oerrs.Errors) == 0 {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			errs.add(path, "does not match any of the allowed schemas")
+		}
+	}
+
+	switch v := data.(type) {
+	case map[string]interface{}:
+		s.validateObject(path, v, errs)
+
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			errs.add(path, "expected at least %d items", *s.MinItems)
+		}
+
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(indexPath(path, i), item, errs)
+			}
+		}
+
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			errs.add(path, "expected at least %d characters", *s.MinLength)
+		}
+
+		if s.MaxLength != nil && length > *s.MaxLength {
+			errs.add(path, "expected at most %d characters", *s.MaxLength)
+		}
+
+		if s.Pattern != "" {
+			re, err := regexp.Compile(s.Pattern)
+			if err != nil || !re.MatchString(v) {
+				errs.add(path, "does not match pattern %s", s.Pattern)
+			}
+		}
+
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			errs.add(path, "%v is less than the minimum %v", v, *s.Minimum)
+		}
+
+		if s.Maximum != nil && v > *s.Maximum {
+			errs.add(path, "%v is greater than the maximum %v", v, *s.Maximum)
+		}
+	}
+}
+
+func (s *schema) validateObject(path string, obj map[string]interface{}, errs *ValidationError) {
+	for _, req := range s.Required {
+		if _, ok := obj[req]; !ok {
+			errs.add(path, "required property %s is missing", req)
+		}
+	}
+
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		prop, ok := s.Properties[k]
+		switch {
+		case ok:
+			prop.validate(propertyPath(path, k), obj[k], errs)
+
+		case s.AdditionalProperties == nil:
+
+		case !s.AdditionalProperties.allowed:
+			errs.add(path, "additional property %s is not allowed", k)
+
+		case s.AdditionalProperties.schema != nil:
+			s.AdditionalProperties.schema.validate(propertyPath(path, k), obj[k], errs)
+		}
+	}
+}
+
+func (s *schema) matchesType(data interface{}) bool {
+	actual := typeName(data)
+
+	for _, t := range s.Type {
+		if t == actual || t == "number" && actual == "integer" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func typeName(data interface{}) string {
+	switch v := data.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return "unknown"
+	}
+}
+
+func propertyPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+
+	return path + "." + name
+}
+
+func indexPath(path string, i int) string {
+	return path + "[" + strconv.Itoa(i) + "]"
+}
@@ -0,0 +1,53 @@
+package transport
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// File is a transport using files created by Choria for every request
+type File struct {
+	// RequestPath is the file holding the request
+	RequestPath string
+
+	// ReplyPath is the file the reply will be written to, it has to exist
+	ReplyPath string
+}
+
+// NewFile creates a file transport using the files named in CHORIA_EXTERNAL_REQUEST and CHORIA_EXTERNAL_REPLY
+func NewFile() *File {
+	return &File{
+		RequestPath: os.Getenv("CHORIA_EXTERNAL_REQUEST"),
+		ReplyPath:   os.Getenv("CHORIA_EXTERNAL_REPLY"),
+	}
+}
+
+// ReadRequest reads the request file
+func (f *File) ReadRequest() ([]byte, error) {
+	if f.RequestPath == "" {
+		return nil, fmt.Errorf("no request file set in CHORIA_EXTERNAL_REQUEST")
+	}
+
+	rj, err := ioutil.ReadFile(f.RequestPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read request from CHORIA_EXTERNAL_REQUEST file: %s", err)
+	}
+
+	return rj, nil
+}
+
+// WriteReply replaces the contents of the reply file
+func (f *File) WriteReply(reply []byte) error {
+	stat, err := os.Stat(f.ReplyPath)
+	if err != nil {
+		return fmt.Errorf("reply file '%s' from CHORIA_EXTERNAL_REPLY does not exist", f.ReplyPath)
+	}
+
+	err = ioutil.WriteFile(f.ReplyPath, reply, stat.Mode())
+	if err != nil {
+		return fmt.Errorf("failed writing to reply file %s: %s", f.ReplyPath, err)
+	}
+
+	return nil
+}
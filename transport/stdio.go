@@ -0,0 +1,47 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Stdio is a transport that reads the request from STDIN and writes the reply to a file descriptor other
+// than STDOUT, leaving STDOUT free for logging
+type Stdio struct {
+	In  io.Reader
+	Out io.Writer
+}
+
+// NewStdio creates a transport reading from STDIN and writing replies to the file descriptor fd
+func NewStdio(fd int) *Stdio {
+	return &Stdio{
+		In:  os.Stdin,
+		Out: os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd)),
+	}
+}
+
+// ReadRequest reads the request from the input until EOF
+func (s *Stdio) ReadRequest() ([]byte, error) {
+	rj, err := ioutil.ReadAll(s.In)
+	if err != nil {
+		return nil, fmt.Errorf("could not read request from STDIN: %s", err)
+	}
+
+	return rj, nil
+}
+
+// WriteReply writes the reply to the output and closes it when possible
+func (s *Stdio) WriteReply(reply []byte) error {
+	_, err := s.Out.Write(reply)
+	if err != nil {
+		return fmt.Errorf("could not write reply: %s", err)
+	}
+
+	if c, ok := s.Out.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
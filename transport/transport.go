@@ -0,0 +1,52 @@
+// Package transport moves external protocol requests and replies between Choria and the external plugin
+package transport
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Transport reads the request for and writes the reply from an external plugin
+type Transport interface {
+	// ReadRequest reads the JSON request
+	ReadRequest() ([]byte, error)
+
+	// WriteReply writes the JSON reply
+	WriteReply(reply []byte) error
+}
+
+const (
+	// FileTransport is the name of the transport that uses the files named in CHORIA_EXTERNAL_REQUEST and CHORIA_EXTERNAL_REPLY
+	FileTransport = "file"
+
+	// StdioTransport is the name of the transport that reads requests from STDIN and writes replies to a file descriptor
+	StdioTransport = "stdio"
+
+	// DefaultReplyFD is the file descriptor replies are written to by the stdio transport when CHORIA_EXTERNAL_REPLY_FD is not set
+	DefaultReplyFD = 3
+)
+
+// FromEnvironment creates the transport named in CHORIA_EXTERNAL_TRANSPORT, defaulting to the file transport
+func FromEnvironment() (Transport, error) {
+	switch os.Getenv("CHORIA_EXTERNAL_TRANSPORT") {
+	case "", FileTransport:
+		return NewFile(), nil
+
+	case StdioTransport:
+		fd := DefaultReplyFD
+
+		if os.Getenv("CHORIA_EXTERNAL_REPLY_FD") != "" {
+			var err error
+			fd, err = strconv.Atoi(os.Getenv("CHORIA_EXTERNAL_REPLY_FD"))
+			if err != nil || fd < 0 {
+				return nil, fmt.Errorf("invalid file descriptor %q in CHORIA_EXTERNAL_REPLY_FD", os.Getenv("CHORIA_EXTERNAL_REPLY_FD"))
+			}
+		}
+
+		return NewStdio(fd), nil
+
+	default:
+		return nil, fmt.Errorf("unknown transport %q in CHORIA_EXTERNAL_TRANSPORT", os.Getenv("CHORIA_EXTERNAL_TRANSPORT"))
+	}
+}
@@ -0,0 +1,134 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func cleanEnv() {
+	os.Unsetenv("CHORIA_EXTERNAL_REQUEST")
+	os.Unsetenv("CHORIA_EXTERNAL_REPLY")
+	os.Unsetenv("CHORIA_EXTERNAL_TRANSPORT")
+	os.Unsetenv("CHORIA_EXTERNAL_REPLY_FD")
+}
+
+func TestFromEnvironment(t *testing.T) {
+	defer cleanEnv()
+
+	tr, err := FromEnvironment()
+	if err != nil {
+		t.Fatalf("default transport failed: %s", err)
+	}
+	if _, ok := tr.(*File); !ok {
+		t.Fatalf("expected the file transport by default, got %T", tr)
+	}
+
+	os.Setenv("CHORIA_EXTERNAL_TRANSPORT", "stdio")
+	tr, err = FromEnvironment()
+	if err != nil {
+		t.Fatalf("stdio transport failed: %s", err)
+	}
+	if _, ok := tr.(*Stdio); !ok {
+		t.Fatalf("expected the stdio transport, got %T", tr)
+	}
+
+	os.Setenv("CHORIA_EXTERNAL_REPLY_FD", "bogus")
+	_, err = FromEnvironment()
+	if err == nil {
+		t.Fatalf("expected invalid file descriptor to fail")
+	}
+
+	os.Setenv("CHORIA_EXTERNAL_TRANSPORT", "bogus")
+	_, err = FromEnvironment()
+	if err == nil {
+		t.Fatalf("expected unknown transport to fail")
+	}
+}
+
+func TestFile(t *testing.T) {
+	defer cleanEnv()
+
+	dir, err := ioutil.TempDir("", "transport")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("CHORIA_EXTERNAL_REQUEST", filepath.Join(dir, "request.json"))
+	os.Setenv("CHORIA_EXTERNAL_REPLY", filepath.Join(dir, "reply.json"))
+
+	tr := NewFile()
+
+	_, err = tr.ReadRequest()
+	if err == nil {
+		t.Fatalf("expected missing request to fail")
+	}
+
+	err = tr.WriteReply([]byte("{}"))
+	if err == nil {
+		t.Fatalf("expected missing reply file to fail")
+	}
+
+	ioutil.WriteFile(tr.RequestPath, []byte(`{"request":1}`), 0600)
+	ioutil.WriteFile(tr.ReplyPath, []byte("previous reply"), 0600)
+
+	req, err := tr.ReadRequest()
+	if err != nil || string(req) != `{"request":1}` {
+		t.Fatalf("unexpected request %q: %v", req, err)
+	}
+
+	err = tr.WriteReply([]byte(`{"reply":1}`))
+	if err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+
+	rep, _ := ioutil.ReadFile(tr.ReplyPath)
+	if string(rep) != `{"reply":1}` {
+		t.Fatalf("unexpected reply %q", rep)
+	}
+}
+
+func TestStdio(t *testing.T) {
+	defer cleanEnv()
+
+	out := &bytes.Buffer{}
+	tr := &Stdio{In: bytes.NewBufferString(`{"request":1}`), Out: out}
+
+	req, err := tr.ReadRequest()
+	if err != nil || string(req) != `{"request":1}` {
+		t.Fatalf("unexpected request %q: %v", req, err)
+	}
+
+	err = tr.WriteReply([]byte(`{"reply":1}`))
+	if err != nil || out.String() != `{"reply":1}` {
+		t.Fatalf("unexpected reply %q: %v", out.String(), err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe failed: %s", err)
+	}
+	defer r.Close()
+
+	os.Setenv("CHORIA_EXTERNAL_TRANSPORT", "stdio")
+	os.Setenv("CHORIA_EXTERNAL_REPLY_FD", fmt.Sprintf("%d", w.Fd()))
+
+	env, err := FromEnvironment()
+	if err != nil {
+		t.Fatalf("stdio transport failed: %s", err)
+	}
+
+	err = env.WriteReply([]byte(`{"reply":2}`))
+	if err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+
+	rep, _ := ioutil.ReadAll(r)
+	if string(rep) != `{"reply":2}` {
+		t.Fatalf("unexpected reply %q", rep)
+	}
+}